@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Problem is a JSON problem details object (RFC 7807), returned by the API middlewares
+// with the content type "application/problem+json".
+type Problem struct {
+	Type   string `json:"type"`             // "about:blank"
+	Title  string `json:"title"`            // Status text (Ex: "Unauthorized")
+	Status int    `json:"status"`           // HTTP status code
+	Detail string `json:"detail,omitempty"` // Explanation for the client (Ex: "session expired")
+}
+
+// WriteProblem writes a problem details response (RFC 7807) with the status code, so API
+// handlers can report their errors in the same format as the API middlewares.
+func WriteProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// CORSOptions configures the cross-origin requests accepted by the API middlewares.
+// With no AllowedOrigins, cross-origin requests are not allowed.
+type CORSOptions struct {
+	// AllowedOrigins (Ex: "https://app.example.com"). "*" allows any origin, but only with
+	// Bearer tokens: AllowCredentials is ignored and cookies of other origins are not read.
+	AllowedOrigins []string
+
+	// AllowedMethods of preflight requests (default GET, HEAD, POST, PUT, PATCH and DELETE).
+	AllowedMethods []string
+
+	// AllowedHeaders of preflight requests (default Authorization and Content-Type).
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers readable by the client.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with cookies from the listed AllowedOrigins.
+	AllowCredentials bool
+
+	// MaxAge is the time in seconds that browsers can cache the preflight response.
+	MaxAge int
+}
+
+// GetAPIMiddleware is the GetAuthMiddleware of JSON APIs, for SPA and mobile clients.
+//
+// Sessions are read from the header "Authorization: Bearer <token>" (see NewSessionToken)
+// or, without that header, from the session cookie. Only the API middlewares read the
+// header. Requests without a valid session get a 401 status code, and users
+// with an auth level lower than required get a 403 status code. Both responses have a
+// problem details body (RFC 7807, see Problem). No redirection is done.
+//
+// Cross-origin requests are allowed as set in cors, and preflight requests (OPTIONS) are
+// answered by the middleware without authentication. Requests from other origins get a
+// 403 status code.
+func GetAPIMiddleware(authLevel int, cors CORSOptions) func(http.Handler) http.Handler {
+	return defaultAuth.GetAPIMiddleware(authLevel, cors)
+}
+
+// GetAPIMiddleware is the GetAuthMiddleware of JSON APIs. See GetAPIMiddleware.
+func (a *Authenticator) GetAPIMiddleware(authLevel int, cors CORSOptions) func(http.Handler) http.Handler {
+	return a.RequireAPI(Level(authLevel), cors)
+}
+
+// RequireAPI is the Require of JSON APIs. It only allows users who pass the rule, and
+// answers as GetAPIMiddleware.
+func RequireAPI(rule Rule, cors CORSOptions) func(http.Handler) http.Handler {
+	return defaultAuth.RequireAPI(rule, cors)
+}
+
+// RequireAPI is the Require of JSON APIs. See RequireAPI.
+func (a *Authenticator) RequireAPI(rule Rule, cors CORSOptions) func(http.Handler) http.Handler {
+	if len(cors.AllowedMethods) == 0 {
+		cors.AllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(cors.AllowedHeaders) == 0 {
+		cors.AllowedHeaders = []string{"Authorization", "Content-Type"}
+	}
+
+	authenticate := a.require(rule, a.getAPISession, func(w http.ResponseWriter, r *http.Request, err error) {
+		switch {
+		case errors.Is(err, ErrInsufficientLevel):
+			WriteProblem(w, http.StatusForbidden, ErrInsufficientLevel.Error())
+		case errors.Is(err, ErrSessionExpired), errors.Is(err, ErrSessionRevoked):
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			WriteProblem(w, http.StatusUnauthorized, errors.Unwrap(err).Error())
+		case errors.Is(err, ErrNoSession):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteProblem(w, http.StatusUnauthorized, ErrNoSession.Error())
+		default:
+			log.Printf("API request not authenticated: %s", err)
+			WriteProblem(w, http.StatusInternalServerError, "")
+		}
+	})
+
+	return func(next http.Handler) http.Handler {
+		authNext := authenticate(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				authNext.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			if sameOrigin(r, origin) {
+				authNext.ServeHTTP(w, r)
+				return
+			}
+			allowed, credentials := cors.allowOrigin(w, origin)
+			if !allowed {
+				WriteProblem(w, http.StatusForbidden, "origin not allowed")
+				return
+			}
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if !preflight {
+				if !credentials {
+					// Only Bearer tokens authenticate requests of any origin
+					r = r.Clone(r.Context())
+					r.Header.Del("Cookie")
+				}
+				authNext.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			if cors.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// allowOrigin sets the CORS response headers if the origin is allowed, and returns true
+// and whether the origin can send credentials. Credentials are never allowed with "*",
+// or any website could call the API as the logged-in user.
+func (cors CORSOptions) allowOrigin(w http.ResponseWriter, origin string) (bool, bool) {
+	credentials := false
+	switch {
+	case contains(cors.AllowedOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if cors.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			credentials = true
+		}
+	case contains(cors.AllowedOrigins, "*"):
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	default:
+		return false, false
+	}
+	if len(cors.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+	}
+	return true, credentials
+}
+
+// sameOrigin returns true if the origin has the host of the request.
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"net"
-	"sync"
 	"time"
 )
 
@@ -11,44 +10,44 @@ type userLogins struct {
 	exp     int64 // Banned expire time
 }
 
-// Stores failed logings: map[user+IP]loginAttemps
-var badLoginStore map[string]userLogins = make(map[string]userLogins)
-
-var mtxBadLoginStore *sync.Mutex = &sync.Mutex{}
-
-var badLoginCount int = 0
-
 // RegBadLogin registers the failed login attemp.
 // This function allows, together with "IsBlocked", to block during certain period of time (default 15 mins.)
 // those user-ip combinations that have exceeded a certain number of attempts (default 5).
 //
 // remoteAddress is obtained from request -> http.Request.RemoteAddr
 func RegBadLogin(user string, remoteAddress string) {
-	badLoginCount++
+	defaultAuth.RegBadLogin(user, remoteAddress)
+}
 
+// RegBadLogin registers the failed login attemp. See RegBadLogin.
+func (a *Authenticator) RegBadLogin(user string, remoteAddress string) {
 	ip, _, _ := net.SplitHostPort(remoteAddress)
 	key := user + ip
 
-	mtxBadLoginStore.Lock()
-	obj, ok := badLoginStore[key]
+	a.mtxBadLoginStore.Lock()
+	a.badLoginCount++
+	obj, ok := a.badLoginStore[key]
 	if !ok {
-		badLoginStore[key] = userLogins{0, 0}
-		mtxBadLoginStore.Unlock()
-		if badLoginCount > conf.cleanBadLoginsCycle {
-			badLoginCount = 0
-			go cleanBadLoginStore()
+		a.badLoginStore[key] = userLogins{0, 0}
+		clean := a.badLoginCount > a.cleanBadLoginsCycle
+		if clean {
+			a.badLoginCount = 0
+		}
+		a.mtxBadLoginStore.Unlock()
+		if clean {
+			go a.cleanBadLoginStore()
 		}
 		return
 	}
 
 	obj.attemps++
-	expireTime := time.Now().Unix() + conf.banDuration
-	if obj.attemps < conf.maxAttemps {
+	expireTime := time.Now().Unix() + a.banDuration
+	if obj.attemps < a.maxAttemps {
 		expireTime = 0
 	}
 
-	badLoginStore[key] = userLogins{obj.attemps, expireTime}
-	mtxBadLoginStore.Unlock()
+	a.badLoginStore[key] = userLogins{obj.attemps, expireTime}
+	a.mtxBadLoginStore.Unlock()
 }
 
 // IsBlocked returns "true" if the user-ip combination is temporarily banned
@@ -57,21 +56,26 @@ func RegBadLogin(user string, remoteAddress string) {
 //
 // remoteAddress is obtained from request -> http.Request.RemoteAddr
 func IsBlocked(user string, remoteAddress string) bool {
+	return defaultAuth.IsBlocked(user, remoteAddress)
+}
+
+// IsBlocked returns "true" if the user-ip combination is temporarily banned. See IsBlocked.
+func (a *Authenticator) IsBlocked(user string, remoteAddress string) bool {
 	ip, _, _ := net.SplitHostPort(remoteAddress)
 	key := user + ip
 
-	mtxBadLoginStore.Lock()
-	obj, ok := badLoginStore[key]
-	mtxBadLoginStore.Unlock()
+	a.mtxBadLoginStore.Lock()
+	obj, ok := a.badLoginStore[key]
+	a.mtxBadLoginStore.Unlock()
 	if !ok {
 		return false
 	}
 
 	if obj.exp < time.Now().Unix() {
-		if obj.attemps > conf.maxAttemps {
-			mtxBadLoginStore.Lock()
-			delete(badLoginStore, key)
-			mtxBadLoginStore.Unlock()
+		if obj.attemps > a.maxAttemps {
+			a.mtxBadLoginStore.Lock()
+			delete(a.badLoginStore, key)
+			a.mtxBadLoginStore.Unlock()
 		}
 		return false
 	}
@@ -79,13 +83,13 @@ func IsBlocked(user string, remoteAddress string) bool {
 	return true
 }
 
-func cleanBadLoginStore() {
+func (a *Authenticator) cleanBadLoginStore() {
 	t := time.Now().Unix()
-	mtxBadLoginStore.Lock()
-	for k, v := range badLoginStore {
+	a.mtxBadLoginStore.Lock()
+	for k, v := range a.badLoginStore {
 		if v.exp < t && v.exp > 0 {
-			delete(badLoginStore, k)
+			delete(a.badLoginStore, k)
 		}
 	}
-	mtxBadLoginStore.Unlock()
+	a.mtxBadLoginStore.Unlock()
 }
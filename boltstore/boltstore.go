@@ -0,0 +1,226 @@
+// Package boltstore implements an auth.SessionStore over an embedded bbolt
+// key-value database.
+package boltstore
+
+import (
+	"encoding/json"
+
+	"github.com/jjcapellan/auth"
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketSessions = []byte("sessions")         // session id -> session
+var bucketUserSessions = []byte("usersessions") // user -> bucket of session ids
+
+// SessionStore is an auth.SessionStore which saves sessions in a bbolt database.
+type SessionStore struct {
+	db *bolt.DB
+}
+
+// Open opens (or creates) the bbolt database file in path and returns a SessionStore over it.
+func Open(path string) (*SessionStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	store, err := New(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// New returns a SessionStore over an already opened bbolt database.
+func New(db *bolt.DB) (*SessionStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketSessions); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketUserSessions)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SessionStore{db}, nil
+}
+
+// Close closes the underlying bbolt database.
+func (s *SessionStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SessionStore) CreateSession(session auth.Session) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putSession(tx, session)
+	})
+}
+
+func (s *SessionStore) GetSession(id string) (auth.Session, error) {
+	var session auth.Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		session, err = getSession(tx, id)
+		return err
+	})
+	return session, err
+}
+
+func (s *SessionStore) TouchSession(id string, lastSeen int64, exp int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := getSession(tx, id)
+		if err != nil {
+			return err
+		}
+		session.LastSeen = lastSeen
+		session.Exp = exp
+		return putSession(tx, session)
+	})
+}
+
+func (s *SessionStore) RevokeSession(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := getSession(tx, id)
+		if err != nil {
+			return err
+		}
+		session.Revoked = true
+		return putSession(tx, session)
+	})
+}
+
+func (s *SessionStore) UpdateSessionAuth(id string, authTime int64, amr []string, twoFactor bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := getSession(tx, id)
+		if err != nil {
+			return err
+		}
+		session.AuthTime = authTime
+		session.AMR = amr
+		session.TwoFactor = twoFactor
+		return putSession(tx, session)
+	})
+}
+
+func (s *SessionStore) DeleteSession(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := getSession(tx, id)
+		if err == auth.ErrSessionNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return deleteSession(tx, session)
+	})
+}
+
+func (s *SessionStore) DeleteUserSessions(user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions, err := listUserSessions(tx, user)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if err := deleteSession(tx, session); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SessionStore) ListUserSessions(user string) ([]auth.Session, error) {
+	var sessions []auth.Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		sessions, err = listUserSessions(tx, user)
+		return err
+	})
+	return sessions, err
+}
+
+func (s *SessionStore) PurgeExpired(now int64) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var expired []auth.Session
+		err := tx.Bucket(bucketSessions).ForEach(func(k, v []byte) error {
+			var session auth.Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if session.Exp < now {
+				expired = append(expired, session)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, session := range expired {
+			if err := deleteSession(tx, session); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+func getSession(tx *bolt.Tx, id string) (auth.Session, error) {
+	var session auth.Session
+	data := tx.Bucket(bucketSessions).Get([]byte(id))
+	if data == nil {
+		return session, auth.ErrSessionNotFound
+	}
+	err := json.Unmarshal(data, &session)
+	return session, err
+}
+
+func putSession(tx *bolt.Tx, session auth.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketSessions).Put([]byte(session.ID), data); err != nil {
+		return err
+	}
+	userBucket, err := tx.Bucket(bucketUserSessions).CreateBucketIfNotExists([]byte(session.User))
+	if err != nil {
+		return err
+	}
+	return userBucket.Put([]byte(session.ID), []byte{})
+}
+
+func deleteSession(tx *bolt.Tx, session auth.Session) error {
+	if err := tx.Bucket(bucketSessions).Delete([]byte(session.ID)); err != nil {
+		return err
+	}
+	userBucket := tx.Bucket(bucketUserSessions).Bucket([]byte(session.User))
+	if userBucket == nil {
+		return nil
+	}
+	return userBucket.Delete([]byte(session.ID))
+}
+
+func listUserSessions(tx *bolt.Tx, user string) ([]auth.Session, error) {
+	userBucket := tx.Bucket(bucketUserSessions).Bucket([]byte(user))
+	if userBucket == nil {
+		return nil, nil
+	}
+	var sessions []auth.Session
+	err := userBucket.ForEach(func(k, v []byte) error {
+		session, err := getSession(tx, string(k))
+		if err == auth.ErrSessionNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+	return sessions, err
+}
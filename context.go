@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+)
+
+// Principal is the authenticated user of a request. GetAuthMiddleware attaches it
+// to the request context, and handlers read it with FromContext.
+type Principal struct {
+	User      string
+	AuthLevel int
+	SessionID string   // Same value as Session.ID
+	Issued    int64    // Session creation time (unix seconds)
+	Exp       int64    // Session expire time (unix seconds)
+	TwoFactor bool     // true if the session was created after a second factor verification
+	AuthTime  int64    // Time of the last authentication of the user (unix seconds)
+	AMR       []string // Authentication methods used in the last authentication
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+// NewContext returns a copy of ctx which carries the principal.
+func NewContext(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// FromContext returns the principal attached to ctx by GetAuthMiddleware.
+// The boolean is false if there is no principal in ctx.
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(Principal)
+	return principal, ok
+}
+
+func newPrincipal(session Session) Principal {
+	return Principal{
+		User:      session.User,
+		AuthLevel: session.AuthLevel,
+		SessionID: session.ID,
+		Issued:    session.Created,
+		Exp:       session.Exp,
+		TwoFactor: session.TwoFactor,
+		AuthTime:  session.AuthTime,
+		AMR:       session.AMR,
+	}
+}
@@ -1,65 +1,223 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
-// CheckAuthCookie returns error if not exists a valid session cookie in the request
+// Session cookie prefixes. See CookieOptions.Prefix.
+const (
+	CookiePrefixHost   = "__Host-"
+	CookiePrefixSecure = "__Secure-"
+)
+
+const defaultCookieName = "JJCSESID"
+
+// CookieOptions defines the attributes of the session cookies.
+type CookieOptions struct {
+	// Name of the cookie (default "JJCSESID").
+	Name string
+
+	// Domain of the cookie. Empty by default (only the current host).
+	Domain string
+
+	// Path of the cookie (default "/").
+	Path string
+
+	// Secure cookies are only sent over HTTPS.
+	Secure bool
+
+	// SameSite attribute (default http.SameSiteLaxMode).
+	SameSite http.SameSite
+
+	// Persistent cookies expire with the session. Otherwise the cookie is deleted
+	// when the browser is closed.
+	Persistent bool
+
+	// Prefix is added to Name. Can be "", CookiePrefixHost or CookiePrefixSecure.
+	// Both prefixes force Secure, and CookiePrefixHost also requires Path "/" and no Domain.
+	Prefix string
+}
+
+// Errors returned by CheckAuthCookie and CheckAuthLevel. They are wrapped, so use errors.Is to check them.
+var (
+	ErrNoSession         = errors.New("session not found")
+	ErrSessionExpired    = errors.New("session expired")
+	ErrSessionRevoked    = errors.New("session revoked")
+	ErrInsufficientLevel = errors.New("insufficient authorization level")
+)
+
+// CheckAuthCookie returns error if not exists a valid session cookie in the request.
+//
+// The error wraps ErrNoSession, ErrSessionExpired or ErrSessionRevoked.
 func CheckAuthCookie(r *http.Request) error {
-	cookie, err := r.Cookie("JJCSESID")
+	return defaultAuth.CheckAuthCookie(r)
+}
+
+// CheckAuthCookie returns error if not exists a valid session cookie in the request. See CheckAuthCookie.
+func (a *Authenticator) CheckAuthCookie(r *http.Request) error {
+	_, err := a.getRequestSession(r)
+	return err
+}
+
+// CheckAuthLevel returns error if not exists a valid session cookie in the request, or
+// if the session auth level is lower than authLevel.
+//
+// The error wraps ErrNoSession, ErrSessionExpired, ErrSessionRevoked or ErrInsufficientLevel.
+func CheckAuthLevel(r *http.Request, authLevel int) error {
+	return defaultAuth.CheckAuthLevel(r, authLevel)
+}
+
+// CheckAuthLevel checks the session cookie and its auth level. See CheckAuthLevel.
+func (a *Authenticator) CheckAuthLevel(r *http.Request, authLevel int) error {
+	session, err := a.getRequestSession(r)
 	if err != nil {
 		return err
 	}
+	if session.AuthLevel < authLevel {
+		return fmt.Errorf("Check auth level: %w", ErrInsufficientLevel)
+	}
+	return nil
+}
 
-	mtxSessionStore.Lock()
-	if session, ok := sessionStore[cookie.Value]; ok {
-		if !checkExpTime((session)) {
-			mtxSessionStore.Unlock()
-			err = fmt.Errorf("Check cookie: expired cookie")
-			return err
-		}
+// getRequestSession returns the valid session referenced by the session cookie of the request.
+func (a *Authenticator) getRequestSession(r *http.Request) (Session, error) {
+	token, err := a.readSessionCookie(r)
+	if err != nil {
+		return Session{}, fmt.Errorf("Check cookie: %w", ErrNoSession)
 	}
-	mtxSessionStore.Unlock()
+	return a.getValidSession(token)
+}
 
-	if dbSession, err := getUserSession(cookie.Value); err == nil {
-		if !checkExpTime(dbSession) {
-			err = fmt.Errorf("Check cookie: expired cookie")
-			return err
-		}
+// getAPISession returns the valid session referenced by the header
+// "Authorization: Bearer <token>" or, if there is no such header, by the session cookie.
+func (a *Authenticator) getAPISession(r *http.Request) (Session, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return a.getValidSession(strings.TrimSpace(header[7:]))
 	}
+	return a.getRequestSession(r)
+}
 
-	return nil
+// getValidSession returns the session of the token if it is not revoked or expired.
+func (a *Authenticator) getValidSession(token string) (Session, error) {
+	session, err := a.getSession(token)
+	if errors.Is(err, ErrSessionNotFound) {
+		return Session{}, fmt.Errorf("Check cookie: %w", ErrNoSession)
+	}
+	if err != nil {
+		return Session{}, fmt.Errorf("Check cookie: session store error: %s", err.Error())
+	}
+
+	if session.Revoked {
+		return Session{}, fmt.Errorf("Check cookie: %w", ErrSessionRevoked)
+	}
+	if !checkExpTime(session) {
+		return Session{}, fmt.Errorf("Check cookie: %w", ErrSessionExpired)
+	}
+
+	return session, nil
 }
 
 // LogOut deletes current session and user cookie
 func LogOut(w http.ResponseWriter, r *http.Request) error {
-	cookie, err := r.Cookie("JJCSESID")
+	return defaultAuth.LogOut(w, r)
+}
+
+// LogOut deletes current session and user cookie
+func (a *Authenticator) LogOut(w http.ResponseWriter, r *http.Request) error {
+	token, err := a.readSessionCookie(r)
 	if err != nil {
 		return err
 	}
-	err = deleteSession(cookie.Value)
+	err = a.deleteSession(a.hashToken(token))
 	if err != nil {
 		return err
 	}
 
-	newCookie := &http.Cookie{
-		Name:    "JJCSESID",
-		Expires: time.Now(),
-		Path:    "/",
+	cookie := a.newCookie("")
+	cookie.Expires = time.Unix(0, 0)
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+
+	return nil
+}
+
+// SetCookieOptions sets the attributes of the session cookies.
+func SetCookieOptions(opts CookieOptions) error {
+	return defaultAuth.SetCookieOptions(opts)
+}
+
+// SetCookieOptions sets the attributes of the session cookies.
+func (a *Authenticator) SetCookieOptions(opts CookieOptions) error {
+	if opts.Name == "" {
+		opts.Name = defaultCookieName
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == 0 {
+		opts.SameSite = http.SameSiteLaxMode
+	}
+
+	switch opts.Prefix {
+	case "":
+	case CookiePrefixHost:
+		if opts.Domain != "" || opts.Path != "/" {
+			return fmt.Errorf("Cookie options: %s cookies require Path \"/\" and no Domain", CookiePrefixHost)
+		}
+		opts.Secure = true
+	case CookiePrefixSecure:
+		opts.Secure = true
+	default:
+		return fmt.Errorf("Cookie options: unknown cookie prefix %s", opts.Prefix)
+	}
+	if opts.SameSite == http.SameSiteNoneMode && !opts.Secure {
+		return fmt.Errorf("Cookie options: SameSite=None cookies require Secure")
 	}
-	http.SetCookie(w, newCookie)
 
+	a.cookie = opts
 	return nil
 }
 
-func setSessionCookie(token string, w http.ResponseWriter) {
-	cookie := &http.Cookie{
-		Name:     "JJCSESID",
-		Value:    token,
-		Path:     "/",
+func (a *Authenticator) cookieName() string {
+	return a.cookie.Prefix + a.cookie.Name
+}
+
+func (a *Authenticator) newCookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.cookieName(),
+		Value:    value,
+		Path:     a.cookie.Path,
+		Domain:   a.cookie.Domain,
+		Secure:   a.cookie.Secure,
 		HttpOnly: true,
+		SameSite: a.cookie.SameSite,
+	}
+}
+
+// readSessionCookie returns the session token of the request.
+func (a *Authenticator) readSessionCookie(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(a.cookieName())
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+// setSessionCookie sets the session cookie. Persistent cookies expire at the
+// expire time [exp] of the session.
+func (a *Authenticator) setSessionCookie(w http.ResponseWriter, token string, exp int64) {
+	cookie := a.newCookie(token)
+	if a.cookie.Persistent {
+		cookie.Expires = time.Unix(exp, 0)
+		cookie.MaxAge = int(exp - time.Now().Unix())
+		if cookie.MaxAge <= 0 {
+			cookie.MaxAge = -1
+		}
 	}
 
 	http.SetCookie(w, cookie)
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// emailVerificationDuration is the default validity of verification links.
+const emailVerificationDuration = 60 * 60 * 24 // 24 hours
+
+const purposeVerifyEmail = "verify-email"
+
+// ErrEmailVerified is returned by SendVerificationEmail when the user has not an email
+// waiting for verification.
+var ErrEmailVerified = errors.New("email already verified")
+
+// NewEmailVerificationToken returns a signed token which confirms the email waiting for
+// verification (the pending email set by UpdateUserEmail, or else the current email).
+// The token is valid until its expiration (EmailRules.VerificationDuration) or its first use.
+//
+// Use it to send the verification emails with your own templates or mail service.
+func NewEmailVerificationToken(user string) (string, error) {
+	return defaultAuth.NewEmailVerificationToken(user)
+}
+
+// NewEmailVerificationToken returns a signed email verification token. See NewEmailVerificationToken.
+func (a *Authenticator) NewEmailVerificationToken(user string) (string, error) {
+	token, _, err := a.newEmailVerificationToken(a.userKey(user))
+	return token, err
+}
+
+// SendVerificationEmail sends a link to confirm the email waiting for verification
+// (see NewEmailVerificationToken). The link is EmailRules.VerificationURL with the
+// query parameter "token".
+//
+// Returns ErrEmailVerified if there is nothing to verify.
+func SendVerificationEmail(user string) error {
+	return defaultAuth.SendVerificationEmail(user)
+}
+
+// SendVerificationEmail sends a link to confirm the email. See SendVerificationEmail.
+func (a *Authenticator) SendVerificationEmail(user string) error {
+	user = a.userKey(user)
+	token, email, err := a.newEmailVerificationToken(user)
+	if err != nil {
+		return err
+	}
+	if a.emailRules.VerificationURL == "" {
+		return fmt.Errorf("Verification email not sent to user %s: EmailRules.VerificationURL is empty", user)
+	}
+	link, err := url.Parse(a.emailRules.VerificationURL)
+	if err != nil {
+		return fmt.Errorf("Verification email not sent: %s", err.Error())
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	body := "Open this link to confirm your email address:\r\n" + link.String()
+	err = a.mailer.SendMail(email, "Email verification", body)
+	if err != nil {
+		return fmt.Errorf("Verification email not sent: %s", err.Error())
+	}
+	return nil
+}
+
+// ConfirmEmail checks the token of a verification link and marks the email as verified.
+// If the token confirms a pending email, it replaces the previous email of the user.
+//
+// Returns the user of the token, or an error wrapping ErrInvalidToken or ErrTokenExpired.
+func ConfirmEmail(token string) (string, error) {
+	return defaultAuth.ConfirmEmail(token)
+}
+
+// ConfirmEmail checks the token of a verification link. See ConfirmEmail.
+func (a *Authenticator) ConfirmEmail(token string) (string, error) {
+	fields, err := a.parseToken(purposeVerifyEmail, token)
+	if err == nil && len(fields) != 2 {
+		err = ErrInvalidToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("Email not confirmed: %w", err)
+	}
+	user, email := fields[0], fields[1]
+
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return "", fmt.Errorf("Email not confirmed: %s", err.Error())
+	}
+
+	// The token is single-use because it is only valid while its email is waiting for verification
+	switch {
+	case objUser.PendingEmail == email:
+		err = a.users.UpdateEmail(user, email)
+		if err == nil {
+			err = a.users.UpdateEmailStatus(user, true, "")
+		}
+	case objUser.Email == email && !objUser.EmailVerified:
+		err = a.users.UpdateEmailStatus(user, true, objUser.PendingEmail)
+	default:
+		return "", fmt.Errorf("Email not confirmed: %w", ErrInvalidToken)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Email not confirmed: %s", err.Error())
+	}
+	return user, nil
+}
+
+// IsEmailVerified returns true if the current email of the user was confirmed.
+func IsEmailVerified(user string) bool {
+	return defaultAuth.IsEmailVerified(user)
+}
+
+// IsEmailVerified returns true if the current email of the user was confirmed.
+func (a *Authenticator) IsEmailVerified(user string) bool {
+	objUser, err := a.getUser(user)
+	return err == nil && objUser.EmailVerified
+}
+
+// newEmailVerificationToken returns the token and the email to verify.
+func (a *Authenticator) newEmailVerificationToken(user string) (string, string, error) {
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return "", "", fmt.Errorf("Verification token not created: %s", err.Error())
+	}
+	email := objUser.PendingEmail
+	if email == "" {
+		if objUser.Email == "" || objUser.EmailVerified {
+			return "", "", ErrEmailVerified
+		}
+		email = objUser.Email
+	}
+
+	duration := int64(a.emailRules.VerificationDuration)
+	if duration <= 0 {
+		duration = emailVerificationDuration
+	}
+	token, err := a.signToken(purposeVerifyEmail, duration, user, email)
+	if err != nil {
+		return "", "", fmt.Errorf("Verification token not created: %s", err.Error())
+	}
+	return token, email, nil
+}
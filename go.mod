@@ -3,6 +3,9 @@ module github.com/jjcapellan/auth
 go 1.16
 
 require (
-	github.com/jjcapellan/wordgen v0.1.0
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/text v0.3.7
 )
@@ -0,0 +1,608 @@
+// Package handlers implements the http.Handlers of the usual authentication pages: login,
+// logout, registration, second factor, password reset and email verification.
+//
+// Each handler accepts HTML form posts and JSON bodies. Responses are JSON if the request
+// body is JSON or the Accept header prefers "application/json". Otherwise successful
+// requests are redirected, and forms are rendered with html/templates which can be replaced
+// (see Options.Templates).
+//
+// Posts are protected against CSRF with a double-submit token: the token is saved in a
+// cookie and must be sent again in the field "csrf_token" (or the header "X-CSRF-Token").
+// The templates receive it in Page.CSRFToken, and JSON clients get it from a GET request
+// of any page with "Accept: application/json".
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/jjcapellan/auth"
+)
+
+// Options configures the handlers. Empty fields take the default values.
+type Options struct {
+	// SessionDuration of the sessions created by Login and TwoFactor in seconds (default 3600).
+	SessionDuration int
+
+	// AuthLevel of the users created by Register (default 0).
+	AuthLevel int
+
+	// SendVerificationEmail sends the email verification link to the users created by
+	// Register (see auth.SendVerificationEmail).
+	SendVerificationEmail bool
+
+	// LoginURL is the path of the Login handler (default "/login"). TwoFactor redirects
+	// there when there is no pending login.
+	LoginURL string
+
+	// TwoFactorURL is the path of the TwoFactor handler (default "/login/2fa"). Login
+	// redirects there when the user must send a verification code.
+	TwoFactorURL string
+
+	// Redirect URLs after a successful login (default "/"), logout (default LoginURL),
+	// registration (default LoginURL), password reset (default LoginURL) and email
+	// verification (default "/").
+	LoginRedirect    string
+	LogoutRedirect   string
+	RegisterRedirect string
+	ResetRedirect    string
+	VerifyRedirect   string
+
+	// Templates replaces the default templates with the same name: "login", "2fa",
+	// "register", "forgot_password", "reset_password", "verify_email" and "message". They
+	// are executed with a Page.
+	Templates *template.Template
+
+	// CSRFCookieName is the name of the cookie with the CSRF token (default "csrf_token").
+	CSRFCookieName string
+
+	// SecureCookies sets the Secure attribute of the CSRF cookie (only sent over HTTPS).
+	SecureCookies bool
+}
+
+// Page is the data passed to the templates.
+type Page struct {
+	User      string // User name of the submitted form
+	Email     string // Email of the submitted form
+	Token     string // Token of the password reset or email verification link
+	Error     string // Message of a failed request
+	Message   string // Message of the template "message"
+	CSRFToken string // Value of the hidden field "csrf_token" of the forms
+}
+
+// Handlers serves the authentication pages of an auth.Authenticator.
+type Handlers struct {
+	auth      *auth.Authenticator
+	opts      Options
+	templates map[string]*template.Template
+}
+
+// templateNames are the templates used by the handlers.
+var templateNames = []string{"login", "2fa", "register", "forgot_password", "reset_password", "verify_email", "message"}
+
+// New returns the handlers of the Authenticator a. If a is nil, the handlers use the
+// Authenticator of the package level functions (auth.Default).
+func New(a *auth.Authenticator, opts Options) *Handlers {
+	if a == nil {
+		a = auth.Default()
+	}
+	if opts.SessionDuration <= 0 {
+		opts.SessionDuration = 3600
+	}
+	if opts.LoginURL == "" {
+		opts.LoginURL = "/login"
+	}
+	if opts.TwoFactorURL == "" {
+		opts.TwoFactorURL = "/login/2fa"
+	}
+	if opts.LoginRedirect == "" {
+		opts.LoginRedirect = "/"
+	}
+	if opts.LogoutRedirect == "" {
+		opts.LogoutRedirect = opts.LoginURL
+	}
+	if opts.RegisterRedirect == "" {
+		opts.RegisterRedirect = opts.LoginURL
+	}
+	if opts.ResetRedirect == "" {
+		opts.ResetRedirect = opts.LoginURL
+	}
+	if opts.VerifyRedirect == "" {
+		opts.VerifyRedirect = "/"
+	}
+	if opts.CSRFCookieName == "" {
+		opts.CSRFCookieName = "csrf_token"
+	}
+
+	h := &Handlers{auth: a, opts: opts, templates: make(map[string]*template.Template)}
+	for _, name := range templateNames {
+		var tmpl *template.Template
+		if opts.Templates != nil {
+			tmpl = opts.Templates.Lookup(name)
+		}
+		if tmpl == nil {
+			tmpl = defaultTemplates.Lookup(name)
+		}
+		h.templates[name] = tmpl
+	}
+	return h
+}
+
+// Login handles the login form (fields "user" and "password"). It uses auth.Login, so
+// failed logins are registered and banned users are rejected.
+//
+// If the user requires a second factor, HTML requests are redirected to TwoFactorURL and
+// JSON requests get {"status": "pending_2fa"}. Then the code is sent to the TwoFactor handler.
+func (h *Handlers) Login() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.form(w, r, "login", Page{})
+			return
+		}
+		if !allowPost(w, r) {
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "login", Page{}, "Invalid request")
+			return
+		}
+		page := Page{User: form["user"]}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "login", page, csrfMessage)
+			return
+		}
+		result, err := h.auth.Login(w, r, auth.LoginRequest{
+			User:     form["user"],
+			Password: form["password"],
+			Duration: h.opts.SessionDuration,
+		})
+		if err != nil {
+			status, message := loginError(err)
+			h.fail(w, r, status, "login", page, message)
+			return
+		}
+		h.loggedIn(w, r, result)
+	})
+}
+
+// TwoFactor handles the form of the second step of the login (field "code", or
+// "recovery_code" with a recovery code).
+func (h *Handlers) TwoFactor() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.form(w, r, "2fa", Page{})
+			return
+		}
+		if !allowPost(w, r) {
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "2fa", Page{}, "Invalid request")
+			return
+		}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "2fa", Page{}, csrfMessage)
+			return
+		}
+		if form["code"] == "" && form["recovery_code"] == "" {
+			h.fail(w, r, http.StatusBadRequest, "2fa", Page{}, "Verification code required")
+			return
+		}
+		result, err := h.auth.Login(w, r, auth.LoginRequest{
+			Code:         form["code"],
+			RecoveryCode: form["recovery_code"],
+		})
+		if errors.Is(err, auth.ErrNoPendingLogin) && !wantsJSON(r) {
+			http.Redirect(w, r, h.opts.LoginURL, http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			status, message := loginError(err)
+			h.fail(w, r, status, "2fa", Page{}, message)
+			return
+		}
+		h.loggedIn(w, r, result)
+	})
+}
+
+// Logout handles the logout (POST). The session cookie is deleted even if the session
+// is not valid. The pages of the app get the CSRF token of the logout form with CSRFToken.
+func (h *Handlers) Logout() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "message", Page{}, "Invalid request")
+			return
+		}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "message", Page{}, csrfMessage)
+			return
+		}
+		h.auth.LogOut(w, r)
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, response{Status: "logged_out"})
+			return
+		}
+		http.Redirect(w, r, h.opts.LogoutRedirect, http.StatusSeeOther)
+	})
+}
+
+// Register handles the registration form (fields "user", "password" and "email").
+func (h *Handlers) Register() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.form(w, r, "register", Page{})
+			return
+		}
+		if !allowPost(w, r) {
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "register", Page{}, "Invalid request")
+			return
+		}
+		page := Page{User: form["user"], Email: form["email"]}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "register", page, csrfMessage)
+			return
+		}
+		err = h.auth.NewUser(form["user"], form["password"], form["email"], h.opts.AuthLevel)
+		if err != nil {
+			status, message := registerError(err)
+			h.fail(w, r, status, "register", page, message)
+			return
+		}
+		user, _ := h.auth.NormalizeUsername(form["user"])
+		if h.opts.SendVerificationEmail && form["email"] != "" {
+			err = h.auth.SendVerificationEmail(user)
+			if err != nil {
+				log.Printf("verification email of %s not sent: %s", user, err)
+			}
+		}
+
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusCreated, response{Status: "registered", User: user})
+			return
+		}
+		http.Redirect(w, r, h.opts.RegisterRedirect, http.StatusSeeOther)
+	})
+}
+
+// ForgotPassword handles the form which requests a password reset link (field "user",
+// with a user name or an email). See auth.RequestPasswordReset.
+//
+// The response is the same whether the account exists or not.
+func (h *Handlers) ForgotPassword() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.form(w, r, "forgot_password", Page{})
+			return
+		}
+		if !allowPost(w, r) {
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil || form["user"] == "" {
+			h.fail(w, r, http.StatusBadRequest, "forgot_password", Page{}, "User or email required")
+			return
+		}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "forgot_password", Page{}, csrfMessage)
+			return
+		}
+		err = h.auth.RequestPasswordReset(form["user"])
+		if err != nil {
+			log.Printf("password reset not requested: %s", err)
+			h.fail(w, r, http.StatusInternalServerError, "forgot_password", Page{}, "Internal server error")
+			return
+		}
+
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusAccepted, response{Status: "sent"})
+			return
+		}
+		h.render(w, r, http.StatusOK, "message", Page{Message: "If the account exists, you will receive an email with a link to reset your password."})
+	})
+}
+
+// ResetPassword handles the page of the password reset link (query parameter "token") and
+// its form (fields "token" and "password"). See auth.ResetPassword.
+func (h *Handlers) ResetPassword() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.form(w, r, "reset_password", Page{Token: r.URL.Query().Get("token")})
+			return
+		}
+		if !allowPost(w, r) {
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "reset_password", Page{}, "Invalid request")
+			return
+		}
+		page := Page{Token: form["token"]}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "reset_password", page, csrfMessage)
+			return
+		}
+		user, err := h.auth.ResetPassword(form["token"], form["password"])
+		if err != nil {
+			status, message := tokenError(err)
+			h.fail(w, r, status, "reset_password", page, message)
+			return
+		}
+
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, response{Status: "reset", User: user})
+			return
+		}
+		http.Redirect(w, r, h.opts.ResetRedirect, http.StatusSeeOther)
+	})
+}
+
+// VerifyEmail handles the page of the email verification link (query parameter "token")
+// and its form (field "token"). See auth.ConfirmEmail.
+//
+// The email is only confirmed by the form post, so link scanners of email providers which
+// open the link do not confirm it.
+func (h *Handlers) VerifyEmail() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.form(w, r, "verify_email", Page{Token: r.URL.Query().Get("token")})
+			return
+		}
+		if !allowPost(w, r) {
+			return
+		}
+		form, err := readForm(w, r)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "verify_email", Page{}, "Invalid request")
+			return
+		}
+		page := Page{Token: form["token"]}
+		if !h.validCSRF(r, form) {
+			h.fail(w, r, http.StatusForbidden, "verify_email", page, csrfMessage)
+			return
+		}
+
+		user, err := h.auth.ConfirmEmail(form["token"])
+		if err != nil {
+			status, message := tokenError(err)
+			h.fail(w, r, status, "message", Page{}, message)
+			return
+		}
+
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, response{Status: "verified", User: user})
+			return
+		}
+		http.Redirect(w, r, h.opts.VerifyRedirect, http.StatusSeeOther)
+	})
+}
+
+// CSRFToken returns the CSRF token of the request, which the forms of the app send in the
+// field "csrf_token" (Ex: the logout form). If the request has no token, a new one is
+// saved in the CSRF cookie of the response.
+func (h *Handlers) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(h.opts.CSRFCookieName)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		log.Printf("CSRF token not created: %s", err)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.opts.CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   h.opts.SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// csrfMessage is the error message of requests without a valid CSRF token.
+const csrfMessage = "The form has expired. Try again."
+
+// validCSRF returns true if the CSRF token of the form (field "csrf_token" or header
+// "X-CSRF-Token") is the token of the CSRF cookie.
+func (h *Handlers) validCSRF(r *http.Request, form map[string]string) bool {
+	cookie, err := r.Cookie(h.opts.CSRFCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := form["csrf_token"]
+	if token == "" {
+		token = r.Header.Get("X-CSRF-Token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) == 1
+}
+
+// loggedIn writes the response of a successful step of the login.
+func (h *Handlers) loggedIn(w http.ResponseWriter, r *http.Request, result auth.LoginResult) {
+	if result.Status == auth.LoginPending2FA {
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, response{Status: "pending_2fa", User: result.User})
+			return
+		}
+		http.Redirect(w, r, h.opts.TwoFactorURL, http.StatusSeeOther)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, response{Status: "logged_in", User: result.User})
+		return
+	}
+	http.Redirect(w, r, h.opts.LoginRedirect, http.StatusSeeOther)
+}
+
+// form writes the page of a GET request: the template, or the CSRF token in JSON.
+func (h *Handlers) form(w http.ResponseWriter, r *http.Request, name string, page Page) {
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, response{CSRFToken: h.CSRFToken(w, r)})
+		return
+	}
+	h.render(w, r, http.StatusOK, name, page)
+}
+
+// fail writes a failed request: the template with the error message, or a JSON error.
+func (h *Handlers) fail(w http.ResponseWriter, r *http.Request, status int, name string, page Page, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, response{Error: message})
+		return
+	}
+	page.Error = message
+	h.render(w, r, status, name, page)
+}
+
+func (h *Handlers) render(w http.ResponseWriter, r *http.Request, status int, name string, page Page) {
+	page.CSRFToken = h.CSRFToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := h.templates[name].Execute(w, page)
+	if err != nil {
+		log.Printf("template %s not executed: %s", name, err)
+	}
+}
+
+// response is the body of the JSON responses.
+type response struct {
+	Status    string `json:"status,omitempty"`
+	User      string `json:"user,omitempty"`
+	Error     string `json:"error,omitempty"`
+	CSRFToken string `json:"csrf_token,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// maxBodySize is the size limit of the request bodies.
+const maxBodySize = 1 << 16
+
+// readForm returns the fields of a JSON object body or of a form post.
+func readForm(w http.ResponseWriter, r *http.Request) (map[string]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if isJSON(r.Header.Get("Content-Type")) {
+		form := make(map[string]string)
+		err := json.NewDecoder(r.Body).Decode(&form)
+		return form, err
+	}
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	form := make(map[string]string)
+	for key := range r.PostForm {
+		form[key] = r.PostForm.Get(key)
+	}
+	return form, nil
+}
+
+// wantsJSON returns true if the request body is JSON, or if the Accept header
+// prefers JSON over HTML.
+func wantsJSON(r *http.Request) bool {
+	if isJSON(r.Header.Get("Content-Type")) {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		switch {
+		case isJSON(mediaType):
+			return true
+		case mediaType == "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", "GET, POST")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
+// loginError returns the status code and the message for the user of an auth.Login error.
+func loginError(err error) (int, string) {
+	switch {
+	case errors.Is(err, auth.ErrLoginBlocked):
+		return http.StatusTooManyRequests, "Too many failed logins. Try again later."
+	case errors.Is(err, auth.ErrInvalidLogin):
+		return http.StatusUnauthorized, "Wrong user or password"
+	case errors.Is(err, auth.ErrEmailNotVerified):
+		return http.StatusForbidden, "Verify your email before logging in"
+	case errors.Is(err, auth.ErrNoPendingLogin):
+		return http.StatusUnauthorized, "Login expired. Log in again."
+	case errors.Is(err, auth.ErrCodeInvalid):
+		return http.StatusUnauthorized, "Wrong verification code"
+	case errors.Is(err, auth.ErrCodeExpired), errors.Is(err, auth.ErrCodeExhausted), errors.Is(err, auth.ErrCodeNotFound):
+		return http.StatusUnauthorized, "Verification code expired. Log in again."
+	}
+	log.Printf("login error: %s", err)
+	return http.StatusInternalServerError, "Internal server error"
+}
+
+// registerError returns the status code and the message for the user of an auth.NewUser error.
+func registerError(err error) (int, string) {
+	var policyErr *auth.PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return http.StatusBadRequest, policyErr.Error()
+	case errors.Is(err, auth.ErrInvalidUsername):
+		return http.StatusBadRequest, "Invalid user name"
+	case errors.Is(err, auth.ErrInvalidEmail):
+		return http.StatusBadRequest, "Invalid email"
+	case errors.Is(err, auth.ErrUserExists):
+		return http.StatusConflict, "User name already used"
+	}
+	log.Printf("registration error: %s", err)
+	return http.StatusInternalServerError, "Internal server error"
+}
+
+// tokenError returns the status code and the message for the user of an error of
+// auth.ResetPassword or auth.ConfirmEmail.
+func tokenError(err error) (int, string) {
+	var policyErr *auth.PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return http.StatusBadRequest, policyErr.Error()
+	case errors.Is(err, auth.ErrTokenExpired):
+		return http.StatusBadRequest, "The link has expired"
+	case errors.Is(err, auth.ErrInvalidToken):
+		return http.StatusBadRequest, "The link is not valid or was already used"
+	}
+	log.Printf("token error: %s", err)
+	return http.StatusInternalServerError, "Internal server error"
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"html/template"
+)
+
+// defaultTemplates are minimal pages, meant to be replaced with Options.Templates.
+var defaultTemplates = template.Must(template.New("").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.}}</title></head>
+<body>
+<h1>{{.}}</h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "error"}}{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}{{end}}
+
+{{define "login"}}{{template "header" "Log in"}}{{template "error" .}}<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>User <input name="user" value="{{.User}}" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+<button type="submit">Log in</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "2fa"}}{{template "header" "Verification code"}}{{template "error" .}}<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>Code <input name="code" autocomplete="one-time-code" inputmode="numeric" autofocus></label>
+<button type="submit">Verify</button>
+</form>
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>Recovery code <input name="recovery_code" autocomplete="off"></label>
+<button type="submit">Use recovery code</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "register"}}{{template "header" "Sign up"}}{{template "error" .}}<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>User <input name="user" value="{{.User}}" autocomplete="username" required></label>
+<label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="email"></label>
+<label>Password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Sign up</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "forgot_password"}}{{template "header" "Forgot password"}}{{template "error" .}}<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>User or email <input name="user" autocomplete="username" required></label>
+<button type="submit">Send reset link</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "reset_password"}}{{template "header" "New password"}}{{template "error" .}}<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<label>New password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Save password</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "verify_email"}}{{template "header" "Verify email"}}{{template "error" .}}<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm email</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "message"}}{{template "header" "Account"}}{{template "error" .}}{{if .Message}}<p>{{.Message}}</p>
+{{end}}{{template "footer"}}{{end}}
+`))
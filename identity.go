@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Username normalization forms. See UsernameRules.Normalization.
+const (
+	NormalizeNFKC   = "nfkc"   // Unicode NFKC
+	NormalizePRECIS = "precis" // PRECIS UsernameCasePreserved profile (RFC 8265)
+	NormalizeNone   = "none"
+)
+
+// ErrInvalidUsername and ErrInvalidEmail are wrapped by the errors of NewUser and
+// UpdateUserEmail when the input does not satisfy the rules.
+var (
+	ErrInvalidUsername = errors.New("invalid username")
+	ErrInvalidEmail    = errors.New("invalid email")
+)
+
+// UsernameRules defines how usernames are validated and normalized. The normalized
+// username is the key used to save and look up the user.
+type UsernameRules struct {
+	MinLength int // Minimum number of characters (after normalization)
+	MaxLength int // Maximum number of characters (0 means no limit)
+
+	// Pattern restricts the allowed characters (Ex: ^[a-z0-9._-]+$). nil allows any
+	// printable character without spaces at the ends.
+	Pattern *regexp.Regexp
+
+	// Normalization is NormalizeNFKC (default), NormalizePRECIS or NormalizeNone.
+	Normalization string
+
+	// CaseFold makes usernames case insensitive ("Alice" and "alice" are the same user).
+	CaseFold bool
+
+	// RejectConfusables rejects usernames which mix scripts (Ex: latin and cyrillic letters),
+	// or which look like an existing username (Ex: cyrillic "аlice" and "alice").
+	RejectConfusables bool
+}
+
+// EmailRules defines how emails are validated, normalized and verified.
+type EmailRules struct {
+	// LowercaseLocalPart lowercases the part before "@". The domain is always lowercased.
+	LowercaseLocalPart bool
+
+	// VerificationURL is the address of the page which calls ConfirmEmail. The token is
+	// added as the query parameter "token" (Ex: https://example.com/confirm?token=...).
+	// If it is empty, SendVerificationEmail does not send emails.
+	VerificationURL string
+
+	// VerificationDuration is the validity in seconds of the verification links (default 24 hours).
+	VerificationDuration int
+
+	// RequireVerified makes CheckLogin and New2FA fail for users without a verified email.
+	RequireVerified bool
+}
+
+// DefaultUsernameRules are the rules used if none are configured.
+var DefaultUsernameRules = UsernameRules{
+	MinLength:     1,
+	MaxLength:     128,
+	Normalization: NormalizeNFKC,
+	CaseFold:      true,
+}
+
+// SetUsernameRules sets the rules of new usernames and the normalization of lookups.
+func SetUsernameRules(rules UsernameRules) {
+	defaultAuth.SetUsernameRules(rules)
+}
+
+// SetUsernameRules sets the rules of new usernames and the normalization of lookups.
+func (a *Authenticator) SetUsernameRules(rules UsernameRules) {
+	a.usernameRules = rules
+}
+
+// SetEmailRules sets the normalization and the verification of emails.
+func SetEmailRules(rules EmailRules) {
+	defaultAuth.SetEmailRules(rules)
+}
+
+// SetEmailRules sets the normalization and the verification of emails.
+func (a *Authenticator) SetEmailRules(rules EmailRules) {
+	a.emailRules = rules
+}
+
+// NormalizeUsername validates the username and returns its normalized form, which is
+// the key used to save the user. The error wraps ErrInvalidUsername.
+func NormalizeUsername(user string) (string, error) {
+	return defaultAuth.NormalizeUsername(user)
+}
+
+// NormalizeUsername validates and normalizes the username. See NormalizeUsername.
+func (a *Authenticator) NormalizeUsername(user string) (string, error) {
+	rules := a.usernameRules
+	key, err := a.normalizeUsername(user)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidUsername, err.Error())
+	}
+
+	length := utf8.RuneCountInString(key)
+	if length < rules.MinLength {
+		return "", fmt.Errorf("%w: must have at least %d characters", ErrInvalidUsername, rules.MinLength)
+	}
+	if rules.MaxLength > 0 && length > rules.MaxLength {
+		return "", fmt.Errorf("%w: must have at most %d characters", ErrInvalidUsername, rules.MaxLength)
+	}
+	for _, r := range key {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("%w: contains not printable characters", ErrInvalidUsername)
+		}
+	}
+	if rules.Pattern != nil && !rules.Pattern.MatchString(key) {
+		return "", fmt.Errorf("%w: contains not allowed characters", ErrInvalidUsername)
+	}
+
+	if rules.RejectConfusables {
+		if mixedScripts(key) {
+			return "", fmt.Errorf("%w: mixes characters of several scripts", ErrInvalidUsername)
+		}
+		if skeleton := confusableSkeleton(key); skeleton != key {
+			if _, err := a.users.GetUser(skeleton); err == nil {
+				return "", fmt.Errorf("%w: looks like an existing username", ErrInvalidUsername)
+			}
+		}
+	}
+	return key, nil
+}
+
+// NormalizeEmail validates the email and returns its normalized form. An empty email
+// is valid. The error wraps ErrInvalidEmail.
+func NormalizeEmail(email string) (string, error) {
+	return defaultAuth.NormalizeEmail(email)
+}
+
+// NormalizeEmail validates and normalizes the email. See NormalizeEmail.
+func (a *Authenticator) NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", fmt.Errorf("%w: %s is not a valid address", ErrInvalidEmail, email)
+	}
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", fmt.Errorf("%w: %s has not a valid domain", ErrInvalidEmail, email)
+	}
+	if a.emailRules.LowercaseLocalPart {
+		local = strings.ToLower(local)
+	}
+	return norm.NFC.String(local + "@" + domain), nil
+}
+
+// normalizeUsername applies the normalization and case folding of the rules.
+func (a *Authenticator) normalizeUsername(user string) (string, error) {
+	rules := a.usernameRules
+	key := strings.TrimSpace(user)
+
+	switch rules.Normalization {
+	case NormalizePRECIS:
+		var err error
+		key, err = precis.UsernameCasePreserved.String(key)
+		if err != nil {
+			return "", err
+		}
+	case NormalizeNone:
+	default:
+		key = norm.NFKC.String(key)
+	}
+
+	if rules.CaseFold {
+		key = cases.Fold().String(key)
+	}
+	return key, nil
+}
+
+// userKey returns the key of an existing user for lookups. Users saved by older versions
+// may have a not normalized key, so it is used if the normalized key does not exist.
+func (a *Authenticator) userKey(user string) string {
+	key, err := a.normalizeUsername(user)
+	if err != nil {
+		return user
+	}
+	if key != user {
+		if _, err := a.users.GetUser(key); err != nil {
+			if _, err := a.users.GetUser(user); err == nil {
+				return user
+			}
+		}
+	}
+	return key
+}
+
+// getUser returns the user looked up by its normalized key.
+func (a *Authenticator) getUser(user string) (User, error) {
+	return a.users.GetUser(a.userKey(user))
+}
+
+// mixedScripts returns true if the letters of s belong to more than one script.
+// Common characters (digits, punctuation) are ignored.
+func mixedScripts(s string) bool {
+	var script *unicode.RangeTable
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		current := scriptOf(r)
+		if script != nil && current != script {
+			return true
+		}
+		script = current
+	}
+	return false
+}
+
+var scripts = []*unicode.RangeTable{
+	unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Armenian, unicode.Hebrew,
+	unicode.Arabic, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul,
+}
+
+func scriptOf(r rune) *unicode.RangeTable {
+	for _, script := range scripts {
+		if unicode.Is(script, r) {
+			return script
+		}
+	}
+	return nil
+}
+
+// confusables maps letters of other scripts to the latin letter they look like
+// (subset of Unicode confusables.txt for lowercase letters).
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'п': 'n', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'г': 'r',
+	'ѕ': 's', 'т': 't', 'ц': 'u', 'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ʐ': 'z',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+}
+
+// confusableSkeleton replaces confusable letters by their latin look-alike.
+func confusableSkeleton(s string) string {
+	return strings.Map(func(r rune) rune {
+		if latin, ok := confusables[r]; ok {
+			return latin
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,384 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWT signature algorithms.
+const (
+	JWTHS256 = "HS256" // HMAC-SHA256 with a key derived from the secret. Used if the keyring is empty
+	JWTRS256 = "RS256" // RSA PKCS#1 v1.5 with SHA-256
+	JWTEdDSA = "EdDSA" // Ed25519
+)
+
+// JWTKey is a key of the JWT keyring. The key ID is the header "kid" of the tokens, so old
+// keys can verify the tokens issued before a rotation.
+type JWTKey struct {
+	ID string
+
+	// PrivateKey is a *rsa.PrivateKey (RS256) or an ed25519.PrivateKey (EdDSA). It is nil
+	// for keys which only verify tokens.
+	PrivateKey crypto.Signer
+
+	// PublicKey is a *rsa.PublicKey or an ed25519.PublicKey. Only required if PrivateKey is nil.
+	PublicKey crypto.PublicKey
+}
+
+// JWTOptions defines the access and refresh tokens of IssueTokens.
+type JWTOptions struct {
+	// Issuer is the claim "iss" of the access tokens. Optional.
+	Issuer string
+
+	// Audience is the claim "aud" of the access tokens. If it is set, tokens of other
+	// audiences are rejected.
+	Audience string
+
+	// AccessTTL is the lifetime of the access tokens in seconds (default 900).
+	AccessTTL int
+
+	// RefreshTTL is the lifetime of the refresh tokens in seconds (default 30 days). Each
+	// rotation extends the token family, up to Options.MaxSessionLifetime.
+	RefreshTTL int
+}
+
+// DefaultJWTOptions are the JWT options used if Options.JWT is empty.
+var DefaultJWTOptions = JWTOptions{
+	AccessTTL:  60 * 15,
+	RefreshTTL: 60 * 60 * 24 * 30,
+}
+
+// jwtHeader is the JOSE header of the access tokens.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// jwtClaims are the claims of the access tokens.
+type jwtClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	Expires   int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	AuthLevel int      `json:"lvl"`
+	SessionID string   `json:"sid"`
+	AuthTime  int64    `json:"auth_time,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
+	TwoFactor bool     `json:"tfa,omitempty"` // Session.TwoFactor
+}
+
+// SetJWTOptions sets the options of the access and refresh tokens. Zero values are
+// replaced by the values of DefaultJWTOptions.
+func SetJWTOptions(opts JWTOptions) {
+	defaultAuth.SetJWTOptions(opts)
+}
+
+// SetJWTOptions sets the options of the access and refresh tokens. See SetJWTOptions.
+func (a *Authenticator) SetJWTOptions(opts JWTOptions) {
+	if opts.AccessTTL <= 0 {
+		opts.AccessTTL = DefaultJWTOptions.AccessTTL
+	}
+	if opts.RefreshTTL <= 0 {
+		opts.RefreshTTL = DefaultJWTOptions.RefreshTTL
+	}
+	a.jwt = opts
+}
+
+// AddJWTKey adds a key to the JWT keyring. If the key has a private key, it becomes the
+// current key, which signs the new access tokens. Keys without private key only verify
+// tokens (Ex: the previous key after a rotation).
+//
+// While the keyring is empty, access tokens are signed with HS256 and a key derived from
+// the secret, so only this app can verify them. Once a key is added, HS256 tokens are rejected.
+func AddJWTKey(key JWTKey) error {
+	return defaultAuth.AddJWTKey(key)
+}
+
+// AddJWTKey adds a key to the JWT keyring. See AddJWTKey.
+func (a *Authenticator) AddJWTKey(key JWTKey) error {
+	if key.ID == "" {
+		return fmt.Errorf("JWT key not added: empty key ID")
+	}
+	if key.PrivateKey != nil {
+		key.PublicKey = key.PrivateKey.Public()
+	}
+	switch pub := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return fmt.Errorf("JWT key %s not added: RSA keys must have at least 2048 bits", key.ID)
+		}
+	case ed25519.PublicKey:
+	default:
+		return fmt.Errorf("JWT key %s not added: only RSA and Ed25519 keys are supported", key.ID)
+	}
+
+	a.mtxJWTKeys.Lock()
+	defer a.mtxJWTKeys.Unlock()
+	a.jwtKeys[key.ID] = key
+	if key.PrivateKey != nil {
+		a.currentJWTKey = key.ID
+	}
+	return nil
+}
+
+// ParseAccessToken verifies the signature, the expiration, the issuer and the audience of
+// an access token of IssueTokens, and returns its principal. The Users table and the
+// session store are not read, so revoked sessions are valid until the token expires.
+//
+// Returns an error wrapping ErrInvalidToken or ErrTokenExpired.
+func ParseAccessToken(token string) (Principal, error) {
+	return defaultAuth.ParseAccessToken(token)
+}
+
+// ParseAccessToken verifies an access token and returns its principal. See ParseAccessToken.
+func (a *Authenticator) ParseAccessToken(token string) (Principal, error) {
+	claims, err := a.parseJWT(token)
+	if err != nil {
+		return Principal{}, fmt.Errorf("Access token not valid: %w", err)
+	}
+	return Principal{
+		User:      claims.Subject,
+		AuthLevel: claims.AuthLevel,
+		SessionID: claims.SessionID,
+		Issued:    claims.IssuedAt,
+		Exp:       claims.Expires,
+		TwoFactor: claims.TwoFactor,
+		AuthTime:  claims.AuthTime,
+		AMR:       claims.AMR,
+	}, nil
+}
+
+// GetJWTMiddleware is the GetAPIMiddleware of the access tokens of IssueTokens, sent in the
+// header "Authorization: Bearer <token>". It verifies the tokens without reading the Users
+// table or the session store (see ParseAccessToken).
+//
+// Requests without a valid token get a 401 status code, and users with an auth level lower
+// than required get a 403 status code, with a problem details body (see Problem).
+func GetJWTMiddleware(authLevel int) func(http.Handler) http.Handler {
+	return defaultAuth.GetJWTMiddleware(authLevel)
+}
+
+// GetJWTMiddleware is the GetAPIMiddleware of the access tokens. See GetJWTMiddleware.
+func (a *Authenticator) GetJWTMiddleware(authLevel int) func(http.Handler) http.Handler {
+	return a.RequireJWT(Level(authLevel))
+}
+
+// RequireJWT is the RequireAPI of the access tokens. It only allows users who pass the rule,
+// and answers as GetJWTMiddleware.
+func RequireJWT(rule Rule) func(http.Handler) http.Handler {
+	return defaultAuth.RequireJWT(rule)
+}
+
+// RequireJWT is the RequireAPI of the access tokens. See RequireJWT.
+func (a *Authenticator) RequireJWT(rule Rule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if len(header) <= 7 || !strings.EqualFold(header[:7], "Bearer ") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				WriteProblem(w, http.StatusUnauthorized, "access token not found")
+				return
+			}
+			principal, err := a.ParseAccessToken(strings.TrimSpace(header[7:]))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				WriteProblem(w, http.StatusUnauthorized, errors.Unwrap(err).Error())
+				return
+			}
+
+			// The user of the token is already normalized, so the Users table is not read
+			if !rule(&Access{User: principal.User, AuthLevel: principal.AuthLevel, a: a}) {
+				WriteProblem(w, http.StatusForbidden, ErrInsufficientLevel.Error())
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
+		})
+	}
+}
+
+// JWKSHandler returns a handler which serves the public keys of the JWT keyring as a JSON
+// Web Key Set (RFC 7517), so other services can verify the access tokens.
+func JWKSHandler() http.Handler {
+	return defaultAuth.JWKSHandler()
+}
+
+// JWKSHandler returns a handler which serves the public keys of the JWT keyring. See JWKSHandler.
+func (a *Authenticator) JWKSHandler() http.Handler {
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []jwk{}
+		a.mtxJWTKeys.Lock()
+		for _, key := range a.jwtKeys {
+			switch pub := key.PublicKey.(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, jwk{Kty: "RSA", Kid: key.ID, Use: "sig", Alg: JWTRS256,
+					N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+					E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+			case ed25519.PublicKey:
+				keys = append(keys, jwk{Kty: "OKP", Kid: key.ID, Use: "sig", Alg: JWTEdDSA,
+					Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)})
+			}
+		}
+		a.mtxJWTKeys.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+	})
+}
+
+// signJWT returns an access token of the session, signed with the current key.
+func (a *Authenticator) signJWT(session Session) (string, int64, error) {
+	jti, err := createToken()
+	if err != nil {
+		return "", 0, err
+	}
+	now := time.Now().Unix()
+	claims := jwtClaims{
+		Issuer:    a.jwt.Issuer,
+		Subject:   session.User,
+		Audience:  a.jwt.Audience,
+		IssuedAt:  now,
+		Expires:   now + int64(a.jwt.AccessTTL),
+		ID:        jti,
+		AuthLevel: session.AuthLevel,
+		SessionID: session.ID,
+		AuthTime:  session.AuthTime,
+		AMR:       session.AMR,
+		TwoFactor: session.TwoFactor,
+	}
+
+	a.mtxJWTKeys.Lock()
+	key, ok := a.jwtKeys[a.currentJWTKey]
+	a.mtxJWTKeys.Unlock()
+	header := jwtHeader{Alg: JWTHS256, Typ: "JWT"}
+	if ok {
+		header.Kid = key.ID
+		header.Alg = jwtAlgorithm(key.PublicKey)
+	}
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", 0, err
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", 0, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+
+	var sig []byte
+	switch header.Alg {
+	case JWTHS256:
+		sig = a.jwtHMAC(signed)
+	case JWTRS256:
+		hash := sha256.Sum256([]byte(signed))
+		sig, err = key.PrivateKey.Sign(rand.Reader, hash[:], crypto.SHA256)
+	case JWTEdDSA:
+		sig, err = key.PrivateKey.Sign(rand.Reader, []byte(signed), crypto.Hash(0))
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), claims.Expires, nil
+}
+
+// parseJWT verifies an access token and returns its claims. The algorithm of the header
+// must match the key, so a public key can not be used as HMAC key.
+func (a *Authenticator) parseJWT(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	var header jwtHeader
+	var claims jwtClaims
+	if decodeJWTPart(parts[0], &header) != nil || decodeJWTPart(parts[1], &claims) != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	signed := parts[0] + "." + parts[1]
+
+	a.mtxJWTKeys.Lock()
+	key, ok := a.jwtKeys[header.Kid]
+	emptyKeyring := len(a.jwtKeys) == 0
+	a.mtxJWTKeys.Unlock()
+
+	valid := false
+	switch {
+	case header.Alg == JWTHS256 && emptyKeyring:
+		valid = hmac.Equal(sig, a.jwtHMAC(signed))
+	case ok && header.Alg == jwtAlgorithm(key.PublicKey):
+		switch pub := key.PublicKey.(type) {
+		case *rsa.PublicKey:
+			hash := sha256.Sum256([]byte(signed))
+			valid = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil
+		case ed25519.PublicKey:
+			valid = ed25519.Verify(pub, []byte(signed), sig)
+		}
+	}
+	if !valid {
+		return jwtClaims{}, ErrInvalidToken
+	}
+
+	if claims.Issuer != a.jwt.Issuer || (a.jwt.Audience != "" && claims.Audience != a.jwt.Audience) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if claims.Expires < time.Now().Unix() {
+		return jwtClaims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// jwtHMAC returns the HS256 signature. The key is derived from the secret, so signatures
+// can not be confused with the signed tokens of other flows.
+func (a *Authenticator) jwtHMAC(signed string) []byte {
+	key := hmac.New(sha256.New, []byte(a.secret))
+	key.Write([]byte("jwt"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func jwtAlgorithm(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return JWTRS256
+	case ed25519.PublicKey:
+		return JWTEdDSA
+	}
+	return ""
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
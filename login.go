@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginRequest is the data sent by the user in each step of Login.
+type LoginRequest struct {
+	// User and Password of the first step.
+	User     string
+	Password string
+
+	// Code is the verification code (email or authenticator app) of the second step.
+	Code string
+
+	// RecoveryCode may be used instead of Code (see GenerateRecoveryCodes).
+	RecoveryCode string
+
+	// Duration of the session in seconds (see NewSession). Only read in the first step.
+	Duration int
+}
+
+// LoginStatus is the state of a login after a call to Login.
+type LoginStatus int
+
+const (
+	// LoginComplete means that the session of the user was created.
+	LoginComplete LoginStatus = iota + 1
+
+	// LoginPending2FA means that the password is valid, and the user must send the
+	// verification code in a second call to Login.
+	LoginPending2FA
+)
+
+// LoginResult is returned by Login.
+type LoginResult struct {
+	User   string
+	Status LoginStatus
+}
+
+// Errors of Login, usable with errors.Is. Errors of Verify2FA are also wrapped.
+var (
+	ErrLoginBlocked     = errors.New("too many failed logins")
+	ErrInvalidLogin     = errors.New("wrong user or password")
+	ErrEmailNotVerified = errors.New("email not verified")
+	ErrNoPendingLogin   = errors.New("no pending login")
+)
+
+// pendingLoginDuration is the time in seconds to complete the second step of Login.
+const pendingLoginDuration = int64(60 * 5)
+
+// Login checks the credentials of a login form and creates the session of the user,
+// chaining IsBlocked, CheckLogin, RegBadLogin, New2FA, Check2FA and NewSessionFromRequest.
+//
+// First step: LoginRequest with User, Password and Duration. If the user does not require
+// a second factor (see Requires2FA), the session is created and the status is LoginComplete.
+// If the user or its TOTP secret can not be read, the login fails.
+// Else a verification code is sent (see New2FA), a short-lived signed cookie keeps the
+// pending login during 5 minutes, and the status is LoginPending2FA.
+//
+// Second step: LoginRequest with Code or RecoveryCode. If the code is valid, the session is
+// created and the status is LoginComplete.
+//
+// Failed steps are registered with RegBadLogin. Returns an error wrapping ErrLoginBlocked,
+// ErrInvalidLogin, ErrEmailNotVerified (see EmailRules.RequireVerified, not registered as
+// a failed login), ErrNoPendingLogin, or the errors of Verify2FA.
+func Login(w http.ResponseWriter, r *http.Request, req LoginRequest) (LoginResult, error) {
+	return defaultAuth.Login(w, r, req)
+}
+
+// Login checks the credentials of a login form and creates the session of the user. See Login.
+func (a *Authenticator) Login(w http.ResponseWriter, r *http.Request, req LoginRequest) (LoginResult, error) {
+	if req.Code != "" || req.RecoveryCode != "" {
+		return a.finishLogin(w, r, req)
+	}
+
+	user := a.userKey(req.User)
+	if a.IsBlocked(user, r.RemoteAddr) {
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %w", user, ErrLoginBlocked)
+	}
+	authLevel, err := a.checkLogin(user, req.Password)
+	if errors.Is(err, ErrEmailNotVerified) {
+		// The password was right, so it is not a failed login
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %w", user, err)
+	}
+	if err != nil {
+		a.RegBadLogin(user, r.RemoteAddr)
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %w", user, err)
+	}
+
+	// A failed lookup must not skip the second factor
+	requires2FA, err := a.requires2FA(user)
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %s", user, err.Error())
+	}
+	if !requires2FA {
+		err := a.NewSessionFromRequest(user, req.Duration, authLevel, w, r, MethodPassword)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{User: user, Status: LoginComplete}, nil
+	}
+
+	// A throttled code is still valid, so the pending login goes on
+	err = a.send2FACode(user, pendingLoginDuration)
+	if err != nil && !errors.Is(err, ErrCodeThrottled) {
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %s", user, err.Error())
+	}
+	// The checked methods travel with the pending login, so only this client can complete it
+	token, err := a.signToken("pending login", pendingLoginDuration, user, strconv.Itoa(req.Duration), MethodPassword)
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %s", user, err.Error())
+	}
+	cookie := a.newCookie(token)
+	cookie.Name = a.pendingLoginCookieName()
+	cookie.MaxAge = int(pendingLoginDuration)
+	http.SetCookie(w, cookie)
+
+	return LoginResult{User: user, Status: LoginPending2FA}, nil
+}
+
+// finishLogin is the second step of Login.
+func (a *Authenticator) finishLogin(w http.ResponseWriter, r *http.Request, req LoginRequest) (LoginResult, error) {
+	cookie, err := r.Cookie(a.pendingLoginCookieName())
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("Login failed: %w", ErrNoPendingLogin)
+	}
+	fields, err := a.parseToken("pending login", cookie.Value)
+	if err != nil || len(fields) != 3 {
+		return LoginResult{}, fmt.Errorf("Login failed: %w", ErrNoPendingLogin)
+	}
+	user := fields[0]
+	duration, _ := strconv.Atoi(fields[1])
+	methods := strings.Split(fields[2], ",")
+
+	if a.IsBlocked(user, r.RemoteAddr) {
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %w", user, ErrLoginBlocked)
+	}
+	method := MethodRecoveryCode
+	if req.RecoveryCode != "" {
+		if !a.UseRecoveryCode(user, req.RecoveryCode) {
+			err = ErrCodeInvalid
+		}
+	} else {
+		method, err = a.check2FACode(user, req.Code)
+	}
+	if err != nil {
+		a.RegBadLogin(user, r.RemoteAddr)
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %w", user, err)
+	}
+
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return LoginResult{}, fmt.Errorf("Login of %s failed: %s", user, err.Error())
+	}
+	err = a.NewSessionFromRequest(user, duration, objUser.AuthLevel, w, r, append(methods, method)...)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	cookie = a.newCookie("")
+	cookie.Name = a.pendingLoginCookieName()
+	cookie.Expires = time.Unix(0, 0)
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+
+	return LoginResult{User: user, Status: LoginComplete}, nil
+}
+
+func (a *Authenticator) pendingLoginCookieName() string {
+	return a.cookieName() + "_2FA"
+}
+
+// SetRequire2FA sets if the user must pass a second factor in Login. Users with a confirmed
+// TOTP authenticator always require it.
+func SetRequire2FA(user string, required bool) error {
+	return defaultAuth.SetRequire2FA(user, required)
+}
+
+// SetRequire2FA sets if the user must pass a second factor in Login. See SetRequire2FA.
+func (a *Authenticator) SetRequire2FA(user string, required bool) error {
+	user = a.userKey(user)
+	err := a.users.UpdateRequire2FA(user, required)
+	if err != nil {
+		return fmt.Errorf("2FA setting of %s not updated: %s", user, err.Error())
+	}
+	return nil
+}
+
+// Requires2FA returns true if the user must pass a second factor in Login, because of
+// SetRequire2FA or a confirmed TOTP authenticator.
+func Requires2FA(user string) bool {
+	return defaultAuth.Requires2FA(user)
+}
+
+// Requires2FA returns true if the user must pass a second factor in Login. See Requires2FA.
+func (a *Authenticator) Requires2FA(user string) bool {
+	requires2FA, _ := a.requires2FA(a.userKey(user))
+	return requires2FA
+}
+
+// requires2FA returns true if the user must pass a second factor, or an error if the
+// user or its TOTP secret could not be read.
+func (a *Authenticator) requires2FA(user string) (bool, error) {
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return false, err
+	}
+	if objUser.Require2FA {
+		return true, nil
+	}
+	secret, err := a.totpStore.GetTOTP(user)
+	if errors.Is(err, ErrTOTPNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return secret.Confirmed, nil
+}
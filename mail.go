@@ -11,24 +11,33 @@ type SmtpConfig struct {
 	Port     string
 }
 
+// Mailer sends the emails of the package (verification codes and links). The default
+// Mailer sends them through the smtp server of SmtpConfig.
+type Mailer interface {
+	SendMail(to string, subject string, body string) error
+}
+
 type mailConfig struct {
 	SmtpConfig
 	auth smtp.Auth
 }
 
-var mailConf = &mailConfig{}
-
-func initSmtp(smtpConf SmtpConfig) {
-	mailConf.SmtpConfig = smtpConf
-	mailConf.auth = smtp.PlainAuth("", smtpConf.From, smtpConf.Password, smtpConf.Host)
+func (m *mailConfig) initSmtp(smtpConf SmtpConfig) {
+	m.SmtpConfig = smtpConf
+	m.auth = smtp.PlainAuth("", smtpConf.From, smtpConf.Password, smtpConf.Host)
 }
 
 func genMessage(subject string, body string) (msg string) {
 	return "Subject: " + subject + "\r\n\r\n" + body + "\r\n"
 }
 
-func sendMessage(to string, message string) error {
-	msg := "From: " + mailConf.From + "\r\n" + "To: " + to + "\r\n" + message
-	err := smtp.SendMail(mailConf.Host+":"+mailConf.Port, mailConf.auth, mailConf.From, []string{to}, []byte(msg))
+func (m *mailConfig) sendMessage(to string, message string) error {
+	msg := "From: " + m.From + "\r\n" + "To: " + to + "\r\n" + message
+	err := smtp.SendMail(m.Host+":"+m.Port, m.auth, m.From, []string{to}, []byte(msg))
 	return err
 }
+
+// SendMail sends a plain text email through the smtp server.
+func (m *mailConfig) SendMail(to string, subject string, body string) error {
+	return m.sendMessage(to, genMessage(subject, body))
+}
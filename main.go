@@ -2,21 +2,204 @@ package auth
 
 import (
 	"database/sql"
+	"fmt"
+	"sync"
 )
 
-type config struct {
+// Options contains the parameters used by New to build an Authenticator.
+type Options struct {
+	// DB is the database where the table "Users" is stored.
+	DB *sql.DB
+
+	// Users is the storage of the users profiles. If it is nil, a SQLUserStore over DB is used.
+	Users UserStore
+
+	// Roles is the storage of the roles and permissions. If it is nil, a SQLRoleStore over DB
+	// is used, or a MemoryRoleStore if DB is nil.
+	Roles RoleStore
+
+	// LevelRoles maps auth levels onto roles. See MapLevelRoles.
+	LevelRoles map[int][]string
+
+	// Sessions is the storage of the sessions. If it is nil, a SQLSessionStore over DB is used,
+	// or a MemorySessionStore if DB is nil too.
+	Sessions SessionStore
+
+	// Secret is a random word used for cryptographic purposes.
+	Secret string
+
+	// Peppers is the pepper keyring. The last key is the current key. See AddPepperKey.
+	Peppers []PepperKey
+
+	// PasswordPolicy defines the rules of new passwords (default DefaultPasswordPolicy).
+	PasswordPolicy *PasswordPolicy
+
+	// PasswordHistory is the storage of previous password hashes. If it is nil, a
+	// SQLPasswordHistoryStore over DB is used, or a MemoryPasswordHistoryStore if DB is nil.
+	PasswordHistory PasswordHistoryStore
+
+	// UsernameRules defines the validation and normalization of usernames (default
+	// DefaultUsernameRules).
+	UsernameRules *UsernameRules
+
+	// EmailRules defines the normalization and the verification of emails.
+	EmailRules EmailRules
+
+	// PasswordResets is the storage of the pending password resets. If it is nil, a
+	// SQLPasswordResetStore over DB is used, or a MemoryPasswordResetStore if DB is nil.
+	PasswordResets PasswordResetStore
+
+	// PasswordReset defines the password reset links. See RequestPasswordReset.
+	PasswordReset PasswordResetOptions
+
+	// TOTP is the storage of the TOTP secrets. If it is nil, a SQLTOTPStore over DB is
+	// used, or a MemoryTOTPStore if DB is nil.
+	TOTP TOTPStore
+
+	// TOTPOptions defines the TOTP codes (default DefaultTOTPOptions).
+	TOTPOptions *TOTPOptions
+
+	// RecoveryCodes is the storage of the recovery codes. If it is nil, a SQLRecoveryCodeStore
+	// over DB is used, or a MemoryRecoveryCodeStore if DB is nil.
+	RecoveryCodes RecoveryCodeStore
+
+	// WebAuthn is the storage of the WebAuthn credentials. If it is nil, a SQLWebAuthnStore
+	// over DB is used, or a MemoryWebAuthnStore if DB is nil.
+	WebAuthn WebAuthnStore
+
+	// WebAuthnOptions defines the relying party of the WebAuthn ceremonies.
+	WebAuthnOptions WebAuthnOptions
+
+	// Hasher is used to hash new passwords (default DefaultPasswordHasher).
+	Hasher PasswordHasher
+
+	// TwoFactor is the storage of the verification codes of New2FA. If it is nil, a
+	// SQLTwoFactorStore over DB is used, or a MemoryTwoFactorStore if DB is nil.
+	TwoFactor TwoFactorStore
+
+	// TwoFactorOptions defines the verification codes of New2FA (default DefaultTwoFactorOptions).
+	TwoFactorOptions *TwoFactorOptions
+
+	// RefreshTokens is the storage of the refresh tokens of IssueTokens. If it is nil, a
+	// SQLRefreshTokenStore over DB is used, or a MemoryRefreshTokenStore if DB is nil.
+	RefreshTokens RefreshTokenStore
+
+	// JWT defines the access and refresh tokens of IssueTokens (default DefaultJWTOptions).
+	JWT JWTOptions
+
+	// JWTKeys is the JWT keyring. The last key with private key signs. See AddJWTKey.
+	JWTKeys []JWTKey
+
+	// Smtp can be an empty struct, in that case smtp server won't be initialized.
+	Smtp SmtpConfig
+
+	// Mailer sends the emails of the package. If it is nil, emails are sent through Smtp.
+	Mailer Mailer
+
+	// MaxAttemps is the number of login attemps before ban a combination user-ip (default 5).
+	MaxAttemps int
+
+	// BanDuration is the duration in minutes of the ban (default 15).
+	BanDuration int
+
+	// SlidingSessions enables sliding expiration: the duration passed to NewSession is an
+	// idle timeout, and the session expiration is extended on each request that passes
+	// GetAuthMiddleware.
+	SlidingSessions bool
+
+	// MaxSessionLifetime is the maximum time in seconds since its creation that a session
+	// can be valid, even if it is extended by activity. 0 means no limit.
+	MaxSessionLifetime int
+
+	// Cookie defines the attributes of the session cookies. Zero values are replaced by the
+	// defaults described in CookieOptions.
+	Cookie CookieOptions
+
+	// SessionTouchInterval is the minimum time in seconds between two updates of the same
+	// session in the session store (default 60).
+	SessionTouchInterval int
+}
+
+// Authenticator is an independent authentication realm. Each instance has its own
+// stores, secret, login bans and verification codes, so several of them
+// can be used in the same process.
+type Authenticator struct {
 	db                  *sql.DB
+	users               UserStore
+	roles               RoleStore
 	secret              string
+	hasher              PasswordHasher
+	policy              PasswordPolicy
+	history             PasswordHistoryStore
+	usernameRules       UsernameRules
+	emailRules          EmailRules
+	resets              PasswordResetStore
+	passwordReset       PasswordResetOptions
+	resetQueue          chan passwordResetRequest
+	resetWorker         *sync.Once // Starts the sender of resetQueue
+	totpStore           TOTPStore
+	totp                TOTPOptions
+	recoveryCodes       RecoveryCodeStore
 	maxAttemps          int   // login attems before ban specific combination user/IP
 	banDuration         int64 // ban duration in seconds
 	cleanBadLoginsCycle int   // Number of new registers before clean badLogingsStore
+
+	webauthnStore WebAuthnStore
+	webauthn      WebAuthnOptions
+
+	peppers       map[string]string // pepper key ID -> secret
+	currentPepper string
+	mtxPeppers    *sync.Mutex
+
+	refreshTokens RefreshTokenStore
+	jwt           JWTOptions
+	jwtKeys       map[string]JWTKey // key ID -> key
+	currentJWTKey string
+	mtxJWTKeys    *sync.Mutex
+
+	mail   *mailConfig
+	mailer Mailer
+
+	cookie CookieOptions
+
+	levelRoles    map[int][]string // auth level -> roles
+	mtxLevelRoles *sync.Mutex
+
+	sessions           SessionStore
+	sessionCount       int // Number of new sessions since last purge of expired sessions
+	cleanSessionsCycle int // Number of new sessions before purge expired sessions
+	mtxSessionCount    *sync.Mutex
+
+	slidingSessions      bool
+	maxSessionLifetime   int64 // seconds
+	sessionTouchInterval int64 // seconds
+
+	badLoginStore    map[string]userLogins // Stores failed logings: map[user+IP]loginAttemps
+	badLoginCount    int
+	mtxBadLoginStore *sync.Mutex
+
+	codes     TwoFactorStore
+	twoFactor TwoFactorOptions
 }
 
 const maxAttemps = 5
 const banDuration = int64(60 * 15) // 15 minutes
 const cleanBadLoginsCycle = 100
+const cleanSessionsCycle = 100
+const sessionTouchInterval = int64(60) // 1 minute
 
-var conf = &config{}
+// defaultAuth is the instance used by the package level functions.
+var defaultAuth = &Authenticator{}
+
+// New creates a new Authenticator and initializes its "Users" table.
+func New(opts Options) (*Authenticator, error) {
+	a := &Authenticator{}
+	err := a.init(opts)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
 
 // Init initializes all necesary objects to use this package funcions
 //
@@ -26,35 +209,303 @@ var conf = &config{}
 //
 // smtpConf: can be an empty struct, in that case smtp server won't be initialized
 func Init(database *sql.DB, secretKey string, smtpConf SmtpConfig) error {
+	return defaultAuth.init(Options{DB: database, Secret: secretKey, Smtp: smtpConf})
+}
+
+// InitWithStore is like Init, but users profiles are saved in any UserStore
+// instead of a "Users" table.
+func InitWithStore(store UserStore, secretKey string, smtpConf SmtpConfig) error {
+	return defaultAuth.init(Options{Users: store, Secret: secretKey, Smtp: smtpConf})
+}
 
-	conf.db = database
-	conf.secret = secretKey
-	conf.maxAttemps = maxAttemps
-	conf.banDuration = banDuration
-	conf.cleanBadLoginsCycle = cleanBadLoginsCycle
+// Default returns the Authenticator used by the package level functions.
+func Default() *Authenticator {
+	return defaultAuth
+}
 
-	if smtpConf.From != "" {
-		initSmtp(smtpConf)
+func (a *Authenticator) init(opts Options) error {
+	a.db = opts.DB
+	a.users = opts.Users
+	a.roles = opts.Roles
+	a.sessions = opts.Sessions
+	a.secret = opts.Secret
+	a.hasher = opts.Hasher
+	if a.hasher == nil {
+		a.hasher = DefaultPasswordHasher
+	}
+	a.policy = DefaultPasswordPolicy
+	if opts.PasswordPolicy != nil {
+		a.policy = *opts.PasswordPolicy
+	}
+	a.history = opts.PasswordHistory
+	a.usernameRules = DefaultUsernameRules
+	if opts.UsernameRules != nil {
+		a.usernameRules = *opts.UsernameRules
+	}
+	a.emailRules = opts.EmailRules
+	a.resets = opts.PasswordResets
+	a.passwordReset = opts.PasswordReset
+	a.resetQueue = make(chan passwordResetRequest, passwordResetQueueSize)
+	a.resetWorker = &sync.Once{}
+	a.totpStore = opts.TOTP
+	a.recoveryCodes = opts.RecoveryCodes
+	a.webauthnStore = opts.WebAuthn
+	a.SetWebAuthnOptions(opts.WebAuthnOptions)
+	a.totp = DefaultTOTPOptions
+	if opts.TOTPOptions != nil {
+		if err := a.SetTOTPOptions(*opts.TOTPOptions); err != nil {
+			return err
+		}
+	}
+	a.maxAttemps = maxAttemps
+	a.banDuration = banDuration
+	a.cleanBadLoginsCycle = cleanBadLoginsCycle
+	a.cleanSessionsCycle = cleanSessionsCycle
+	a.slidingSessions = opts.SlidingSessions
+	a.maxSessionLifetime = int64(opts.MaxSessionLifetime)
+	a.sessionTouchInterval = sessionTouchInterval
+	if opts.SessionTouchInterval > 0 {
+		a.sessionTouchInterval = int64(opts.SessionTouchInterval)
 	}
 
-	err := initAuthTable()
+	a.SetMaxAttemps(opts.MaxAttemps)
+	if opts.BanDuration > 0 {
+		a.SetBanDuration(opts.BanDuration)
+	}
+
+	err := a.SetCookieOptions(opts.Cookie)
 	if err != nil {
 		return err
 	}
+
+	a.peppers = make(map[string]string)
+	a.currentPepper = ""
+	a.mtxPeppers = &sync.Mutex{}
+	for _, key := range opts.Peppers {
+		if err := a.AddPepperKey(key); err != nil {
+			return err
+		}
+	}
+
+	a.refreshTokens = opts.RefreshTokens
+	a.SetJWTOptions(opts.JWT)
+	a.jwtKeys = make(map[string]JWTKey)
+	a.currentJWTKey = ""
+	a.mtxJWTKeys = &sync.Mutex{}
+	for _, key := range opts.JWTKeys {
+		if err := a.AddJWTKey(key); err != nil {
+			return err
+		}
+	}
+
+	a.mail = &mailConfig{}
+	if opts.Smtp.From != "" {
+		a.mail.initSmtp(opts.Smtp)
+	}
+	a.mailer = opts.Mailer
+	if a.mailer == nil {
+		a.mailer = a.mail
+	}
+
+	a.mtxSessionCount = &sync.Mutex{}
+	a.levelRoles = make(map[int][]string)
+	a.mtxLevelRoles = &sync.Mutex{}
+	for level, roles := range opts.LevelRoles {
+		a.MapLevelRoles(level, roles...)
+	}
+	a.badLoginStore = make(map[string]userLogins)
+	a.mtxBadLoginStore = &sync.Mutex{}
+	a.codes = opts.TwoFactor
+	a.twoFactor = DefaultTwoFactorOptions
+	if opts.TwoFactorOptions != nil {
+		a.SetTwoFactorOptions(*opts.TwoFactorOptions)
+	}
+
+	if a.users == nil {
+		if a.db == nil {
+			return fmt.Errorf("Init error: a database or a UserStore is required")
+		}
+		store, err := NewSQLUserStore(a.db)
+		if err != nil {
+			return err
+		}
+		a.users = store
+	}
+
+	if a.roles == nil {
+		if a.db == nil {
+			a.roles = NewMemoryRoleStore()
+		} else {
+			store, err := NewSQLRoleStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.roles = store
+		}
+	}
+
+	if a.history == nil {
+		if a.db == nil {
+			a.history = NewMemoryPasswordHistoryStore()
+		} else {
+			store, err := NewSQLPasswordHistoryStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.history = store
+		}
+	}
+
+	if a.resets == nil {
+		if a.db == nil {
+			a.resets = NewMemoryPasswordResetStore()
+		} else {
+			store, err := NewSQLPasswordResetStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.resets = store
+		}
+	}
+
+	if a.totpStore == nil {
+		if a.db == nil {
+			a.totpStore = NewMemoryTOTPStore()
+		} else {
+			store, err := NewSQLTOTPStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.totpStore = store
+		}
+	}
+
+	if a.recoveryCodes == nil {
+		if a.db == nil {
+			a.recoveryCodes = NewMemoryRecoveryCodeStore()
+		} else {
+			store, err := NewSQLRecoveryCodeStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.recoveryCodes = store
+		}
+	}
+
+	if a.webauthnStore == nil {
+		if a.db == nil {
+			a.webauthnStore = NewMemoryWebAuthnStore()
+		} else {
+			store, err := NewSQLWebAuthnStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.webauthnStore = store
+		}
+	}
+
+	if a.codes == nil {
+		if a.db == nil {
+			a.codes = NewMemoryTwoFactorStore()
+		} else {
+			store, err := NewSQLTwoFactorStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.codes = store
+		}
+	}
+
+	if a.refreshTokens == nil {
+		if a.db == nil {
+			a.refreshTokens = NewMemoryRefreshTokenStore()
+		} else {
+			store, err := NewSQLRefreshTokenStore(a.db)
+			if err != nil {
+				return err
+			}
+			a.refreshTokens = store
+		}
+	}
+
+	if a.sessions == nil {
+		if a.db == nil {
+			a.sessions = NewMemorySessionStore()
+			return nil
+		}
+		store, err := NewSQLSessionStore(a.db)
+		if err != nil {
+			return err
+		}
+		a.sessions = store
+	}
 	return nil
 }
 
 // SetBanDuration sets the duration of ban to combination user-ip
 // for excessive login attemps.
 func SetBanDuration(minutes int) {
-	conf.banDuration = int64(minutes * 60)
+	defaultAuth.SetBanDuration(minutes)
+}
+
+// SetBanDuration sets the duration of ban to combination user-ip
+// for excessive login attemps.
+func (a *Authenticator) SetBanDuration(minutes int) {
+	a.banDuration = int64(minutes * 60)
 }
 
 // SetMaxAttemps sets the max number of login attemps before ban temporally
 // a combination user-ip.
 func SetMaxAttemps(attemps int) {
+	defaultAuth.SetMaxAttemps(attemps)
+}
+
+// SetMaxAttemps sets the max number of login attemps before ban temporally
+// a combination user-ip.
+func (a *Authenticator) SetMaxAttemps(attemps int) {
 	if attemps < 1 {
 		return
 	}
-	conf.maxAttemps = attemps
+	a.maxAttemps = attemps
+}
+
+// SetSlidingSessions enables or disables the sliding expiration of new sessions.
+// See Options.SlidingSessions.
+func SetSlidingSessions(enabled bool) {
+	defaultAuth.SetSlidingSessions(enabled)
+}
+
+// SetSlidingSessions enables or disables the sliding expiration of new sessions.
+// See Options.SlidingSessions.
+func (a *Authenticator) SetSlidingSessions(enabled bool) {
+	a.slidingSessions = enabled
+}
+
+// SetMaxSessionLifetime sets the maximum lifetime in seconds of new sessions.
+// 0 means no limit.
+func SetMaxSessionLifetime(seconds int) {
+	defaultAuth.SetMaxSessionLifetime(seconds)
+}
+
+// SetMaxSessionLifetime sets the maximum lifetime in seconds of new sessions.
+// 0 means no limit.
+func (a *Authenticator) SetMaxSessionLifetime(seconds int) {
+	if seconds < 0 {
+		return
+	}
+	a.maxSessionLifetime = int64(seconds)
+}
+
+// SetPasswordHasher sets the hasher of new passwords. Stored hashes of other algorithms
+// are still valid, and they are replaced on next successful login.
+func SetPasswordHasher(hasher PasswordHasher) {
+	defaultAuth.SetPasswordHasher(hasher)
+}
+
+// SetPasswordHasher sets the hasher of new passwords. See SetPasswordHasher.
+func (a *Authenticator) SetPasswordHasher(hasher PasswordHasher) {
+	if hasher == nil {
+		return
+	}
+	a.hasher = hasher
 }
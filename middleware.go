@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 )
 
@@ -9,33 +11,66 @@ import (
 // Returned middleware redirects the user to notLoggedURL if auth cookie is not valid, or
 // redirects to forbiddenURL if user auth level is lower than required. These two URLs may be
 // an empty string, in which case only will be returned a 403 status code.
+//
+// The authenticated user is attached to the request context. Use FromContext to read it.
 func GetAuthMiddleware(authLevel int, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if err := CheckAuthCookie(r); err != nil {
+	return defaultAuth.GetAuthMiddleware(authLevel, notLoggedURL, forbiddenURL)
+}
 
-				if notLoggedURL != "" {
-					http.Redirect(w, r, notLoggedURL, http.StatusSeeOther)
-				} else {
-					w.WriteHeader(http.StatusForbidden)
-					w.Write([]byte("Forbidden: Not valid or expired credentials"))
-				}
+// GetAuthMiddleware returns a middleware function to use in the server router. See GetAuthMiddleware.
+func (a *Authenticator) GetAuthMiddleware(authLevel int, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return a.Require(Level(authLevel), notLoggedURL, forbiddenURL)
+}
 
-				return
+// Require returns a middleware which only allows users who pass the rule.
+// notLoggedURL and forbiddenURL work as in GetAuthMiddleware.
+func Require(rule Rule, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return defaultAuth.Require(rule, notLoggedURL, forbiddenURL)
+}
+
+// Require returns a middleware which only allows users who pass the rule. See Require.
+func (a *Authenticator) Require(rule Rule, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return a.require(rule, a.getRequestSession, func(w http.ResponseWriter, r *http.Request, err error) {
+		if !errors.Is(err, ErrInsufficientLevel) {
+
+			if notLoggedURL != "" {
+				http.Redirect(w, r, notLoggedURL, http.StatusSeeOther)
+			} else {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("Forbidden: Not valid or expired credentials"))
 			}
 
-			cookie, _ := r.Cookie("JJCSESID")
-			if authValue := GetUserAuthLevel(cookie.Value); authValue < authLevel {
+			return
+		}
 
-				if forbiddenURL != "" {
-					http.Redirect(w, r, forbiddenURL, http.StatusSeeOther)
-				} else {
-					w.WriteHeader(http.StatusForbidden)
-					w.Write([]byte("Forbidden: Insufficient authorization level"))
-				}
+		if forbiddenURL != "" {
+			http.Redirect(w, r, forbiddenURL, http.StatusSeeOther)
+		} else {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden: Insufficient authorization level"))
+		}
+	})
+}
+
+// require returns a middleware which only allows users who pass the rule. The session is
+// read from the request with getSession. Other requests are passed to deny with an error
+// wrapping ErrNoSession, ErrSessionExpired, ErrSessionRevoked or ErrInsufficientLevel.
+func (a *Authenticator) require(rule Rule, getSession func(r *http.Request) (Session, error), deny func(w http.ResponseWriter, r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := getSession(r)
+			if err != nil {
+				deny(w, r, err)
 				return
 			}
-			next.ServeHTTP(w, r)
+
+			if !rule(a.GetAccess(session.User, session.AuthLevel)) {
+				deny(w, r, fmt.Errorf("Check rule: %w", ErrInsufficientLevel))
+				return
+			}
+
+			session = a.refreshSession(w, r, session)
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), newPrincipal(session))))
 		})
 	}
 }
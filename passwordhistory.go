@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// PasswordHistoryStore saves the previous password hashes of the users, so the
+// password policy can prevent their reuse.
+//
+// This package includes SQLPasswordHistoryStore and MemoryPasswordHistoryStore.
+type PasswordHistoryStore interface {
+	// AddPassword saves a previous password hash of the user.
+	AddPassword(user string, hashedPassword string) error
+
+	// PasswordHistory returns the last [n] previous password hashes of the user, newest first.
+	PasswordHistory(user string, n int) ([]string, error)
+
+	// DeletePasswordHistory deletes all previous password hashes of the user.
+	DeletePasswordHistory(user string) error
+}
+
+// MemoryPasswordHistoryStore is a concurrency-safe PasswordHistoryStore which keeps hashes in memory.
+type MemoryPasswordHistoryStore struct {
+	history map[string][]string // user -> hashes, oldest first
+	mtx     *sync.Mutex
+}
+
+// NewMemoryPasswordHistoryStore creates an empty MemoryPasswordHistoryStore.
+func NewMemoryPasswordHistoryStore() *MemoryPasswordHistoryStore {
+	return &MemoryPasswordHistoryStore{
+		history: make(map[string][]string),
+		mtx:     &sync.Mutex{},
+	}
+}
+
+func (s *MemoryPasswordHistoryStore) AddPassword(user string, hashedPassword string) error {
+	s.mtx.Lock()
+	s.history[user] = append(s.history[user], hashedPassword)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryPasswordHistoryStore) PasswordHistory(user string, n int) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	hashes := s.history[user]
+	result := []string{}
+	for i := len(hashes) - 1; i >= 0 && len(result) < n; i-- {
+		result = append(result, hashes[i])
+	}
+	return result, nil
+}
+
+func (s *MemoryPasswordHistoryStore) DeletePasswordHistory(user string) error {
+	s.mtx.Lock()
+	delete(s.history, user)
+	s.mtx.Unlock()
+	return nil
+}
+
+// SQLPasswordHistoryStore is a PasswordHistoryStore which saves hashes in the table
+// "Password_history" of a database/sql database.
+type SQLPasswordHistoryStore struct {
+	db *sql.DB
+}
+
+// NewSQLPasswordHistoryStore creates the table "Password_history" in the database if not exists.
+func NewSQLPasswordHistoryStore(db *sql.DB) (*SQLPasswordHistoryStore, error) {
+	_, err := db.Exec(qryCreatePasswordHistoryTable)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLPasswordHistoryStore{db}, nil
+}
+
+func (s *SQLPasswordHistoryStore) AddPassword(user string, hashedPassword string) error {
+	_, err := s.db.Exec(qryAddPasswordHistory, user, hashedPassword, time.Now().UnixNano())
+	return err
+}
+
+func (s *SQLPasswordHistoryStore) PasswordHistory(user string, n int) ([]string, error) {
+	rows, err := s.db.Query(qryGetPasswordHistory, user, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func (s *SQLPasswordHistoryStore) DeletePasswordHistory(user string) error {
+	_, err := s.db.Exec(qryDeletePasswordHistory, user)
+	return err
+}
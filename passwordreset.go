@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// passwordResetDuration is the default validity of password reset links.
+const passwordResetDuration = 60 * 60 // 1 hour
+
+// passwordResetInterval is the default minimum time between two links sent to a user.
+const passwordResetInterval = 60 // 1 minute
+
+// passwordResetQueueSize is the number of requests of RequestPasswordReset which can wait
+// to be sent. Further requests are dropped until the queue has room.
+const passwordResetQueueSize = 100
+
+// passwordResetRequest is a request of RequestPasswordReset waiting to be sent.
+type passwordResetRequest struct {
+	userOrEmail string
+	link        *url.URL
+}
+
+// PasswordResetOptions defines the password reset links sent by RequestPasswordReset.
+type PasswordResetOptions struct {
+	// URL is the address of the page which calls ResetPassword. The token is added as the
+	// query parameter "token" (Ex: https://example.com/reset?token=...).
+	URL string
+
+	// Duration is the validity in seconds of the links (default 1 hour).
+	Duration int
+
+	// ResendInterval is the minimum time in seconds between two links sent to the same
+	// user by RequestPasswordReset (default 1 minute).
+	ResendInterval int
+}
+
+// SetPasswordResetOptions sets the password reset links sent by RequestPasswordReset.
+func SetPasswordResetOptions(opts PasswordResetOptions) {
+	defaultAuth.SetPasswordResetOptions(opts)
+}
+
+// SetPasswordResetOptions sets the password reset links. See SetPasswordResetOptions.
+func (a *Authenticator) SetPasswordResetOptions(opts PasswordResetOptions) {
+	a.passwordReset = opts
+}
+
+// RequestPasswordReset sends a password reset link to the email of the user. userOrEmail
+// can be a username or an email; in the last case a link is sent for each user with that
+// email. If EmailRules.RequireVerified is set, only verified emails receive links.
+//
+// The result does not reveal if the account exists: the users are searched, and the
+// resets are saved and sent, in background, so the response time is the same for unknown
+// users. Those errors are logged. Only errors of the configuration are returned.
+//
+// No link is sent to a user who received another one less than
+// PasswordResetOptions.ResendInterval seconds ago. The requests are sent one by one, and
+// they are dropped while too many are waiting.
+func RequestPasswordReset(userOrEmail string) error {
+	return defaultAuth.RequestPasswordReset(userOrEmail)
+}
+
+// RequestPasswordReset sends a password reset link. See RequestPasswordReset.
+func (a *Authenticator) RequestPasswordReset(userOrEmail string) error {
+	if a.passwordReset.URL == "" {
+		return fmt.Errorf("Password reset not sent: PasswordResetOptions.URL is empty")
+	}
+	link, err := url.Parse(a.passwordReset.URL)
+	if err != nil {
+		return fmt.Errorf("Password reset not sent: %s", err.Error())
+	}
+	a.resetWorker.Do(func() {
+		go func() {
+			for req := range a.resetQueue {
+				a.sendPasswordResets(req.userOrEmail, req.link)
+			}
+		}()
+	})
+	select {
+	case a.resetQueue <- passwordResetRequest{userOrEmail, link}:
+	default:
+		log.Printf("password reset not sent: too many pending requests")
+	}
+	return nil
+}
+
+// sendPasswordResets saves and sends a password reset for each user of userOrEmail.
+func (a *Authenticator) sendPasswordResets(userOrEmail string, link *url.URL) {
+	users := []string{}
+	user := a.userKey(userOrEmail)
+	if _, err := a.users.GetUser(user); err == nil {
+		users = append(users, user)
+	} else if email, err := a.NormalizeEmail(userOrEmail); err == nil && email != "" {
+		users, err = a.users.UsersByEmail(email)
+		if err != nil {
+			log.Printf("password reset not sent: %s", err)
+			return
+		}
+	}
+
+	interval := int64(a.passwordReset.ResendInterval)
+	if interval <= 0 {
+		interval = passwordResetInterval
+	}
+	now := time.Now().Unix()
+	for _, user := range users {
+		objUser, err := a.users.GetUser(user)
+		if err != nil || objUser.Email == "" || (a.emailRules.RequireVerified && !objUser.EmailVerified) {
+			continue
+		}
+		// Resend throttling
+		last, err := a.resets.LastReset(user)
+		if err == nil && last.Exp >= now && last.Created+interval > now {
+			continue
+		}
+		token, err := a.NewPasswordResetToken(user)
+		if err != nil {
+			log.Printf("%s password reset not sent: %s", user, err)
+			continue
+		}
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		body := "Open this link to choose a new password:\r\n" + link.String()
+
+		err = a.mailer.SendMail(objUser.Email, "Password reset", body)
+		if err != nil {
+			log.Printf("%s password reset not sent: %s", user, err)
+		}
+	}
+}
+
+// NewPasswordResetToken saves a password reset for the user and returns its token. The
+// token is valid until its expiration (PasswordResetOptions.Duration) or its first use.
+//
+// Use it to send the password reset emails with your own templates or mail service.
+func NewPasswordResetToken(user string) (string, error) {
+	return defaultAuth.NewPasswordResetToken(user)
+}
+
+// NewPasswordResetToken saves a password reset for the user. See NewPasswordResetToken.
+func (a *Authenticator) NewPasswordResetToken(user string) (string, error) {
+	user = a.userKey(user)
+	if _, err := a.users.GetUser(user); err != nil {
+		return "", fmt.Errorf("Password reset not created: %s", err.Error())
+	}
+	token, err := createToken()
+	if err != nil {
+		return "", err
+	}
+
+	duration := int64(a.passwordReset.Duration)
+	if duration <= 0 {
+		duration = passwordResetDuration
+	}
+	now := time.Now().Unix()
+	err = a.resets.CreateReset(PasswordReset{ID: a.hashToken(token), User: user, Created: now, Exp: now + duration})
+	if err != nil {
+		return "", fmt.Errorf("Password reset not created: %s", err.Error())
+	}
+	err = a.resets.PurgeExpired(now)
+	if err != nil {
+		log.Printf("expired password resets not purged: %s", err)
+	}
+	return token, nil
+}
+
+// ResetPassword sets the new password of the user of the token and revokes all the
+// sessions of the user. The other pending resets of the user are cancelled.
+//
+// Returns the user of the token, a *PolicyError if the password does not satisfy the
+// password policy (the token is not used in that case), or an error wrapping
+// ErrInvalidToken or ErrTokenExpired.
+func ResetPassword(token string, newPassword string) (string, error) {
+	return defaultAuth.ResetPassword(token, newPassword)
+}
+
+// ResetPassword sets the new password of the user of the token. See ResetPassword.
+func (a *Authenticator) ResetPassword(token string, newPassword string) (string, error) {
+	id := a.hashToken(token)
+	reset, err := a.resets.GetReset(id)
+	if errors.Is(err, ErrResetNotFound) {
+		return "", fmt.Errorf("Password not reset: %w", ErrInvalidToken)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Password not reset: %s", err.Error())
+	}
+	if reset.Exp < time.Now().Unix() {
+		return "", fmt.Errorf("Password not reset: %w", ErrTokenExpired)
+	}
+
+	user := reset.User
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return "", fmt.Errorf("Password not reset: %s", err.Error())
+	}
+	err = a.checkPolicy(user, objUser.Email, newPassword)
+	if err != nil {
+		return "", err
+	}
+
+	// Only one of several concurrent uses of the token can delete it
+	err = a.resets.DeleteReset(id)
+	if errors.Is(err, ErrResetNotFound) {
+		return "", fmt.Errorf("Password not reset: %w", ErrInvalidToken)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Password not reset: %s", err.Error())
+	}
+
+	err = a.UpdateUserPass(user, newPassword)
+	if err != nil {
+		return "", err
+	}
+	err = a.resets.DeleteUserResets(user)
+	if err != nil {
+		log.Printf("%s password resets not deleted: %s", user, err)
+	}
+	err = a.RevokeAllSessions(user)
+	if err != nil {
+		return "", err
+	}
+	return user, nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// PasswordReset is a pending password reset. The token sent to the user is not saved,
+// only its HMAC (ID).
+type PasswordReset struct {
+	ID      string
+	User    string
+	Created int64 // Creation time (unix seconds)
+	Exp     int64 // Expire time (unix seconds)
+}
+
+// PasswordResetStore saves the pending password resets.
+//
+// This package includes SQLPasswordResetStore and MemoryPasswordResetStore.
+type PasswordResetStore interface {
+	// CreateReset saves a new password reset.
+	CreateReset(reset PasswordReset) error
+
+	// GetReset returns the password reset. Returns ErrResetNotFound if it not exists.
+	GetReset(id string) (PasswordReset, error)
+
+	// LastReset returns the last created password reset of the user. Returns
+	// ErrResetNotFound if the user has not password resets.
+	LastReset(user string) (PasswordReset, error)
+
+	// DeleteReset deletes the password reset. Returns ErrResetNotFound if it not exists, so
+	// only one of several concurrent calls succeeds.
+	DeleteReset(id string) error
+
+	// DeleteUserResets deletes all password resets of the user.
+	DeleteUserResets(user string) error
+
+	// PurgeExpired deletes the password resets expired before [now].
+	PurgeExpired(now int64) error
+}
+
+// ErrResetNotFound is returned by PasswordResetStore when the password reset does not exist.
+var ErrResetNotFound = errors.New("password reset not found")
+
+// MemoryPasswordResetStore is a concurrency-safe PasswordResetStore which keeps resets in memory.
+type MemoryPasswordResetStore struct {
+	resets map[string]PasswordReset
+	mtx    *sync.Mutex
+}
+
+// NewMemoryPasswordResetStore creates an empty MemoryPasswordResetStore.
+func NewMemoryPasswordResetStore() *MemoryPasswordResetStore {
+	return &MemoryPasswordResetStore{
+		resets: make(map[string]PasswordReset),
+		mtx:    &sync.Mutex{},
+	}
+}
+
+func (s *MemoryPasswordResetStore) CreateReset(reset PasswordReset) error {
+	s.mtx.Lock()
+	s.resets[reset.ID] = reset
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryPasswordResetStore) GetReset(id string) (PasswordReset, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	reset, ok := s.resets[id]
+	if !ok {
+		return PasswordReset{}, ErrResetNotFound
+	}
+	return reset, nil
+}
+
+func (s *MemoryPasswordResetStore) LastReset(user string) (PasswordReset, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	last := PasswordReset{}
+	for _, reset := range s.resets {
+		if reset.User == user && (last.User == "" || reset.Created > last.Created) {
+			last = reset
+		}
+	}
+	if last.User == "" {
+		return PasswordReset{}, ErrResetNotFound
+	}
+	return last, nil
+}
+
+func (s *MemoryPasswordResetStore) DeleteReset(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.resets[id]; !ok {
+		return ErrResetNotFound
+	}
+	delete(s.resets, id)
+	return nil
+}
+
+func (s *MemoryPasswordResetStore) DeleteUserResets(user string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, reset := range s.resets {
+		if reset.User == user {
+			delete(s.resets, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryPasswordResetStore) PurgeExpired(now int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, reset := range s.resets {
+		if reset.Exp < now {
+			delete(s.resets, id)
+		}
+	}
+	return nil
+}
+
+// SQLPasswordResetStore is a PasswordResetStore which saves resets in the table
+// "Password_resets" of a database/sql database.
+type SQLPasswordResetStore struct {
+	db *sql.DB
+}
+
+// NewSQLPasswordResetStore creates the table "Password_resets" in the database if not exists.
+func NewSQLPasswordResetStore(db *sql.DB) (*SQLPasswordResetStore, error) {
+	_, err := db.Exec(qryCreatePasswordResetsTable)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(qryCreatePasswordResetsIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLPasswordResetStore{db}, nil
+}
+
+func (s *SQLPasswordResetStore) CreateReset(reset PasswordReset) error {
+	_, err := s.db.Exec(qryNewPasswordReset, reset.ID, reset.User, reset.Created, reset.Exp)
+	return err
+}
+
+func (s *SQLPasswordResetStore) GetReset(id string) (PasswordReset, error) {
+	reset := PasswordReset{ID: id}
+	err := s.db.QueryRow(qryGetPasswordReset, id).Scan(&reset.User, &reset.Created, &reset.Exp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, ErrResetNotFound
+	}
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+func (s *SQLPasswordResetStore) LastReset(user string) (PasswordReset, error) {
+	reset := PasswordReset{User: user}
+	err := s.db.QueryRow(qryLastPasswordReset, user).Scan(&reset.ID, &reset.Created, &reset.Exp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, ErrResetNotFound
+	}
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+func (s *SQLPasswordResetStore) DeleteReset(id string) error {
+	result, err := s.db.Exec(qryDeletePasswordReset, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrResetNotFound
+	}
+	return nil
+}
+
+func (s *SQLPasswordResetStore) DeleteUserResets(user string) error {
+	_, err := s.db.Exec(qryDeleteUserPasswordResets, user)
+	return err
+}
+
+func (s *SQLPasswordResetStore) PurgeExpired(now int64) error {
+	_, err := s.db.Exec(qryPurgePasswordResets, now)
+	return err
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher hashes and verifies passwords. Hashes are strings in PHC format,
+// which encode the algorithm and its parameters (Ex: "$argon2id$v=19$m=19456,t=2,p=1$salt$hash").
+//
+// This package includes Argon2idHasher (default), ScryptHasher and BcryptHasher.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password.
+	Hash(password string) (string, error)
+
+	// Verify returns true if the password matches the encoded hash. Returns error if the
+	// encoded hash was not generated by this algorithm.
+	Verify(password string, encoded string) (bool, error)
+
+	// NeedsRehash returns true if the encoded hash was not generated by this hasher with
+	// its current parameters.
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2idHasher is a PasswordHasher using Argon2id (RFC 9106).
+type Argon2idHasher struct {
+	Time    uint32 // Number of passes
+	Memory  uint32 // Memory in KiB
+	Threads uint8
+	KeyLen  uint32 // Hash length in bytes
+	SaltLen int    // Salt length in bytes
+}
+
+// ScryptHasher is a PasswordHasher using scrypt (RFC 7914).
+type ScryptHasher struct {
+	LogN    int // log2 of the CPU/memory cost N
+	R       int // Block size
+	P       int // Parallelization
+	KeyLen  int // Hash length in bytes
+	SaltLen int // Salt length in bytes
+}
+
+// BcryptHasher is a PasswordHasher using bcrypt. Passwords are limited to 72 bytes by
+// bcrypt, so they should be pre-hashed (this package always does it, see Authenticator).
+type BcryptHasher struct {
+	Cost int
+}
+
+// DefaultPasswordHasher is the hasher used if none is configured.
+var DefaultPasswordHasher PasswordHasher = Argon2idHasher{Time: 2, Memory: 19 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+// b64 is the base64 variant used by PHC strings.
+var b64 = base64.RawStdEncoding
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	params, salt, key, err := decodePHC(encoded, "argon2id")
+	if err != nil {
+		return false, err
+	}
+	if params["v"] != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %d", params["v"])
+	}
+	if params["t"] < 1 || params["p"] < 1 || params["p"] > 255 || params["m"] < 8*params["p"] {
+		return false, fmt.Errorf("invalid argon2id hash parameters")
+	}
+	computed := argon2.IDKey([]byte(password), salt, uint32(params["t"]), uint32(params["m"]),
+		uint8(params["p"]), uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodePHC(encoded, "argon2id")
+	if err != nil {
+		return true
+	}
+	return params["v"] != argon2.Version || params["m"] != int(h.Memory) || params["t"] != int(h.Time) ||
+		params["p"] != int(h.Threads) || len(key) != int(h.KeyLen) || len(salt) != h.SaltLen
+}
+
+func (h ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.LogN, h.R, h.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h ScryptHasher) Verify(password string, encoded string) (bool, error) {
+	params, salt, key, err := decodePHC(encoded, "scrypt")
+	if err != nil {
+		return false, err
+	}
+	computed, err := scrypt.Key([]byte(password), salt, 1<<params["ln"], params["r"], params["p"], len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (h ScryptHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodePHC(encoded, "scrypt")
+	if err != nil {
+		return true
+	}
+	return params["ln"] != h.LogN || params["r"] != h.R || params["p"] != h.P ||
+		len(key) != h.KeyLen || len(salt) != h.SaltLen
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Verify(password string, encoded string) (bool, error) {
+	if !isBcryptHash(encoded) {
+		return false, fmt.Errorf("not a bcrypt hash")
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// verifyHash checks the password against an encoded hash of any supported algorithm.
+func verifyHash(password string, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2idHasher{}.Verify(password, encoded)
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		return ScryptHasher{}.Verify(password, encoded)
+	case isBcryptHash(encoded):
+		return BcryptHasher{}.Verify(password, encoded)
+	}
+	return false, fmt.Errorf("unknown password hash format")
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// decodePHC parses a PHC string "$alg$[v=..$]params$salt$hash" with integer parameters.
+func decodePHC(encoded string, alg string) (map[string]int, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 5 || parts[0] != "" || parts[1] != alg {
+		return nil, nil, nil, fmt.Errorf("not a %s hash", alg)
+	}
+
+	params := make(map[string]int)
+	for _, part := range parts[2 : len(parts)-2] {
+		for _, param := range strings.Split(part, ",") {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				return nil, nil, nil, fmt.Errorf("malformed %s hash parameters", alg)
+			}
+			value, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("malformed %s hash parameters", alg)
+			}
+			params[kv[0]] = value
+		}
+	}
+
+	salt, err := b64.DecodeString(parts[len(parts)-2])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("malformed %s hash salt", alg)
+	}
+	key, err := b64.DecodeString(parts[len(parts)-1])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, fmt.Errorf("malformed %s hash", alg)
+	}
+	return params, salt, key, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("random bytes could not be generated: %s", err.Error())
+	}
+	return b, nil
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PepperKey is a versioned secret mixed into the password hashes. The key ID is saved
+// with each hash, so old keys can be rotated without invalidating passwords.
+type PepperKey struct {
+	ID     string
+	Secret string
+}
+
+// PepperReport shows how many users have password hashes with each pepper key.
+type PepperReport struct {
+	CurrentKey string         // ID of the key used by new hashes
+	Total      int            // Number of users
+	Current    int            // Users with a hash using the current key
+	Old        int            // Users with a hash using an old key (or of an older version of this package)
+	ByKey      map[string]int // Users by key ID. Hashes without key ID are counted as ""
+}
+
+// pepperPrefix precedes the PHC string of hashes peppered with a key of the keyring:
+// "$pepper$kid=<key id>$argon2id$...". Hashes without prefix use the Authenticator secret.
+const pepperPrefix = "$pepper$kid="
+
+// AddPepperKey adds a key to the pepper keyring and makes it the current key.
+// New password hashes use the current key, and each successful login upgrades
+// the user hash to the current key. The keyring also encrypts the TOTP secrets and
+// hashes the recovery codes.
+//
+// Hashes without key ID use the secret passed to Init, unless a key with ID "" is added.
+func AddPepperKey(key PepperKey) error {
+	return defaultAuth.AddPepperKey(key)
+}
+
+// AddPepperKey adds a key to the pepper keyring and makes it the current key. See AddPepperKey.
+func (a *Authenticator) AddPepperKey(key PepperKey) error {
+	if strings.Contains(key.ID, "$") {
+		return fmt.Errorf("Pepper key %s not added: key ID can not contain \"$\"", key.ID)
+	}
+	if key.Secret == "" {
+		return fmt.Errorf("Pepper key %s not added: empty secret", key.ID)
+	}
+	a.mtxPeppers.Lock()
+	a.peppers[key.ID] = key.Secret
+	a.currentPepper = key.ID
+	a.mtxPeppers.Unlock()
+	return nil
+}
+
+// GetPepperReport counts the users whose password hash uses each pepper key.
+func GetPepperReport() (PepperReport, error) {
+	return defaultAuth.GetPepperReport()
+}
+
+// GetPepperReport counts the users whose password hash uses each pepper key. See GetPepperReport.
+func (a *Authenticator) GetPepperReport() (PepperReport, error) {
+	a.mtxPeppers.Lock()
+	current := a.currentPepper
+	a.mtxPeppers.Unlock()
+
+	report := PepperReport{CurrentKey: current, ByKey: make(map[string]int)}
+	names, err := a.users.ListUsers()
+	if err != nil {
+		return report, fmt.Errorf("Pepper report error: %s", err.Error())
+	}
+	for _, name := range names {
+		user, err := a.users.GetUser(name)
+		if err != nil {
+			continue
+		}
+		keyID, _ := splitPepperKey(user.Password)
+		report.Total++
+		report.ByKey[keyID]++
+		if keyID == current && user.Salt == "" {
+			report.Current++
+		} else {
+			report.Old++
+		}
+	}
+	return report, nil
+}
+
+// StartPepperReports runs GetPepperReport every [interval] in background and passes the
+// result to fn, so the progress of a key rotation can be monitored. Returns a function
+// which stops the job.
+func StartPepperReports(interval time.Duration, fn func(PepperReport)) (stop func()) {
+	return defaultAuth.StartPepperReports(interval, fn)
+}
+
+// StartPepperReports runs GetPepperReport periodically in background. See StartPepperReports.
+func (a *Authenticator) StartPepperReports(interval time.Duration, fn func(PepperReport)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report, err := a.GetPepperReport()
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				fn(report)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// pepper mixes the secret of the key into the password with HMAC-SHA256. The result
+// has a fixed length, so long passwords are never truncated by bcrypt.
+func pepper(password string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pepperSecret returns the secret of the key. The key "" is the Authenticator secret
+// unless it was added to the keyring.
+func (a *Authenticator) pepperSecret(keyID string) (string, bool) {
+	a.mtxPeppers.Lock()
+	defer a.mtxPeppers.Unlock()
+	secret, ok := a.peppers[keyID]
+	if !ok && keyID == "" {
+		return a.secret, true
+	}
+	return secret, ok
+}
+
+// pepperKeys returns the IDs and the secrets of all the keys, with the key "".
+func (a *Authenticator) pepperKeys() map[string]string {
+	a.mtxPeppers.Lock()
+	defer a.mtxPeppers.Unlock()
+	keys := map[string]string{"": a.secret}
+	for keyID, secret := range a.peppers {
+		keys[keyID] = secret
+	}
+	return keys
+}
+
+// currentPepperKey returns the ID and the secret of the current key.
+func (a *Authenticator) currentPepperKey() (string, string) {
+	a.mtxPeppers.Lock()
+	keyID := a.currentPepper
+	a.mtxPeppers.Unlock()
+	secret, _ := a.pepperSecret(keyID)
+	return keyID, secret
+}
+
+func (a *Authenticator) hashPass(password string) (string, error) {
+	keyID, secret := a.currentPepperKey()
+
+	hash, err := a.hasher.Hash(pepper(password, secret))
+	if err != nil || keyID == "" {
+		return hash, err
+	}
+	return pepperPrefix + keyID + hash, nil
+}
+
+// checkPass checks the password against the stored hash. Users saved by older versions
+// have a salt and a bcrypt hash of password+salt+secret.
+func (a *Authenticator) checkPass(password string, hashedPassword string, salt string) bool {
+	if salt != "" {
+		err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password+salt+a.secret))
+		return err == nil
+	}
+	keyID, hash := splitPepperKey(hashedPassword)
+	secret, ok := a.pepperSecret(keyID)
+	if !ok {
+		log.Printf("password hash with unknown pepper key %s", keyID)
+		return false
+	}
+	ok, err := verifyHash(pepper(password, secret), hash)
+	return err == nil && ok
+}
+
+func (a *Authenticator) needsRehash(user User) bool {
+	if user.Salt != "" {
+		return true
+	}
+	keyID, hash := splitPepperKey(user.Password)
+	a.mtxPeppers.Lock()
+	current := a.currentPepper
+	a.mtxPeppers.Unlock()
+	return keyID != current || a.hasher.NeedsRehash(hash)
+}
+
+// splitPepperKey returns the pepper key ID and the PHC string of a stored hash.
+func splitPepperKey(hashedPassword string) (string, string) {
+	if !strings.HasPrefix(hashedPassword, pepperPrefix) {
+		return "", hashedPassword
+	}
+	rest := hashedPassword[len(pepperPrefix):]
+	i := strings.Index(rest, "$")
+	if i < 0 {
+		return "", hashedPassword
+	}
+	return rest[:i], rest[i:]
+}
@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy rules. They identify each PolicyViolation.
+const (
+	RuleMinLength   = "min_length"
+	RuleMaxLength   = "max_length"
+	RuleLower       = "lower"
+	RuleUpper       = "upper"
+	RuleDigit       = "digit"
+	RuleSymbol      = "symbol"
+	RuleStrength    = "strength"
+	RuleUserInfo    = "user_info"
+	RuleHistory     = "history"
+	RuleBreached    = "breached"
+	RuleBreachCheck = "breach_check" // The breached passwords source could not be read
+)
+
+// minUserInfoChars is the minimum length of usernames and emails checked by RuleUserInfo.
+const minUserInfoChars = 3
+
+// PasswordPolicy defines the rules which passwords must satisfy in NewUser and UpdateUserPass.
+type PasswordPolicy struct {
+	MinLength int // Minimum number of characters
+	MaxLength int // Maximum number of characters (0 means no limit)
+
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// MinStrength is the minimum score (0 to 4) returned by PasswordStrength.
+	MinStrength int
+
+	// RejectUserInfo rejects passwords which contain the username or the email.
+	RejectUserInfo bool
+
+	// HistorySize is the number of previous passwords (including the current one) which
+	// can not be reused in UpdateUserPass. 0 disables the check.
+	HistorySize int
+
+	// Breached is used to reject passwords exposed in data breaches. Can be nil.
+	Breached BreachChecker
+}
+
+// PolicyViolation is a rule of the password policy not satisfied by a password.
+type PolicyViolation struct {
+	Rule    string // One of the Rule* constants
+	Message string
+}
+
+// PolicyError is returned when a password does not satisfy the password policy.
+// It lists every failed rule.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "Password policy: " + strings.Join(messages, "; ")
+}
+
+// Has returns true if the rule is in the violations list.
+func (e *PolicyError) Has(rule string) bool {
+	for _, v := range e.Violations {
+		if v.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// BreachChecker reports passwords exposed in data breaches.
+type BreachChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// BreachedPasswordsDir is a BreachChecker over a local copy of a k-anonymity range
+// database ("Have I Been Pwned" format): the directory contains one file per 5 hex
+// chars prefix of the SHA-1 hash (Ex: "21BD1" or "21BD1.txt"), and each file has lines
+// "SUFFIX:COUNT" with the other 35 hex chars of the hashes.
+type BreachedPasswordsDir string
+
+// DefaultPasswordPolicy is the policy used if none is configured. It only rejects empty
+// and extremely long passwords.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 1, MaxLength: 1024}
+
+// SetPasswordPolicy sets the policy of new passwords.
+func SetPasswordPolicy(policy PasswordPolicy) {
+	defaultAuth.SetPasswordPolicy(policy)
+}
+
+// SetPasswordPolicy sets the policy of new passwords.
+func (a *Authenticator) SetPasswordPolicy(policy PasswordPolicy) {
+	a.policy = policy
+}
+
+// CheckPassword checks the password against the password policy without saving it.
+// Useful to validate signup and change password forms.
+//
+// Returns nil or a *PolicyError listing every failed rule. The history rule is only
+// checked if the user exists.
+func CheckPassword(user string, email string, password string) error {
+	return defaultAuth.CheckPassword(user, email, password)
+}
+
+// CheckPassword checks the password against the password policy. See CheckPassword.
+func (a *Authenticator) CheckPassword(user string, email string, password string) error {
+	return a.checkPolicy(a.userKey(user), email, password)
+}
+
+func (a *Authenticator) checkPolicy(user string, email string, password string) error {
+	policy := a.policy
+	var violations []PolicyViolation
+	add := func(rule string, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{rule, fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		add(RuleMinLength, "must have at least %d characters", policy.MinLength)
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		add(RuleMaxLength, "must have at most %d characters", policy.MaxLength)
+	}
+
+	classes := charClasses(password)
+	if policy.RequireLower && !classes.lower {
+		add(RuleLower, "must contain a lowercase letter")
+	}
+	if policy.RequireUpper && !classes.upper {
+		add(RuleUpper, "must contain an uppercase letter")
+	}
+	if policy.RequireDigit && !classes.digit {
+		add(RuleDigit, "must contain a digit")
+	}
+	if policy.RequireSymbol && !classes.symbol {
+		add(RuleSymbol, "must contain a symbol")
+	}
+
+	if policy.MinStrength > 0 && PasswordStrength(password) < policy.MinStrength {
+		add(RuleStrength, "is too weak")
+	}
+
+	if policy.RejectUserInfo && containsUserInfo(password, user, email) {
+		add(RuleUserInfo, "must not contain the username or the email")
+	}
+
+	if policy.HistorySize > 0 && a.inPasswordHistory(user, password, policy.HistorySize) {
+		add(RuleHistory, "must not be one of the last %d passwords", policy.HistorySize)
+	}
+
+	if policy.Breached != nil {
+		breached, err := policy.Breached.IsBreached(password)
+		if err != nil {
+			add(RuleBreachCheck, "could not be checked against breached passwords: %s", err.Error())
+		} else if breached {
+			add(RuleBreached, "has been exposed in a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{violations}
+	}
+	return nil
+}
+
+// inPasswordHistory returns true if the password is the current password of the user
+// or one of its previous [size]-1 passwords.
+func (a *Authenticator) inPasswordHistory(user string, password string, size int) bool {
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return false
+	}
+	if a.checkPass(password, objUser.Password, objUser.Salt) {
+		return true
+	}
+	hashes, err := a.history.PasswordHistory(user, size-1)
+	if err != nil {
+		return false
+	}
+	for _, hash := range hashes {
+		if a.checkPass(password, hash, "") {
+			return true
+		}
+	}
+	return false
+}
+
+type classes struct {
+	lower, upper, digit, symbol bool
+}
+
+func charClasses(password string) classes {
+	c := classes{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			c.lower = true
+		case unicode.IsUpper(r):
+			c.upper = true
+		case unicode.IsDigit(r):
+			c.digit = true
+		default:
+			c.symbol = true
+		}
+	}
+	return c
+}
+
+func containsUserInfo(password string, user string, email string) bool {
+	lower := strings.ToLower(password)
+	candidates := []string{user, email}
+	if i := strings.Index(email, "@"); i > 0 {
+		candidates = append(candidates, email[:i])
+	}
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(candidate)
+		if utf8.RuneCountInString(candidate) >= minUserInfoChars && strings.Contains(lower, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordStrength returns a score from 0 (very weak) to 4 (very strong) based on an
+// estimation of the password entropy. Repeated characters and sequences like "abc" or
+// "123" do not add entropy.
+func PasswordStrength(password string) int {
+	c := charClasses(password)
+	pool := 0
+	if c.lower {
+		pool += 26
+	}
+	if c.upper {
+		pool += 26
+	}
+	if c.digit {
+		pool += 10
+	}
+	if c.symbol {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	// Count only the characters which are not a repetition or a continuation of a sequence
+	effective := 0
+	var prev, prevDelta rune
+	for i, r := range []rune(password) {
+		delta := r - prev
+		if i == 0 || (delta != 0 && !(i > 1 && delta == prevDelta && (delta == 1 || delta == -1))) {
+			effective++
+		}
+		prev, prevDelta = r, delta
+	}
+
+	bits := float64(effective) * math.Log2(float64(pool))
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 128:
+		return 3
+	}
+	return 4
+}
+
+// IsBreached looks for the SHA-1 hash of the password in the range file of its prefix.
+func (dir BreachedPasswordsDir) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(string(dir), prefix))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(string(dir), prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, ":"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Authentication methods saved in Session.AMR and Principal.AMR.
+const (
+	MethodPassword     = "pwd"      // CheckLogin
+	MethodEmailCode    = "email"    // Check2FA with a code sent by email
+	MethodTOTP         = "totp"     // CheckTOTP, or Check2FA of a user with authenticator app
+	MethodRecoveryCode = "recovery" // UseRecoveryCode
+	MethodPasskey      = "webauthn" // FinishWebAuthnLogin and PasskeyLogin
+)
+
+// ErrNoRecentAuth is returned by Reauthenticate when no authentication method is passed.
+var ErrNoRecentAuth = errors.New("no recent authentication")
+
+// Reauthenticate upgrades the session of the request in place with the methods just
+// checked for the user of the session (Ex: MethodPassword after CheckLogin). The session
+// keeps its ID and expire time, but its authentication time is now and its methods are
+// the new ones. The session is verified with a second factor if the old and the new
+// methods include two different methods.
+//
+// Use it in the page of the reauthURL of RequireRecentAuth, after checking the credentials
+// of the user of the session:
+//
+//	principal, _ := auth.FromContext(r.Context())
+//	if ok, _ := auth.CheckLogin(principal.User, password); ok {
+//		err = auth.Reauthenticate(r, auth.MethodPassword)
+//	}
+//
+// Returns an error wrapping ErrNoRecentAuth if no method is passed.
+func Reauthenticate(r *http.Request, methods ...string) error {
+	return defaultAuth.Reauthenticate(r, methods...)
+}
+
+// Reauthenticate upgrades the session of the request in place. See Reauthenticate.
+func (a *Authenticator) Reauthenticate(r *http.Request, methods ...string) error {
+	session, err := a.getRequestSession(r)
+	if err != nil {
+		return err
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("Session of %s not reauthenticated: %w", session.User, ErrNoRecentAuth)
+	}
+	twoFactor := session.TwoFactor || isMultiFactor(append(session.AMR, methods...))
+	err = a.sessions.UpdateSessionAuth(session.ID, time.Now().Unix(), methods, twoFactor)
+	if err != nil {
+		return fmt.Errorf("Session of %s not reauthenticated: %s", session.User, err.Error())
+	}
+	return nil
+}
+
+// RequireRecentAuth returns a middleware for sensitive operations (Ex: change the email or
+// delete the account). It only allows sessions whose user authenticated in the last [maxAge]
+// seconds. If methods are passed, that authentication must include one of them
+// (Ex: MethodTOTP, MethodPasskey).
+//
+// Other requests are redirected to reauthURL, where the user is asked again for a password
+// or a second factor (see Reauthenticate). If reauthURL is an empty string, only a 403 status
+// code is returned.
+//
+// Use it after GetAuthMiddleware, which handles requests without a valid session.
+func RequireRecentAuth(maxAge int, reauthURL string, methods ...string) func(http.Handler) http.Handler {
+	return defaultAuth.RequireRecentAuth(maxAge, reauthURL, methods...)
+}
+
+// RequireRecentAuth returns a middleware for sensitive operations. See RequireRecentAuth.
+func (a *Authenticator) RequireRecentAuth(maxAge int, reauthURL string, methods ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := a.getRequestSession(r)
+			if err != nil || !recentlyAuthenticated(session, int64(maxAge), methods) {
+
+				if reauthURL != "" {
+					http.Redirect(w, r, reauthURL, http.StatusSeeOther)
+				} else {
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte("Forbidden: Recent authentication required"))
+				}
+				return
+			}
+
+			session = a.refreshSession(w, r, session)
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), newPrincipal(session))))
+		})
+	}
+}
+
+func recentlyAuthenticated(session Session, maxAge int64, methods []string) bool {
+	if session.AuthTime+maxAge < time.Now().Unix() {
+		return false
+	}
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if contains(session.AMR, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMultiFactor returns true if the methods include at least two different methods
+// (Ex: password and email code).
+func isMultiFactor(methods []string) bool {
+	for _, method := range methods {
+		if method != methods[0] {
+			return true
+		}
+	}
+	return false
+}
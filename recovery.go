@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// defaultRecoveryCodes is the number of recovery codes generated if n is not positive.
+const defaultRecoveryCodes = 10
+
+// recoveryAlphabet excludes characters which are easily confused when printed (0/o, 1/l/i).
+const recoveryAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// recoveryCodeLength is the number of characters (about 50 bits) of a recovery code.
+const recoveryCodeLength = 10
+
+// GenerateRecoveryCodes returns [n] new recovery codes of the user (10 if n is not positive),
+// formatted as "xxxxx-xxxxx". The previous recovery codes are invalidated.
+//
+// The codes are saved as hashes, so they must be shown to the user now.
+func GenerateRecoveryCodes(user string, n int) ([]string, error) {
+	return defaultAuth.GenerateRecoveryCodes(user, n)
+}
+
+// GenerateRecoveryCodes returns new recovery codes of the user. See GenerateRecoveryCodes.
+func (a *Authenticator) GenerateRecoveryCodes(user string, n int) ([]string, error) {
+	user = a.userKey(user)
+	if _, err := a.users.GetUser(user); err != nil {
+		return nil, fmt.Errorf("Recovery codes not generated: %s", err.Error())
+	}
+	if n <= 0 {
+		n = defaultRecoveryCodes
+	}
+
+	keyID, secret := a.currentPepperKey()
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := range codes {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("Recovery codes not generated: %s", err.Error())
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i], keyID, secret)
+	}
+
+	err := a.recoveryCodes.ReplaceRecoveryCodes(user, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("Recovery codes not generated: %s", err.Error())
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode checks a recovery code of the user, in place of Check2FA. Each code can
+// be used only once.
+//
+// Returns true if the code is valid: then pass MethodRecoveryCode to NewSessionFromRequest
+// or Reauthenticate.
+func UseRecoveryCode(user string, code string) bool {
+	return defaultAuth.UseRecoveryCode(user, code)
+}
+
+// UseRecoveryCode checks a recovery code of the user. See UseRecoveryCode.
+func (a *Authenticator) UseRecoveryCode(user string, code string) bool {
+	user = a.userKey(user)
+
+	// The code may be hashed with any key of the pepper keyring
+	for keyID, secret := range a.pepperKeys() {
+		err := a.recoveryCodes.UseRecoveryCode(user, hashRecoveryCode(code, keyID, secret))
+		if errors.Is(err, ErrRecoveryCodeNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s recovery code not checked: %s", user, err)
+			return false
+		}
+		a.clear2FACode(user)
+		return true
+	}
+	return false
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of the user, so the
+// application can ask the user to generate new codes when few remain.
+func RecoveryCodesLeft(user string) (int, error) {
+	return defaultAuth.RecoveryCodesLeft(user)
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of the user.
+func (a *Authenticator) RecoveryCodesLeft(user string) (int, error) {
+	user = a.userKey(user)
+	count, err := a.recoveryCodes.CountRecoveryCodes(user)
+	if err != nil {
+		return 0, fmt.Errorf("%s recovery codes count error: %s", user, err.Error())
+	}
+	return count, nil
+}
+
+// hashRecoveryCode returns the HMAC of the code with the secret of a pepper key. The key
+// ID is saved as in the password hashes: "$pepper$kid=<key id>$<hmac>". Case, spaces and
+// dashes typed by the user are ignored.
+func hashRecoveryCode(code string, keyID string, secret string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("recovery code " + code))
+	hash := hex.EncodeToString(mac.Sum(nil))
+	if keyID == "" {
+		return hash
+	}
+	return pepperPrefix + keyID + "$" + hash
+}
+
+// randomRecoveryCode returns recoveryCodeLength random characters of recoveryAlphabet.
+// Bytes over the largest multiple of the alphabet size are discarded to avoid bias.
+func randomRecoveryCode() (string, error) {
+	max := 256 - 256%len(recoveryAlphabet)
+	code := make([]byte, 0, recoveryCodeLength)
+	for len(code) < recoveryCodeLength {
+		b, err := randomBytes(recoveryCodeLength)
+		if err != nil {
+			return "", err
+		}
+		for i := 0; i < len(b) && len(code) < recoveryCodeLength; i++ {
+			if int(b[i]) < max {
+				code = append(code, recoveryAlphabet[int(b[i])%len(recoveryAlphabet)])
+			}
+		}
+	}
+	return string(code), nil
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// RecoveryCodeStore saves the hashes of the recovery codes of the users.
+//
+// This package includes SQLRecoveryCodeStore and MemoryRecoveryCodeStore.
+type RecoveryCodeStore interface {
+	// ReplaceRecoveryCodes deletes the recovery codes of the user and saves the new hashes.
+	ReplaceRecoveryCodes(user string, hashes []string) error
+
+	// UseRecoveryCode deletes the recovery code of the user. Returns ErrRecoveryCodeNotFound
+	// if it not exists, so only one of several concurrent uses succeeds.
+	UseRecoveryCode(user string, hash string) error
+
+	// CountRecoveryCodes returns the number of unused recovery codes of the user.
+	CountRecoveryCodes(user string) (int, error)
+
+	// DeleteRecoveryCodes deletes all recovery codes of the user.
+	DeleteRecoveryCodes(user string) error
+}
+
+// ErrRecoveryCodeNotFound is returned by RecoveryCodeStore when the recovery code does not exist.
+var ErrRecoveryCodeNotFound = errors.New("recovery code not found")
+
+// MemoryRecoveryCodeStore is a concurrency-safe RecoveryCodeStore which keeps hashes in memory.
+type MemoryRecoveryCodeStore struct {
+	codes map[string]map[string]bool // user -> hashes
+	mtx   *sync.Mutex
+}
+
+// NewMemoryRecoveryCodeStore creates an empty MemoryRecoveryCodeStore.
+func NewMemoryRecoveryCodeStore() *MemoryRecoveryCodeStore {
+	return &MemoryRecoveryCodeStore{
+		codes: make(map[string]map[string]bool),
+		mtx:   &sync.Mutex{},
+	}
+}
+
+func (s *MemoryRecoveryCodeStore) ReplaceRecoveryCodes(user string, hashes []string) error {
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = true
+	}
+	s.mtx.Lock()
+	s.codes[user] = codes
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryRecoveryCodeStore) UseRecoveryCode(user string, hash string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.codes[user][hash] {
+		return ErrRecoveryCodeNotFound
+	}
+	delete(s.codes[user], hash)
+	return nil
+}
+
+func (s *MemoryRecoveryCodeStore) CountRecoveryCodes(user string) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.codes[user]), nil
+}
+
+func (s *MemoryRecoveryCodeStore) DeleteRecoveryCodes(user string) error {
+	s.mtx.Lock()
+	delete(s.codes, user)
+	s.mtx.Unlock()
+	return nil
+}
+
+// SQLRecoveryCodeStore is a RecoveryCodeStore which saves hashes in the table
+// "Recovery_codes" of a database/sql database.
+type SQLRecoveryCodeStore struct {
+	db *sql.DB
+}
+
+// NewSQLRecoveryCodeStore creates the table "Recovery_codes" in the database if not exists.
+func NewSQLRecoveryCodeStore(db *sql.DB) (*SQLRecoveryCodeStore, error) {
+	_, err := db.Exec(qryCreateRecoveryCodesTable)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLRecoveryCodeStore{db}, nil
+}
+
+func (s *SQLRecoveryCodeStore) ReplaceRecoveryCodes(user string, hashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(qryDeleteRecoveryCodes, user)
+	for i := 0; err == nil && i < len(hashes); i++ {
+		_, err = tx.Exec(qryAddRecoveryCode, user, hashes[i])
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLRecoveryCodeStore) UseRecoveryCode(user string, hash string) error {
+	result, err := s.db.Exec(qryUseRecoveryCode, user, hash)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+func (s *SQLRecoveryCodeStore) CountRecoveryCodes(user string) (int, error) {
+	var count int
+	err := s.db.QueryRow(qryCountRecoveryCodes, user).Scan(&count)
+	return count, err
+}
+
+func (s *SQLRecoveryCodeStore) DeleteRecoveryCodes(user string) error {
+	_, err := s.db.Exec(qryDeleteRecoveryCodes, user)
+	return err
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrRefreshTokenReused is returned by RefreshTokens when a refresh token is used twice.
+// The token may have been stolen, so its whole family is revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// TokenPair is the response of IssueTokens and RefreshTokens. Its JSON format is the
+// token response of OAuth 2.0 (RFC 6749).
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"` // "Bearer"
+	ExpiresIn    int64  `json:"expires_in"` // Lifetime of the access token in seconds
+	RefreshToken string `json:"refresh_token"`
+}
+
+// IssueTokens creates a session of the user (see NewSessionToken) and returns a JWT access
+// token and a refresh token of that session. Call it after the credentials of the user
+// are checked (Ex: CheckLogin), with the methods checked (see NewSessionFromRequest). r may
+// be nil.
+//
+// The access token (see JWTOptions and AddJWTKey) carries the user ("sub"), the auth level
+// ("lvl"), the session ID ("sid") and the authentication methods ("amr"), so other services
+// can verify it without this package stores (see ParseAccessToken and GetJWTMiddleware).
+//
+// The refresh token is saved as an HMAC in the RefreshTokenStore. It is valid only once:
+// see RefreshTokens.
+func IssueTokens(user string, authLevel int, r *http.Request, methods ...string) (TokenPair, error) {
+	return defaultAuth.IssueTokens(user, authLevel, r, methods...)
+}
+
+// IssueTokens creates a session and returns its access and refresh tokens. See IssueTokens.
+func (a *Authenticator) IssueTokens(user string, authLevel int, r *http.Request, methods ...string) (TokenPair, error) {
+	err := a.refreshTokens.PurgeExpired(time.Now().Unix())
+	if err != nil {
+		log.Printf("expired refresh tokens not purged: %s", err)
+	}
+	_, session, err := a.createSession(user, a.jwt.RefreshTTL, authLevel, r, methods, isMultiFactor(methods))
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("Tokens of %s not issued: %s", user, err.Error())
+	}
+	pair, err := a.issueTokenPair(session, session.Exp)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("Tokens of %s not issued: %s", session.User, err.Error())
+	}
+	return pair, nil
+}
+
+// RefreshTokens rotates a refresh token: the token is marked as used, and a new access token
+// and a new refresh token of the same session are returned. Each rotation extends the
+// session by JWTOptions.RefreshTTL seconds, up to Options.MaxSessionLifetime.
+//
+// If a used refresh token is sent again, the whole family (the session and all its refresh
+// tokens) is revoked, and an error wrapping ErrRefreshTokenReused is returned. So clients must
+// not refresh concurrently with the same token.
+//
+// Returns an error wrapping ErrInvalidToken if the token does not exist or its session was
+// revoked (see RevokeSession and LogOut), or ErrTokenExpired.
+func RefreshTokens(refreshToken string) (TokenPair, error) {
+	return defaultAuth.RefreshTokens(refreshToken)
+}
+
+// RefreshTokens rotates a refresh token. See RefreshTokens.
+func (a *Authenticator) RefreshTokens(refreshToken string) (TokenPair, error) {
+	id := a.hashToken(refreshToken)
+	token, err := a.refreshTokens.GetRefreshToken(id)
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return TokenPair{}, fmt.Errorf("Refresh token not valid: %w", ErrInvalidToken)
+	}
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("Refresh token not read: %s", err.Error())
+	}
+	now := time.Now().Unix()
+	if token.Exp < now {
+		return TokenPair{}, fmt.Errorf("Refresh token not valid: %w", ErrTokenExpired)
+	}
+
+	// A used token, or a concurrent use, revokes the family
+	if token.Used {
+		return TokenPair{}, a.revokeTokenFamily(token)
+	}
+	err = a.refreshTokens.UseRefreshToken(id)
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return TokenPair{}, a.revokeTokenFamily(token)
+	}
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("Refresh token not used: %s", err.Error())
+	}
+
+	session, err := a.sessions.GetSession(token.Family)
+	if err != nil || session.Revoked || !checkExpTime(session) {
+		return TokenPair{}, fmt.Errorf("Refresh token of %s not valid: session not found: %w", token.User, ErrInvalidToken)
+	}
+	exp := now + int64(a.jwt.RefreshTTL)
+	if session.MaxExp > 0 && exp > session.MaxExp {
+		exp = session.MaxExp
+	}
+	if exp > session.Exp {
+		err = a.sessions.TouchSession(session.ID, now, exp)
+		if err != nil {
+			return TokenPair{}, fmt.Errorf("Session of %s not extended: %s", token.User, err.Error())
+		}
+		session.Exp = exp
+	}
+
+	pair, err := a.issueTokenPair(session, session.Exp)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("Tokens of %s not issued: %s", token.User, err.Error())
+	}
+	return pair, nil
+}
+
+// RevokeRefreshToken revokes the family of the refresh token: its session and all its
+// refresh tokens. It is the LogOut of API clients. Access tokens already issued are valid
+// until they expire.
+func RevokeRefreshToken(refreshToken string) error {
+	return defaultAuth.RevokeRefreshToken(refreshToken)
+}
+
+// RevokeRefreshToken revokes the family of the refresh token. See RevokeRefreshToken.
+func (a *Authenticator) RevokeRefreshToken(refreshToken string) error {
+	token, err := a.refreshTokens.GetRefreshToken(a.hashToken(refreshToken))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return fmt.Errorf("Refresh token not revoked: %w", ErrInvalidToken)
+	}
+	if err != nil {
+		return fmt.Errorf("Refresh token not revoked: %s", err.Error())
+	}
+	return a.deleteTokenFamily(token)
+}
+
+// issueTokenPair saves a new refresh token of the session, valid until [exp], and returns
+// it with a new access token.
+func (a *Authenticator) issueTokenPair(session Session, exp int64) (TokenPair, error) {
+	refreshToken, err := createToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = a.refreshTokens.SaveRefreshToken(RefreshToken{
+		ID:     a.hashToken(refreshToken),
+		Family: session.ID,
+		User:   session.User,
+		Exp:    exp,
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	accessToken, accessExp, err := a.signJWT(session)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    accessExp - time.Now().Unix(),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// revokeTokenFamily revokes the family of a reused refresh token and returns the error
+// of RefreshTokens.
+func (a *Authenticator) revokeTokenFamily(token RefreshToken) error {
+	log.Printf("refresh token of %s reused: token family revoked", token.User)
+	err := a.deleteTokenFamily(token)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Refresh token of %s not valid: %w", token.User, ErrRefreshTokenReused)
+}
+
+// deleteTokenFamily deletes the refresh tokens of the family and revokes its session.
+func (a *Authenticator) deleteTokenFamily(token RefreshToken) error {
+	err := a.refreshTokens.DeleteFamily(token.Family)
+	if err != nil {
+		return fmt.Errorf("Refresh tokens of %s not revoked: %s", token.User, err.Error())
+	}
+	err = a.sessions.RevokeSession(token.Family)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return fmt.Errorf("Session of %s not revoked: %s", token.User, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// RefreshToken is a refresh token as it is saved in a RefreshTokenStore. All the tokens
+// issued by the rotation of a token belong to the same family, which is the session
+// created by IssueTokens.
+type RefreshToken struct {
+	ID     string // HMAC-SHA256 of the token
+	Family string // ID of the session of the token family
+	User   string
+	Exp    int64 // Expire time (unix seconds)
+	Used   bool  // Rotated tokens are kept until expiration to detect their reuse
+}
+
+// RefreshTokenStore is the storage backend of the refresh tokens.
+//
+// This package includes SQLRefreshTokenStore and MemoryRefreshTokenStore.
+type RefreshTokenStore interface {
+	// SaveRefreshToken saves a new refresh token.
+	SaveRefreshToken(token RefreshToken) error
+
+	// GetRefreshToken returns the token. Returns ErrRefreshTokenNotFound if it not exists.
+	GetRefreshToken(id string) (RefreshToken, error)
+
+	// UseRefreshToken marks the token as used. Returns ErrRefreshTokenNotFound if it not
+	// exists or was already used, so only one of several concurrent uses succeeds.
+	UseRefreshToken(id string) error
+
+	// DeleteFamily deletes all the tokens of the family.
+	DeleteFamily(family string) error
+
+	// DeleteUserRefreshTokens deletes all the tokens of the user.
+	DeleteUserRefreshTokens(user string) error
+
+	// PurgeExpired deletes the tokens expired before [now].
+	PurgeExpired(now int64) error
+}
+
+// ErrRefreshTokenNotFound is returned by RefreshTokenStore when the token does not exist.
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// MemoryRefreshTokenStore is a concurrency-safe RefreshTokenStore which keeps tokens in memory.
+type MemoryRefreshTokenStore struct {
+	tokens map[string]RefreshToken
+	mtx    *sync.Mutex
+}
+
+// NewMemoryRefreshTokenStore creates an empty MemoryRefreshTokenStore.
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		tokens: make(map[string]RefreshToken),
+		mtx:    &sync.Mutex{},
+	}
+}
+
+func (s *MemoryRefreshTokenStore) SaveRefreshToken(token RefreshToken) error {
+	s.mtx.Lock()
+	s.tokens[token.ID] = token
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) GetRefreshToken(id string) (RefreshToken, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	token, ok := s.tokens[id]
+	if !ok {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *MemoryRefreshTokenStore) UseRefreshToken(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	token, ok := s.tokens[id]
+	if !ok || token.Used {
+		return ErrRefreshTokenNotFound
+	}
+	token.Used = true
+	s.tokens[id] = token
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteFamily(family string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, token := range s.tokens {
+		if token.Family == family {
+			delete(s.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteUserRefreshTokens(user string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, token := range s.tokens {
+		if token.User == user {
+			delete(s.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) PurgeExpired(now int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, token := range s.tokens {
+		if token.Exp < now {
+			delete(s.tokens, id)
+		}
+	}
+	return nil
+}
+
+// SQLRefreshTokenStore is a RefreshTokenStore which saves tokens in the table "Refresh_tokens"
+// of a database/sql database.
+type SQLRefreshTokenStore struct {
+	db *sql.DB
+}
+
+// NewSQLRefreshTokenStore creates the table "Refresh_tokens" in the database if not exists.
+func NewSQLRefreshTokenStore(db *sql.DB) (*SQLRefreshTokenStore, error) {
+	_, err := db.Exec(qryCreateRefreshTokensTable)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(qryCreateRefreshTokensIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLRefreshTokenStore{db}, nil
+}
+
+func (s *SQLRefreshTokenStore) SaveRefreshToken(token RefreshToken) error {
+	_, err := s.db.Exec(qryNewRefreshToken, token.ID, token.Family, token.User, token.Exp, token.Used)
+	return err
+}
+
+func (s *SQLRefreshTokenStore) GetRefreshToken(id string) (RefreshToken, error) {
+	token := RefreshToken{ID: id}
+	err := s.db.QueryRow(qryGetRefreshToken, id).Scan(&token.Family, &token.User, &token.Exp, &token.Used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, nil
+}
+
+func (s *SQLRefreshTokenStore) UseRefreshToken(id string) error {
+	result, err := s.db.Exec(qryUseRefreshToken, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+func (s *SQLRefreshTokenStore) DeleteFamily(family string) error {
+	_, err := s.db.Exec(qryDeleteRefreshTokenFamily, family)
+	return err
+}
+
+func (s *SQLRefreshTokenStore) DeleteUserRefreshTokens(user string) error {
+	_, err := s.db.Exec(qryDeleteUserRefreshTokens, user)
+	return err
+}
+
+func (s *SQLRefreshTokenStore) PurgeExpired(now int64) error {
+	_, err := s.db.Exec(qryPurgeRefreshTokens, now)
+	return err
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Access contains the authorization data of an authenticated user: auth level, roles
+// and permissions. Roles and permissions are loaded from the role store on first use.
+type Access struct {
+	User      string
+	AuthLevel int
+
+	a           *Authenticator
+	loaded      bool
+	roles       map[string]bool
+	permissions map[string]bool
+}
+
+// Rule is an authorization condition used by Require, RequireAny and RequireAll.
+type Rule func(access *Access) bool
+
+// GrantRole adds the role to the user.
+func GrantRole(user string, role string) error {
+	return defaultAuth.GrantRole(user, role)
+}
+
+// GrantRole adds the role to the user.
+func (a *Authenticator) GrantRole(user string, role string) error {
+	user = a.userKey(user)
+	err := a.roles.GrantRole(user, role)
+	if err != nil {
+		return fmt.Errorf("Role %s not granted to %s: %s", role, user, err.Error())
+	}
+	return nil
+}
+
+// RevokeRole removes the role from the user.
+func RevokeRole(user string, role string) error {
+	return defaultAuth.RevokeRole(user, role)
+}
+
+// RevokeRole removes the role from the user.
+func (a *Authenticator) RevokeRole(user string, role string) error {
+	user = a.userKey(user)
+	err := a.roles.RevokeRole(user, role)
+	if err != nil {
+		return fmt.Errorf("Role %s not revoked from %s: %s", role, user, err.Error())
+	}
+	return nil
+}
+
+// GetUserRoles returns the roles granted to the user. Roles mapped to auth levels are not included.
+func GetUserRoles(user string) ([]string, error) {
+	return defaultAuth.GetUserRoles(user)
+}
+
+// GetUserRoles returns the roles granted to the user. Roles mapped to auth levels are not included.
+func (a *Authenticator) GetUserRoles(user string) ([]string, error) {
+	user = a.userKey(user)
+	roles, err := a.roles.UserRoles(user)
+	if err != nil {
+		return nil, fmt.Errorf("%s roles could not be read: %s", user, err.Error())
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// GrantPermission adds the permission to the role.
+func GrantPermission(role string, permission string) error {
+	return defaultAuth.GrantPermission(role, permission)
+}
+
+// GrantPermission adds the permission to the role.
+func (a *Authenticator) GrantPermission(role string, permission string) error {
+	err := a.roles.GrantPermission(role, permission)
+	if err != nil {
+		return fmt.Errorf("Permission %s not granted to role %s: %s", permission, role, err.Error())
+	}
+	return nil
+}
+
+// RevokePermission removes the permission from the role.
+func RevokePermission(role string, permission string) error {
+	return defaultAuth.RevokePermission(role, permission)
+}
+
+// RevokePermission removes the permission from the role.
+func (a *Authenticator) RevokePermission(role string, permission string) error {
+	err := a.roles.RevokePermission(role, permission)
+	if err != nil {
+		return fmt.Errorf("Permission %s not revoked from role %s: %s", permission, role, err.Error())
+	}
+	return nil
+}
+
+// GetRolePermissions returns the permissions of the role.
+func GetRolePermissions(role string) ([]string, error) {
+	return defaultAuth.GetRolePermissions(role)
+}
+
+// GetRolePermissions returns the permissions of the role.
+func (a *Authenticator) GetRolePermissions(role string) ([]string, error) {
+	permissions, err := a.roles.RolePermissions(role)
+	if err != nil {
+		return nil, fmt.Errorf("Role %s permissions could not be read: %s", role, err.Error())
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+// MapLevelRoles maps an auth level onto roles: users whose auth level is equal or
+// greater than [level] have these roles too. This allows to mix auth levels and roles.
+func MapLevelRoles(level int, roles ...string) {
+	defaultAuth.MapLevelRoles(level, roles...)
+}
+
+// MapLevelRoles maps an auth level onto roles. See MapLevelRoles.
+func (a *Authenticator) MapLevelRoles(level int, roles ...string) {
+	a.mtxLevelRoles.Lock()
+	a.levelRoles[level] = append(a.levelRoles[level], roles...)
+	a.mtxLevelRoles.Unlock()
+}
+
+// GetAccess returns the authorization data of the user with auth level [authLevel].
+func GetAccess(user string, authLevel int) *Access {
+	return defaultAuth.GetAccess(user, authLevel)
+}
+
+// GetAccess returns the authorization data of the user. See GetAccess.
+func (a *Authenticator) GetAccess(user string, authLevel int) *Access {
+	user = a.userKey(user)
+	return &Access{User: user, AuthLevel: authLevel, a: a}
+}
+
+// HasRole returns true if the user has the role, granted or mapped from its auth level.
+func (access *Access) HasRole(role string) bool {
+	access.load()
+	return access.roles[role]
+}
+
+// HasPermission returns true if any role of the user has the permission.
+func (access *Access) HasPermission(permission string) bool {
+	access.load()
+	return access.permissions[permission]
+}
+
+func (access *Access) load() {
+	if access.loaded {
+		return
+	}
+	access.loaded = true
+	access.roles = make(map[string]bool)
+	access.permissions = make(map[string]bool)
+	a := access.a
+
+	roles, err := a.roles.UserRoles(access.User)
+	if err != nil {
+		log.Printf("%s roles could not be read: %s", access.User, err)
+	}
+	a.mtxLevelRoles.Lock()
+	for level, levelRoles := range a.levelRoles {
+		if access.AuthLevel >= level {
+			roles = append(roles, levelRoles...)
+		}
+	}
+	a.mtxLevelRoles.Unlock()
+
+	for _, role := range roles {
+		if access.roles[role] {
+			continue
+		}
+		access.roles[role] = true
+		permissions, err := a.roles.RolePermissions(role)
+		if err != nil {
+			log.Printf("Role %s permissions could not be read: %s", role, err)
+			continue
+		}
+		for _, permission := range permissions {
+			access.permissions[permission] = true
+		}
+	}
+}
+
+// Role returns a Rule which passes if the user has the role.
+func Role(role string) Rule {
+	return func(access *Access) bool {
+		return access.HasRole(role)
+	}
+}
+
+// Permission returns a Rule which passes if the user has the permission.
+func Permission(permission string) Rule {
+	return func(access *Access) bool {
+		return access.HasPermission(permission)
+	}
+}
+
+// Level returns a Rule which passes if the user auth level is equal or greater than authLevel.
+func Level(authLevel int) Rule {
+	return func(access *Access) bool {
+		return access.AuthLevel >= authLevel
+	}
+}
+
+// Any returns a Rule which passes if any of the rules passes.
+func Any(rules ...Rule) Rule {
+	return func(access *Access) bool {
+		for _, rule := range rules {
+			if rule(access) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// All returns a Rule which passes if all the rules pass.
+func All(rules ...Rule) Rule {
+	return func(access *Access) bool {
+		for _, rule := range rules {
+			if !rule(access) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RequireRole returns a middleware which only allows users with the role.
+// notLoggedURL and forbiddenURL work as in GetAuthMiddleware.
+func RequireRole(role string, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return defaultAuth.Require(Role(role), notLoggedURL, forbiddenURL)
+}
+
+// RequireRole returns a middleware which only allows users with the role. See RequireRole.
+func (a *Authenticator) RequireRole(role string, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return a.Require(Role(role), notLoggedURL, forbiddenURL)
+}
+
+// RequirePermission returns a middleware which only allows users with the permission.
+// notLoggedURL and forbiddenURL work as in GetAuthMiddleware.
+func RequirePermission(permission string, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return defaultAuth.Require(Permission(permission), notLoggedURL, forbiddenURL)
+}
+
+// RequirePermission returns a middleware which only allows users with the permission. See RequirePermission.
+func (a *Authenticator) RequirePermission(permission string, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return a.Require(Permission(permission), notLoggedURL, forbiddenURL)
+}
+
+// RequireAny returns a middleware which only allows users who pass any of the rules.
+func RequireAny(rules []Rule, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return defaultAuth.Require(Any(rules...), notLoggedURL, forbiddenURL)
+}
+
+// RequireAny returns a middleware which only allows users who pass any of the rules.
+func (a *Authenticator) RequireAny(rules []Rule, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return a.Require(Any(rules...), notLoggedURL, forbiddenURL)
+}
+
+// RequireAll returns a middleware which only allows users who pass all the rules.
+func RequireAll(rules []Rule, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return defaultAuth.Require(All(rules...), notLoggedURL, forbiddenURL)
+}
+
+// RequireAll returns a middleware which only allows users who pass all the rules.
+func (a *Authenticator) RequireAll(rules []Rule, notLoggedURL string, forbiddenURL string) func(http.Handler) http.Handler {
+	return a.Require(All(rules...), notLoggedURL, forbiddenURL)
+}
+
+// deleteUserRoles revokes all roles granted to the user.
+func (a *Authenticator) deleteUserRoles(user string) error {
+	roles, err := a.roles.UserRoles(user)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if err := a.roles.RevokeRole(user, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"sync"
+)
+
+// RoleStore is the storage backend of the roles of the users and the permissions of the roles.
+//
+// This package includes SQLRoleStore and MemoryRoleStore.
+type RoleStore interface {
+	// GrantRole adds the role to the user.
+	GrantRole(user string, role string) error
+
+	// RevokeRole removes the role from the user.
+	RevokeRole(user string, role string) error
+
+	// UserRoles returns the roles of the user.
+	UserRoles(user string) ([]string, error)
+
+	// GrantPermission adds the permission to the role.
+	GrantPermission(role string, permission string) error
+
+	// RevokePermission removes the permission from the role.
+	RevokePermission(role string, permission string) error
+
+	// RolePermissions returns the permissions of the role.
+	RolePermissions(role string) ([]string, error)
+}
+
+// MemoryRoleStore is a concurrency-safe RoleStore which keeps roles and permissions in memory.
+type MemoryRoleStore struct {
+	userRoles       map[string]map[string]bool
+	rolePermissions map[string]map[string]bool
+	mtx             *sync.RWMutex
+}
+
+// NewMemoryRoleStore creates an empty MemoryRoleStore.
+func NewMemoryRoleStore() *MemoryRoleStore {
+	return &MemoryRoleStore{
+		userRoles:       make(map[string]map[string]bool),
+		rolePermissions: make(map[string]map[string]bool),
+		mtx:             &sync.RWMutex{},
+	}
+}
+
+func (s *MemoryRoleStore) GrantRole(user string, role string) error {
+	s.mtx.Lock()
+	addToSet(s.userRoles, user, role)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryRoleStore) RevokeRole(user string, role string) error {
+	s.mtx.Lock()
+	delete(s.userRoles[user], role)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryRoleStore) UserRoles(user string) ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return setToSlice(s.userRoles[user]), nil
+}
+
+func (s *MemoryRoleStore) GrantPermission(role string, permission string) error {
+	s.mtx.Lock()
+	addToSet(s.rolePermissions, role, permission)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryRoleStore) RevokePermission(role string, permission string) error {
+	s.mtx.Lock()
+	delete(s.rolePermissions[role], permission)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryRoleStore) RolePermissions(role string) ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return setToSlice(s.rolePermissions[role]), nil
+}
+
+func addToSet(sets map[string]map[string]bool, key string, value string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		sets[key] = set
+	}
+	set[value] = true
+}
+
+func setToSlice(set map[string]bool) []string {
+	values := make([]string, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	return values
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"database/sql"
+)
+
+// SQLRoleStore is a RoleStore which saves roles in the tables "User_roles" and
+// "Role_permissions" of a database/sql database.
+type SQLRoleStore struct {
+	db *sql.DB
+}
+
+// NewSQLRoleStore creates the tables "User_roles" and "Role_permissions" in the database if not exist.
+func NewSQLRoleStore(db *sql.DB) (*SQLRoleStore, error) {
+	_, err := db.Exec(qryCreateUserRolesTable)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(qryCreateRolePermissionsTable)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLRoleStore{db}, nil
+}
+
+func (s *SQLRoleStore) GrantRole(user string, role string) error {
+	return replaceRow(s.db, qryRevokeRole, []interface{}{user, role}, qryGrantRole, user, role)
+}
+
+func (s *SQLRoleStore) RevokeRole(user string, role string) error {
+	_, err := s.db.Exec(qryRevokeRole, user, role)
+	return err
+}
+
+func (s *SQLRoleStore) UserRoles(user string) ([]string, error) {
+	return s.queryStrings(qryGetUserRoles, user)
+}
+
+func (s *SQLRoleStore) GrantPermission(role string, permission string) error {
+	return replaceRow(s.db, qryRevokePermission, []interface{}{role, permission}, qryGrantPermission, role, permission)
+}
+
+func (s *SQLRoleStore) RevokePermission(role string, permission string) error {
+	_, err := s.db.Exec(qryRevokePermission, role, permission)
+	return err
+}
+
+func (s *SQLRoleStore) RolePermissions(role string) ([]string, error) {
+	return s.queryStrings(qryGetRolePermissions, role)
+}
+
+func (s *SQLRoleStore) queryStrings(query string, arg string) ([]string, error) {
+	rows, err := s.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
@@ -1,106 +1,315 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"strconv"
-	"sync"
 	"time"
-
-	"github.com/jjcapellan/wordgen"
 )
 
-type userSession struct {
-	userId    string
-	exp       int64 // Expire time
-	authLevel int
-}
-
-var sessionStore map[string]userSession = make(map[string]userSession)
-
-var mtxSessionStore *sync.Mutex = &sync.Mutex{}
-
-// NewSession creates and saves in users database and sessionStore a new session.
+// NewSession creates and saves in the session store a new session.
 //
-// Session expires in [duration] seconds.
+// Session expires in [duration] seconds. If sliding sessions are enabled, duration is the
+// idle timeout and the session is extended while the user is active.
 //
 // authLevel should be used to filter user access privileges.
 func NewSession(user string, duration int, authLevel int, w http.ResponseWriter) error {
-	token := createToken()
-	expireTime := time.Now().Unix() + int64(duration)
-	err := registerNewSession(user, token, expireTime)
+	return defaultAuth.NewSession(user, duration, authLevel, w)
+}
+
+// NewSession creates and saves a new session. See NewSession.
+func (a *Authenticator) NewSession(user string, duration int, authLevel int, w http.ResponseWriter) error {
+	return a.NewSessionFromRequest(user, duration, authLevel, w, nil)
+}
+
+// NewSessionFromRequest is like NewSession, but also saves the user agent and the IP of
+// the request, so the user can identify each device in the list of active sessions.
+//
+// methods are the authentication methods checked for the user before the session
+// (Ex: MethodPassword after CheckLogin), saved in Session.AMR. With two or more different
+// methods, the session is marked as verified with a second factor (Session.TwoFactor).
+func NewSessionFromRequest(user string, duration int, authLevel int, w http.ResponseWriter, r *http.Request, methods ...string) error {
+	return defaultAuth.NewSessionFromRequest(user, duration, authLevel, w, r, methods...)
+}
+
+// NewSessionFromRequest creates and saves a new session. See NewSessionFromRequest.
+func (a *Authenticator) NewSessionFromRequest(user string, duration int, authLevel int, w http.ResponseWriter, r *http.Request, methods ...string) error {
+	token, session, err := a.createSession(user, duration, authLevel, r, methods, isMultiFactor(methods))
 	if err != nil {
 		return err
 	}
 
-	objUser := userSession{user, expireTime, authLevel}
+	a.setSessionCookie(w, token, session.Exp)
+
+	return nil
+}
+
+// NewSessionToken is like NewSessionFromRequest, but instead of setting the session cookie
+// it returns the session token, which API clients send in the header
+// "Authorization: Bearer <token>" (see GetAPIMiddleware). r may be nil.
+func NewSessionToken(user string, duration int, authLevel int, r *http.Request, methods ...string) (string, error) {
+	return defaultAuth.NewSessionToken(user, duration, authLevel, r, methods...)
+}
+
+// NewSessionToken creates and saves a new session and returns its token. See NewSessionToken.
+func (a *Authenticator) NewSessionToken(user string, duration int, authLevel int, r *http.Request, methods ...string) (string, error) {
+	token, _, err := a.createSession(user, duration, authLevel, r, methods, isMultiFactor(methods))
+	return token, err
+}
+
+// createSession creates and saves a new session authenticated with the methods, and
+// returns its token. twoFactor marks the session as verified with a second factor.
+func (a *Authenticator) createSession(user string, duration int, authLevel int, r *http.Request, methods []string, twoFactor bool) (string, Session, error) {
+	user = a.userKey(user)
+	token, err := createToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+	now := time.Now().Unix()
+	session := Session{
+		ID:        a.hashToken(token),
+		User:      user,
+		AuthLevel: authLevel,
+		Created:   now,
+		LastSeen:  now,
+		Exp:       now + int64(duration),
+	}
+	if a.slidingSessions {
+		session.Idle = int64(duration)
+	}
+	if a.maxSessionLifetime > 0 {
+		session.MaxExp = now + a.maxSessionLifetime
+		if session.Exp > session.MaxExp {
+			session.Exp = session.MaxExp
+		}
+	}
+	session.AMR = methods
+	session.AuthTime = now
+	session.TwoFactor = twoFactor
+	if r != nil {
+		session.UserAgent = r.UserAgent()
+		session.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	err = a.registerNewSession(session)
+	if err != nil {
+		return "", Session{}, err
+	}
+	return token, session, nil
+}
+
+// ListSessions returns the active sessions of the user.
+func ListSessions(user string) ([]Session, error) {
+	return defaultAuth.ListSessions(user)
+}
 
-	mtxSessionStore.Lock()
-	sessionStore[token] = objUser
-	mtxSessionStore.Unlock()
+// ListSessions returns the active sessions of the user.
+func (a *Authenticator) ListSessions(user string) ([]Session, error) {
+	user = a.userKey(user)
+	sessions, err := a.sessions.ListUserSessions(user)
+	if err != nil {
+		return nil, fmt.Errorf("%s sessions could not be read from session store: %s", user, err.Error())
+	}
+	active := sessions[:0]
+	for _, session := range sessions {
+		if checkExpTime(session) && !session.Revoked {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
 
-	setSessionCookie(token, w)
+// RevokeSession revokes one session of the user. sessionId is the field ID of
+// a Session returned by ListSessions.
+//
+// Revoked sessions are rejected with ErrSessionRevoked until they expire.
+func RevokeSession(user string, sessionId string) error {
+	return defaultAuth.RevokeSession(user, sessionId)
+}
 
+// RevokeSession revokes one session of the user. See RevokeSession.
+func (a *Authenticator) RevokeSession(user string, sessionId string) error {
+	user = a.userKey(user)
+	session, err := a.sessions.GetSession(sessionId)
+	if err != nil || session.User != user {
+		return fmt.Errorf("Session of %s could not be revoked: %s", user, ErrSessionNotFound.Error())
+	}
+	err = a.sessions.RevokeSession(sessionId)
+	if err != nil {
+		return fmt.Errorf("Session of %s could not be revoked: %s", user, err.Error())
+	}
 	return nil
 }
 
+// RevokeAllSessions revokes all sessions of the user.
+func RevokeAllSessions(user string) error {
+	return defaultAuth.RevokeAllSessions(user)
+}
+
+// RevokeAllSessions revokes all sessions of the user.
+func (a *Authenticator) RevokeAllSessions(user string) error {
+	user = a.userKey(user)
+	sessions, err := a.sessions.ListUserSessions(user)
+	if err != nil {
+		return fmt.Errorf("%s sessions could not be revoked: %s", user, err.Error())
+	}
+	for _, session := range sessions {
+		if session.Revoked {
+			continue
+		}
+		err = a.sessions.RevokeSession(session.ID)
+		if err != nil {
+			return fmt.Errorf("%s sessions could not be revoked: %s", user, err.Error())
+		}
+	}
+	return nil
+}
+
+// GetSessionId returns the ID of the session of the request, so the current device can be
+// identified in the list returned by ListSessions.
+func GetSessionId(r *http.Request) (string, error) {
+	return defaultAuth.GetSessionId(r)
+}
+
+// GetSessionId returns the ID of the session of the request. See GetSessionId.
+func (a *Authenticator) GetSessionId(r *http.Request) (string, error) {
+	token, err := a.readSessionCookie(r)
+	if err != nil {
+		return "", err
+	}
+	return a.hashToken(token), nil
+}
+
 // Gets authorization level from a session token
 func GetUserAuthLevel(token string) int {
-	defer mtxSessionStore.Unlock()
-	mtxSessionStore.Lock()
+	return defaultAuth.GetUserAuthLevel(token)
+}
 
-	session, ok := sessionStore[token]
-	if !ok {
+// Gets authorization level from a session token
+func (a *Authenticator) GetUserAuthLevel(token string) int {
+	session, err := a.getSession(token)
+	if err != nil {
 		return 0
 	}
-	return session.authLevel
+	return session.AuthLevel
 }
 
-func createToken() string {
-	randomPart := wordgen.NotSymbols(10)
-	timePart := strconv.FormatInt(time.Now().UnixNano(), 10)
-	return randomPart + timePart
+// tokenSize is the number of random bytes (256 bits) of a session token.
+const tokenSize = 32
+
+// createToken returns a random URL-safe session token.
+func createToken() (string, error) {
+	b := make([]byte, tokenSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("session token could not be generated: %s", err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func registerNewSession(user string, token string, expireTime int64) error {
-	_, err := conf.db.Exec(qryNewSession, token, expireTime, user)
+// hashToken returns the session ID saved in the session store: an HMAC-SHA256 of the
+// token keyed with the secret, so a leaked store does not contain valid session tokens.
+func (a *Authenticator) hashToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(a.secret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getSession returns the session of the token from the session store.
+func (a *Authenticator) getSession(token string) (Session, error) {
+	id := a.hashToken(token)
+	session, err := a.sessions.GetSession(id)
 	if err != nil {
-		log.Printf("auth token not registered in database: %s", err)
-		customErr := fmt.Errorf("%s session token could not be registered in database: %s", user, err.Error())
+		return Session{}, err
+	}
+	// Stores may match keys loosely (Ex: case insensitive collations), so the
+	// returned ID is compared again in constant time.
+	if subtle.ConstantTimeCompare([]byte(session.ID), []byte(id)) != 1 {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (a *Authenticator) registerNewSession(session Session) error {
+	err := a.sessions.CreateSession(session)
+	if err != nil {
+		log.Printf("auth token not registered in session store: %s", err)
+		customErr := fmt.Errorf("%s session token could not be registered in session store: %s", session.User, err.Error())
 		return customErr
 	}
+
+	a.mtxSessionCount.Lock()
+	a.sessionCount++
+	clean := a.sessionCount > a.cleanSessionsCycle
+	if clean {
+		a.sessionCount = 0
+	}
+	a.mtxSessionCount.Unlock()
+	if clean {
+		go a.cleanSessionStore()
+	}
+
 	return nil
 }
 
-func checkExpTime(session userSession) bool {
-	return session.exp > time.Now().Unix()
+func checkExpTime(session Session) bool {
+	return session.Exp > time.Now().Unix()
 }
 
-func getUserSession(sessionId string) (userSession, error) {
-	row := conf.db.QueryRow(qryGetUserSession, sessionId)
-	var userId string
-	var exp int64
-	var authLevel int
-	err := row.Scan(&userId, &exp, &authLevel)
+func (a *Authenticator) deleteSession(token string) error {
+	err := a.sessions.DeleteSession(token)
 	if err != nil {
-		customErr := fmt.Errorf("Sesion Id not found in database: %s", err.Error())
-		return userSession{}, customErr
+		customErr := fmt.Errorf("Session could not be deleted from session store: %s", err.Error())
+		return customErr
 	}
-	return userSession{userId, exp, authLevel}, nil
+	return nil
 }
 
-func deleteSession(token string) error {
-	mtxSessionStore.Lock()
-	session := sessionStore[token]
-	user := session.userId
-	delete(sessionStore, token)
-	mtxSessionStore.Unlock()
+// refreshSession extends the expire time of a sliding session and re-issues its cookie.
+// The session store is updated at most once every sessionTouchInterval seconds.
+//
+// Returns the updated session.
+func (a *Authenticator) refreshSession(w http.ResponseWriter, r *http.Request, session Session) Session {
+	if session.Idle == 0 {
+		return session
+	}
+	now := time.Now().Unix()
+	if now-session.LastSeen < a.sessionTouchInterval {
+		return session
+	}
 
-	_, err := conf.db.Exec(qryDeleteSession, user)
+	exp := now + session.Idle
+	if session.MaxExp > 0 && exp > session.MaxExp {
+		exp = session.MaxExp
+	}
+	if exp <= session.Exp {
+		return session
+	}
+
+	err := a.sessions.TouchSession(session.ID, now, exp)
 	if err != nil {
-		customErr := fmt.Errorf("Sessioncold not be deleted from database: %s", err.Error())
-		return customErr
+		log.Printf("session of %s not refreshed in session store: %s", session.User, err)
+		return session
+	}
+	session.LastSeen = now
+	session.Exp = exp
+
+	token, err := a.readSessionCookie(r)
+	if err == nil {
+		a.setSessionCookie(w, token, exp)
+	}
+	return session
+}
+
+func (a *Authenticator) cleanSessionStore() {
+	_, err := a.sessions.PurgeExpired(time.Now().Unix())
+	if err != nil {
+		log.Printf("expired sessions not purged from session store: %s", err)
 	}
-	return nil
 }
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+)
+
+// Session is a user session as it is saved in a SessionStore.
+type Session struct {
+	ID        string // HMAC-SHA256 of the session token
+	User      string
+	AuthLevel int
+	Created   int64 // Creation time (unix seconds)
+	LastSeen  int64 // Last activity time (unix seconds)
+	Exp       int64 // Expire time (unix seconds)
+	Idle      int64 // Idle timeout in seconds of sliding sessions. 0 if expire time is fixed
+	MaxExp    int64 // Absolute expire time (unix seconds). 0 if there is no limit
+	UserAgent string
+	IP        string
+	Revoked   bool     // Revoked sessions are kept until expiration to report ErrSessionRevoked
+	TwoFactor bool     // true if the session was created after a second factor verification
+	AuthTime  int64    // Time of the last authentication of the user (unix seconds)
+	AMR       []string // Authentication methods used in the last authentication (Ex: MethodPassword)
+}
+
+// SessionStore is the storage backend of the sessions. Several app instances can
+// share the same session backend.
+//
+// This package includes MemorySessionStore and SQLSessionStore. The package
+// boltstore contains an embedded key-value implementation.
+type SessionStore interface {
+	// CreateSession saves a new session.
+	CreateSession(session Session) error
+
+	// GetSession returns the session. Returns ErrSessionNotFound if session not exists.
+	GetSession(id string) (Session, error)
+
+	// TouchSession updates last activity and expire time of the session.
+	TouchSession(id string, lastSeen int64, exp int64) error
+
+	// RevokeSession marks the session as revoked.
+	RevokeSession(id string) error
+
+	// UpdateSessionAuth updates authentication time, methods and second factor flag of the session.
+	UpdateSessionAuth(id string, authTime int64, amr []string, twoFactor bool) error
+
+	// DeleteSession deletes the session.
+	DeleteSession(id string) error
+
+	// DeleteUserSessions deletes all sessions of the user.
+	DeleteUserSessions(user string) error
+
+	// ListUserSessions returns all sessions of the user.
+	ListUserSessions(user string) ([]Session, error)
+
+	// PurgeExpired deletes all sessions expired before [now] and returns the number of deleted sessions.
+	PurgeExpired(now int64) (int, error)
+}
+
+// ErrSessionNotFound is returned by SessionStore when the session does not exist.
+var ErrSessionNotFound = errors.New("session not found")
+
+// MemorySessionStore is a concurrency-safe SessionStore which keeps sessions in memory.
+// It can not be shared by several app instances.
+type MemorySessionStore struct {
+	sessions map[string]Session
+	mtx      *sync.RWMutex
+}
+
+// NewMemorySessionStore creates an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]Session),
+		mtx:      &sync.RWMutex{},
+	}
+}
+
+func (s *MemorySessionStore) CreateSession(session Session) error {
+	s.mtx.Lock()
+	s.sessions[session.ID] = session
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) GetSession(id string) (Session, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) TouchSession(id string, lastSeen int64, exp int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.LastSeen = lastSeen
+	session.Exp = exp
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) RevokeSession(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.Revoked = true
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) UpdateSessionAuth(id string, authTime int64, amr []string, twoFactor bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.AuthTime = authTime
+	session.AMR = amr
+	session.TwoFactor = twoFactor
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteSession(id string) error {
+	s.mtx.Lock()
+	delete(s.sessions, id)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteUserSessions(user string) error {
+	s.mtx.Lock()
+	for id, session := range s.sessions {
+		if session.User == user {
+			delete(s.sessions, id)
+		}
+	}
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) ListUserSessions(user string) ([]Session, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.User == user {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) PurgeExpired(now int64) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	count := 0
+	for id, session := range s.sessions {
+		if session.Exp < now {
+			delete(s.sessions, id)
+			count++
+		}
+	}
+	return count, nil
+}
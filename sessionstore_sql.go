@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQLSessionStore is a SessionStore which saves sessions in the table "Sessions"
+// of a database/sql database, so it can be shared by several app instances.
+type SQLSessionStore struct {
+	db *sql.DB
+}
+
+// NewSQLSessionStore creates the table "Sessions" in the database if not exists.
+func NewSQLSessionStore(db *sql.DB) (*SQLSessionStore, error) {
+	_, err := db.Exec(qryCreateSessionsTable)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(qryCreateSessionsIndex)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(qryCheckAuthColumns)
+	if err == nil {
+		rows.Close()
+		return &SQLSessionStore{db}, nil
+	}
+	for _, qry := range []string{qryAddAuthTimeColumn, qryAddAmrColumn} {
+		_, err = db.Exec(qry)
+		if err != nil {
+			return nil, fmt.Errorf("Sessions table not updated: %s", err.Error())
+		}
+	}
+	return &SQLSessionStore{db}, nil
+}
+
+func (s *SQLSessionStore) CreateSession(session Session) error {
+	_, err := s.db.Exec(qryNewSession, session.ID, session.User, session.AuthLevel,
+		session.Created, session.LastSeen, session.Exp, session.Idle, session.MaxExp,
+		session.UserAgent, session.IP, session.TwoFactor, session.AuthTime, strings.Join(session.AMR, ","))
+	return err
+}
+
+func (s *SQLSessionStore) GetSession(id string) (Session, error) {
+	row := s.db.QueryRow(qryGetSession, id)
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, err
+}
+
+func (s *SQLSessionStore) TouchSession(id string, lastSeen int64, exp int64) error {
+	_, err := s.db.Exec(qryTouchSession, lastSeen, exp, id)
+	return err
+}
+
+func (s *SQLSessionStore) RevokeSession(id string) error {
+	_, err := s.db.Exec(qryRevokeSession, id)
+	return err
+}
+
+func (s *SQLSessionStore) UpdateSessionAuth(id string, authTime int64, amr []string, twoFactor bool) error {
+	_, err := s.db.Exec(qryUpdateSessionAuth, authTime, strings.Join(amr, ","), twoFactor, id)
+	return err
+}
+
+func (s *SQLSessionStore) DeleteSession(id string) error {
+	_, err := s.db.Exec(qryDeleteSession, id)
+	return err
+}
+
+func (s *SQLSessionStore) DeleteUserSessions(user string) error {
+	_, err := s.db.Exec(qryDeleteUserSessions, user)
+	return err
+}
+
+func (s *SQLSessionStore) ListUserSessions(user string) ([]Session, error) {
+	rows, err := s.db.Query(qryListUserSessions, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLSessionStore) PurgeExpired(now int64) (int, error) {
+	result, err := s.db.Exec(qryPurgeSessions, now)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	session := Session{}
+	var userAgent, ip, amr sql.NullString
+	err := row.Scan(&session.ID, &session.User, &session.AuthLevel,
+		&session.Created, &session.LastSeen, &session.Exp, &session.Idle, &session.MaxExp,
+		&userAgent, &ip, &session.Revoked, &session.TwoFactor, &session.AuthTime, &amr)
+	session.UserAgent = userAgent.String
+	session.IP = ip.String
+	if amr.String != "" {
+		session.AMR = strings.Split(amr.String, ",")
+	}
+	return session, err
+}
@@ -1,31 +1,274 @@
 package auth
 
+import "database/sql"
+
+// replaceRow deletes a row and inserts it again in one transaction. It is the portable
+// form of the upserts of each database (Ex: INSERT OR REPLACE of SQLite).
+func replaceRow(db *sql.DB, qryDelete string, key []interface{}, qryInsert string, values ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(qryDelete, key...)
+	if err == nil {
+		_, err = tx.Exec(qryInsert, values...)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 const qryCreateTable = "CREATE TABLE IF NOT EXISTS Users (" +
 	"PK_USER TEXT NOT NULL PRIMARY KEY UNIQUE," +
 	"Password TEXT NOT NULL," +
 	"Email TEXT," +
 	"Salt TEXT NOT NULL," +
-	"Session_id TEXT," +
-	"Session_exp BIGINT," +
-	"Auth_level INTEGER DEFAULT 0" +
+	"Auth_level INTEGER DEFAULT 0," +
+	"Email_verified INTEGER DEFAULT 0," +
+	"Pending_email TEXT," +
+	"Require_2fa INTEGER DEFAULT 0" +
 	");"
 
-const qryNewUser = "INSERT INTO Users (PK_USER, Password, Email, Salt, Auth_level) VALUES (?,?,?,?,?);"
+// Columns added to the table "Users" of older versions
+const qryCheckEmailColumns = "SELECT Email_verified, Pending_email FROM Users LIMIT 1;"
+
+const qryAddEmailVerifiedColumn = "ALTER TABLE Users ADD COLUMN Email_verified INTEGER DEFAULT 0;"
 
-const qryNewSession = "UPDATE Users SET Session_id = ?, Session_exp = ? WHERE PK_USER = ?;"
+const qryAddPendingEmailColumn = "ALTER TABLE Users ADD COLUMN Pending_email TEXT;"
 
-const qryGetUserSession = "SELECT PK_USER,Session_exp,Auth_level FROM Users WHERE Session_id = ?;"
+const qryCheckRequire2FAColumn = "SELECT Require_2fa FROM Users LIMIT 1;"
 
-const qryGetUser = "SELECT Password, Email, Salt, Auth_level FROM Users WHERE PK_USER = ?;"
+const qryAddRequire2FAColumn = "ALTER TABLE Users ADD COLUMN Require_2fa INTEGER DEFAULT 0;"
 
-const qryGetUserEmail = "SELECT Email FROM Users WHERE PK_USER = ?;"
+const qryNewUser = "INSERT INTO Users (PK_USER, Password, Email, Salt, Auth_level, Email_verified, Pending_email, Require_2fa) VALUES (?,?,?,?,?,?,?,?);"
+
+const qryGetUser = "SELECT Password, Email, Salt, Auth_level, Email_verified, Pending_email, Require_2fa FROM Users WHERE PK_USER = ?;"
 
 const qryGetUsersCount = "SELECT COUNT(*) FROM Users"
 
-const qryDeleteUser = "DELETE FROM Users WHERE PK_USER = ?;"
+const qryListUsers = "SELECT PK_USER FROM Users;"
+
+const qryUsersByEmail = "SELECT PK_USER FROM Users WHERE Email = ?;"
 
-const qryDeleteSession = "UPDATE Users SET Session_exp = 0 WHERE PK_USER = ?;"
+const qryDeleteUser = "DELETE FROM Users WHERE PK_USER = ?;"
 
 const qryUpdatePass = "UPDATE Users SET Password = ?, Salt = ? WHERE PK_USER = ?;"
 
 const qryUpdateEmail = "UPDATE Users SET Email = ? WHERE PK_USER = ?;"
+
+const qryUpdateEmailStatus = "UPDATE Users SET Email_verified = ?, Pending_email = ? WHERE PK_USER = ?;"
+
+const qryUpdateRequire2FA = "UPDATE Users SET Require_2fa = ? WHERE PK_USER = ?;"
+
+const qryCreateSessionsTable = "CREATE TABLE IF NOT EXISTS Sessions (" +
+	"PK_SESSION TEXT NOT NULL PRIMARY KEY UNIQUE," + // HMAC-SHA256 of the session token
+	"FK_USER TEXT NOT NULL," +
+	"Auth_level INTEGER DEFAULT 0," +
+	"Created BIGINT NOT NULL," +
+	"Last_seen BIGINT NOT NULL," +
+	"Exp BIGINT NOT NULL," +
+	"Idle BIGINT DEFAULT 0," +
+	"Max_exp BIGINT DEFAULT 0," +
+	"User_agent TEXT," +
+	"IP TEXT," +
+	"Revoked BOOLEAN DEFAULT 0," +
+	"Two_factor BOOLEAN DEFAULT 0," +
+	"Auth_time BIGINT DEFAULT 0," +
+	"Amr TEXT DEFAULT ''" + // Comma separated authentication methods
+	");"
+
+const qryCreateSessionsIndex = "CREATE INDEX IF NOT EXISTS Sessions_user ON Sessions (FK_USER);"
+
+const qryNewSession = "INSERT INTO Sessions (PK_SESSION, FK_USER, Auth_level, Created, Last_seen, Exp, Idle, Max_exp, User_agent, IP, Two_factor, Auth_time, Amr) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?);"
+
+const qryGetSession = "SELECT PK_SESSION, FK_USER, Auth_level, Created, Last_seen, Exp, Idle, Max_exp, User_agent, IP, Revoked, Two_factor, Auth_time, Amr FROM Sessions WHERE PK_SESSION = ?;"
+
+const qryTouchSession = "UPDATE Sessions SET Last_seen = ?, Exp = ? WHERE PK_SESSION = ?;"
+
+const qryRevokeSession = "UPDATE Sessions SET Revoked = 1 WHERE PK_SESSION = ?;"
+
+const qryUpdateSessionAuth = "UPDATE Sessions SET Auth_time = ?, Amr = ?, Two_factor = ? WHERE PK_SESSION = ?;"
+
+const qryCheckAuthColumns = "SELECT Auth_time, Amr FROM Sessions LIMIT 1;"
+
+const qryAddAuthTimeColumn = "ALTER TABLE Sessions ADD COLUMN Auth_time BIGINT DEFAULT 0;"
+
+const qryAddAmrColumn = "ALTER TABLE Sessions ADD COLUMN Amr TEXT DEFAULT '';"
+
+const qryDeleteSession = "DELETE FROM Sessions WHERE PK_SESSION = ?;"
+
+const qryDeleteUserSessions = "DELETE FROM Sessions WHERE FK_USER = ?;"
+
+const qryListUserSessions = "SELECT PK_SESSION, FK_USER, Auth_level, Created, Last_seen, Exp, Idle, Max_exp, User_agent, IP, Revoked, Two_factor, Auth_time, Amr FROM Sessions WHERE FK_USER = ?;"
+
+const qryPurgeSessions = "DELETE FROM Sessions WHERE Exp < ?;"
+
+const qryCreateUserRolesTable = "CREATE TABLE IF NOT EXISTS User_roles (" +
+	"FK_USER TEXT NOT NULL," +
+	"Role TEXT NOT NULL," +
+	"PRIMARY KEY (FK_USER, Role)" +
+	");"
+
+const qryCreateRolePermissionsTable = "CREATE TABLE IF NOT EXISTS Role_permissions (" +
+	"Role TEXT NOT NULL," +
+	"Permission TEXT NOT NULL," +
+	"PRIMARY KEY (Role, Permission)" +
+	");"
+
+const qryGrantRole = "INSERT INTO User_roles (FK_USER, Role) VALUES (?,?);"
+
+const qryRevokeRole = "DELETE FROM User_roles WHERE FK_USER = ? AND Role = ?;"
+
+const qryGetUserRoles = "SELECT Role FROM User_roles WHERE FK_USER = ?;"
+
+const qryGrantPermission = "INSERT INTO Role_permissions (Role, Permission) VALUES (?,?);"
+
+const qryRevokePermission = "DELETE FROM Role_permissions WHERE Role = ? AND Permission = ?;"
+
+const qryGetRolePermissions = "SELECT Permission FROM Role_permissions WHERE Role = ?;"
+
+const qryCreatePasswordHistoryTable = "CREATE TABLE IF NOT EXISTS Password_history (" +
+	"FK_USER TEXT NOT NULL," +
+	"Password TEXT NOT NULL," +
+	"Created BIGINT NOT NULL" +
+	");"
+
+const qryAddPasswordHistory = "INSERT INTO Password_history (FK_USER, Password, Created) VALUES (?,?,?);"
+
+const qryGetPasswordHistory = "SELECT Password FROM Password_history WHERE FK_USER = ? ORDER BY Created DESC LIMIT ?;"
+
+const qryDeletePasswordHistory = "DELETE FROM Password_history WHERE FK_USER = ?;"
+
+const qryCreatePasswordResetsTable = "CREATE TABLE IF NOT EXISTS Password_resets (" +
+	"PK_RESET TEXT NOT NULL PRIMARY KEY," +
+	"FK_USER TEXT NOT NULL," +
+	"Created BIGINT NOT NULL," +
+	"Exp BIGINT NOT NULL" +
+	");"
+
+const qryCreatePasswordResetsIndex = "CREATE INDEX IF NOT EXISTS Password_resets_user ON Password_resets (FK_USER);"
+
+const qryNewPasswordReset = "INSERT INTO Password_resets (PK_RESET, FK_USER, Created, Exp) VALUES (?,?,?,?);"
+
+const qryGetPasswordReset = "SELECT FK_USER, Created, Exp FROM Password_resets WHERE PK_RESET = ?;"
+
+const qryLastPasswordReset = "SELECT PK_RESET, Created, Exp FROM Password_resets WHERE FK_USER = ? ORDER BY Created DESC LIMIT 1;"
+
+const qryDeletePasswordReset = "DELETE FROM Password_resets WHERE PK_RESET = ?;"
+
+const qryDeleteUserPasswordResets = "DELETE FROM Password_resets WHERE FK_USER = ?;"
+
+const qryPurgePasswordResets = "DELETE FROM Password_resets WHERE Exp < ?;"
+
+const qryCreateTOTPTable = "CREATE TABLE IF NOT EXISTS Totp_secrets (" +
+	"FK_USER TEXT NOT NULL PRIMARY KEY," +
+	"Secret TEXT NOT NULL," +
+	"Confirmed INTEGER DEFAULT 0," +
+	"Last_step BIGINT DEFAULT 0" +
+	");"
+
+const qrySaveTOTP = "INSERT INTO Totp_secrets (FK_USER, Secret, Confirmed, Last_step) VALUES (?,?,?,?);"
+
+const qryGetTOTP = "SELECT Secret, Confirmed, Last_step FROM Totp_secrets WHERE FK_USER = ?;"
+
+const qryUseTOTPStep = "UPDATE Totp_secrets SET Last_step = ? WHERE FK_USER = ? AND Last_step < ?;"
+
+const qryDeleteTOTP = "DELETE FROM Totp_secrets WHERE FK_USER = ?;"
+
+const qryCreateRecoveryCodesTable = "CREATE TABLE IF NOT EXISTS Recovery_codes (" +
+	"FK_USER TEXT NOT NULL," +
+	"Code_hash TEXT NOT NULL," +
+	"PRIMARY KEY (FK_USER, Code_hash)" +
+	");"
+
+const qryAddRecoveryCode = "INSERT INTO Recovery_codes (FK_USER, Code_hash) VALUES (?,?);"
+
+const qryUseRecoveryCode = "DELETE FROM Recovery_codes WHERE FK_USER = ? AND Code_hash = ?;"
+
+const qryCountRecoveryCodes = "SELECT COUNT(*) FROM Recovery_codes WHERE FK_USER = ?;"
+
+const qryDeleteRecoveryCodes = "DELETE FROM Recovery_codes WHERE FK_USER = ?;"
+
+const qryCreateWebAuthnTable = "CREATE TABLE IF NOT EXISTS Webauthn_credentials (" +
+	"PK_CREDENTIAL TEXT NOT NULL PRIMARY KEY," +
+	"FK_USER TEXT NOT NULL," +
+	"Public_key BLOB NOT NULL," +
+	"Sign_count BIGINT DEFAULT 0," +
+	"Aaguid BLOB," +
+	"Created BIGINT NOT NULL," +
+	"Last_used BIGINT DEFAULT 0" +
+	");"
+
+const qryCreateWebAuthnIndex = "CREATE INDEX IF NOT EXISTS Webauthn_credentials_user ON Webauthn_credentials (FK_USER);"
+
+const qryNewWebAuthnCredential = "INSERT INTO Webauthn_credentials (PK_CREDENTIAL, FK_USER, Public_key, Sign_count, Aaguid, Created, Last_used) VALUES (?,?,?,?,?,?,?);"
+
+const qryGetWebAuthnCredential = "SELECT PK_CREDENTIAL, FK_USER, Public_key, Sign_count, Aaguid, Created, Last_used FROM Webauthn_credentials WHERE PK_CREDENTIAL = ?;"
+
+const qryListWebAuthnCredentials = "SELECT PK_CREDENTIAL, FK_USER, Public_key, Sign_count, Aaguid, Created, Last_used FROM Webauthn_credentials WHERE FK_USER = ? ORDER BY Created;"
+
+const qryUpdateSignCount = "UPDATE Webauthn_credentials SET Sign_count = ?, Last_used = ? WHERE PK_CREDENTIAL = ?;"
+
+const qryDeleteWebAuthnCredential = "DELETE FROM Webauthn_credentials WHERE PK_CREDENTIAL = ?;"
+
+const qryDeleteUserWebAuthnCredentials = "DELETE FROM Webauthn_credentials WHERE FK_USER = ?;"
+
+const qryCreateWebAuthnChallengesTable = "CREATE TABLE IF NOT EXISTS Webauthn_challenges (" +
+	"PK_CHALLENGE TEXT NOT NULL PRIMARY KEY," +
+	"FK_USER TEXT NOT NULL," + // "" for passkey logins without username
+	"Login INTEGER DEFAULT 0," +
+	"Exp BIGINT NOT NULL" +
+	");"
+
+const qryNewWebAuthnChallenge = "INSERT INTO Webauthn_challenges (PK_CHALLENGE, FK_USER, Login, Exp) VALUES (?,?,?,?);"
+
+const qryGetWebAuthnChallenge = "SELECT FK_USER, Login, Exp FROM Webauthn_challenges WHERE PK_CHALLENGE = ?;"
+
+const qryDeleteWebAuthnChallenge = "DELETE FROM Webauthn_challenges WHERE PK_CHALLENGE = ?;"
+
+const qryPurgeWebAuthnChallenges = "DELETE FROM Webauthn_challenges WHERE Exp < ?;"
+
+const qryCreateTwoFactorTable = "CREATE TABLE IF NOT EXISTS Two_factor_codes (" +
+	"FK_USER TEXT NOT NULL PRIMARY KEY," +
+	"Code_hash TEXT NOT NULL," +
+	"Created BIGINT NOT NULL," +
+	"Exp BIGINT NOT NULL," +
+	"Attempts INTEGER DEFAULT 0," +
+	"Totp INTEGER DEFAULT 0" +
+	");"
+
+const qrySaveTwoFactorCode = "INSERT INTO Two_factor_codes (FK_USER, Code_hash, Created, Exp, Attempts, Totp) VALUES (?,?,?,?,?,?);"
+
+const qryGetTwoFactorCode = "SELECT Code_hash, Created, Exp, Attempts, Totp FROM Two_factor_codes WHERE FK_USER = ?;"
+
+const qryAddTwoFactorAttempt = "UPDATE Two_factor_codes SET Attempts = Attempts + 1 WHERE FK_USER = ?;"
+
+const qryGetTwoFactorAttempts = "SELECT Attempts FROM Two_factor_codes WHERE FK_USER = ?;"
+
+const qryDeleteTwoFactorCode = "DELETE FROM Two_factor_codes WHERE FK_USER = ?;"
+
+const qryPurgeTwoFactorCodes = "DELETE FROM Two_factor_codes WHERE Exp < ?;"
+
+const qryCreateRefreshTokensTable = "CREATE TABLE IF NOT EXISTS Refresh_tokens (" +
+	"PK_TOKEN TEXT NOT NULL PRIMARY KEY," + // HMAC-SHA256 of the token
+	"Family TEXT NOT NULL," +
+	"FK_USER TEXT NOT NULL," +
+	"Exp BIGINT NOT NULL," +
+	"Used BOOLEAN DEFAULT 0" +
+	");"
+
+const qryCreateRefreshTokensIndex = "CREATE INDEX IF NOT EXISTS Refresh_tokens_family ON Refresh_tokens (Family);"
+
+const qryNewRefreshToken = "INSERT INTO Refresh_tokens (PK_TOKEN, Family, FK_USER, Exp, Used) VALUES (?,?,?,?,?);"
+
+const qryGetRefreshToken = "SELECT Family, FK_USER, Exp, Used FROM Refresh_tokens WHERE PK_TOKEN = ?;"
+
+const qryUseRefreshToken = "UPDATE Refresh_tokens SET Used = 1 WHERE PK_TOKEN = ? AND Used = 0;"
+
+const qryDeleteRefreshTokenFamily = "DELETE FROM Refresh_tokens WHERE Family = ?;"
+
+const qryDeleteUserRefreshTokens = "DELETE FROM Refresh_tokens WHERE FK_USER = ?;"
+
+const qryPurgeRefreshTokens = "DELETE FROM Refresh_tokens WHERE Exp < ?;"
@@ -5,7 +5,9 @@ go 1.16
 replace github.com/jjcapellan/auth => ../
 
 require (
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jjcapellan/auth v1.0.0-alpha.1
 	github.com/mattn/go-sqlite3 v1.14.11
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 )
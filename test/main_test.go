@@ -1,15 +1,39 @@
 package authtest
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	jjauth "github.com/jjcapellan/auth"
+	"github.com/jjcapellan/auth/boltstore"
+	"github.com/jjcapellan/auth/handlers"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var db *sql.DB
@@ -68,6 +92,78 @@ func TestMain(t *testing.T) {
 	// 5. Test user-ip ban system
 	testBanSystem(t)
 
+	// Test independent Authenticator instances
+	testInstances(t)
+
+	// Test memory and file user stores
+	testUserStores(t)
+
+	// Test session stores shared by several instances
+	testSessionStores(t)
+
+	// Test multiple sessions per user
+	testMultipleSessions(t)
+
+	// Test forged, stale and revoked session tokens
+	testSessionErrors(t)
+
+	// Test sliding sessions with absolute lifetime
+	testSlidingSessions(t)
+
+	// Test principal attached to request context
+	testPrincipal(t)
+
+	// Test session cookie attributes
+	testCookieOptions(t)
+
+	// Test roles and permissions
+	testRoles(t)
+
+	// Test password hashers and transparent rehash
+	testPasswordHashers(t)
+
+	// Test pepper keys rotation
+	testPepperRotation(t)
+
+	// Test password policy
+	testPasswordPolicy(t)
+
+	// Test usernames and emails normalization
+	testIdentity(t)
+
+	// Test email verification
+	testEmailVerification(t)
+
+	// Test password reset
+	testPasswordReset(t)
+
+	// Test TOTP second factor
+	testTOTP(t)
+
+	// Test recovery codes
+	testRecoveryCodes(t)
+
+	// Test WebAuthn with a software authenticator
+	testWebAuthn(t)
+
+	// Test email verification codes
+	testTwoFactorCodes(t)
+
+	// Test step-up authentication
+	testStepUp(t)
+
+	// Test login flow with second factor
+	testLogin(t)
+
+	// Test login, registration and account handlers
+	testHandlers(t)
+
+	// Test JSON API middleware with bearer tokens and CORS
+	testAPIMode(t)
+
+	// Test JWT access tokens and refresh token rotation
+	testJWT(t)
+
 }
 
 func testCheckLogin(user string, password string, expecdOk bool, expecAuthLevel int, t *testing.T) {
@@ -87,6 +183,10 @@ func testNewSession(user string, seconds int, authLevel int, t *testing.T) *http
 		t.Fatalf("NewSession error: %s", err.Error())
 	}
 	sessionCookie := w.Result().Cookies()[0]
+	token, err := base64.RawURLEncoding.DecodeString(sessionCookie.Value)
+	if err != nil || len(token) < 32 {
+		t.Fatalf("NewSession -> session token is not a 256 bits URL-safe token: %s", sessionCookie.Value)
+	}
 	return sessionCookie
 }
 
@@ -145,8 +245,1611 @@ func testBanSystem(t *testing.T) {
 
 }
 
+func testInstances(t *testing.T) {
+	adminDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database")
+	}
+	admin, err := jjauth.New(jjauth.Options{DB: adminDb, Secret: "adminsecret", MaxAttemps: 1})
+	if err != nil {
+		t.Fatalf("New error: %s", err.Error())
+	}
+	err = admin.NewUser("admin", "adminpass", "", 9)
+	if err != nil {
+		t.Fatalf("NewUser error: %s", err)
+	}
+
+	if ok, _ := admin.CheckLogin("user1", "pass1"); ok {
+		t.Fatalf("Instances -> user of default instance logged in admin instance")
+	}
+	if ok, _ := jjauth.CheckLogin("admin", "adminpass"); ok {
+		t.Fatalf("Instances -> user of admin instance logged in default instance")
+	}
+
+	admin.RegBadLogin("user1", "120.120.120.131:4565")
+	admin.RegBadLogin("user1", "120.120.120.131:4565")
+	if !admin.IsBlocked("user1", "120.120.120.131:4565") {
+		t.Fatalf("Instances -> user not banned in admin instance")
+	}
+	if jjauth.IsBlocked("user1", "120.120.120.131:4565") {
+		t.Fatalf("Instances -> admin instance ban applied to default instance")
+	}
+}
+
+func testUserStores(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "users.json")
+	fileStore, err := jjauth.NewFileUserStore(fileName)
+	if err != nil {
+		t.Fatalf("NewFileUserStore error: %s", err.Error())
+	}
+	stores := map[string]jjauth.UserStore{
+		"memory": jjauth.NewMemoryUserStore(),
+		"file":   fileStore,
+	}
+
+	for name, store := range stores {
+		a, err := jjauth.New(jjauth.Options{Users: store, Secret: "storesecret"})
+		if err != nil {
+			t.Fatalf("%s store -> New error: %s", name, err.Error())
+		}
+		err = a.NewUser("user3", "pass3", "email3@email.com", 2)
+		if err != nil {
+			t.Fatalf("%s store -> NewUser error: %s", name, err)
+		}
+		if err = a.NewUser("user3", "pass3", "", 2); err == nil {
+			t.Fatalf("%s store -> NewUser allowed a duplicated user", name)
+		}
+		if ok, level := a.CheckLogin("user3", "pass3"); !ok || level != 2 {
+			t.Fatalf("%s store -> CheckLogin expected: true 2  Got: %t %d", name, ok, level)
+		}
+		err = a.UpdateUserPass("user3", "newpass3")
+		if err != nil {
+			t.Fatalf("%s store -> UpdateUserPass error: %s", name, err)
+		}
+		if ok, _ := a.CheckLogin("user3", "newpass3"); !ok {
+			t.Fatalf("%s store -> CheckLogin failed after UpdateUserPass", name)
+		}
+	}
+
+	// File store must load the users saved by the previous instance
+	reopened, err := jjauth.NewFileUserStore(fileName)
+	if err != nil {
+		t.Fatalf("NewFileUserStore error: %s", err.Error())
+	}
+	if count, _ := reopened.CountUsers(); count != 1 {
+		t.Fatalf("File store -> users count expected: 1  Got: %d", count)
+	}
+}
+
+func testSessionStores(t *testing.T) {
+	sessionsDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database")
+	}
+	sqlStore, err := jjauth.NewSQLSessionStore(sessionsDb)
+	if err != nil {
+		t.Fatalf("NewSQLSessionStore error: %s", err.Error())
+	}
+	boltStore, err := boltstore.Open(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatalf("boltstore.Open error: %s", err.Error())
+	}
+	defer boltStore.Close()
+	stores := map[string]jjauth.SessionStore{
+		"memory": jjauth.NewMemorySessionStore(),
+		"sql":    sqlStore,
+		"bolt":   boltStore,
+	}
+
+	for name, store := range stores {
+		users := jjauth.NewMemoryUserStore()
+		instance1, _ := jjauth.New(jjauth.Options{Users: users, Sessions: store, Secret: "shared"})
+		instance2, _ := jjauth.New(jjauth.Options{Users: users, Sessions: store, Secret: "shared"})
+
+		w := httptest.NewRecorder()
+		err := instance1.NewSession("user4", 60, 3, w)
+		if err != nil {
+			t.Fatalf("%s store -> NewSession error: %s", name, err.Error())
+		}
+		cookie := w.Result().Cookies()[0]
+		r, _ := http.NewRequest("GET", "http://localhost:3000/members", nil)
+		r.AddCookie(cookie)
+
+		if err := instance2.CheckAuthCookie(r); err != nil {
+			t.Fatalf("%s store -> session of instance1 not valid in instance2: %s", name, err.Error())
+		}
+		if level := instance2.GetUserAuthLevel(cookie.Value); level != 3 {
+			t.Fatalf("%s store -> auth level expected: 3  Got: %d", name, level)
+		}
+		if sessions, _ := store.ListUserSessions("user4"); len(sessions) != 1 {
+			t.Fatalf("%s store -> user sessions expected: 1  Got: %d", name, len(sessions))
+		}
+
+		sessionId, _ := instance2.GetSessionId(r)
+		instance2.LogOut(httptest.NewRecorder(), r)
+		if _, err := store.GetSession(sessionId); err != jjauth.ErrSessionNotFound {
+			t.Fatalf("%s store -> session not deleted after LogOut", name)
+		}
+
+		store.CreateSession(jjauth.Session{ID: "old", User: "user4", Exp: time.Now().Unix() - 1})
+		if count, _ := store.PurgeExpired(time.Now().Unix()); count != 1 {
+			t.Fatalf("%s store -> purged sessions expected: 1  Got: %d", name, count)
+		}
+	}
+}
+
+func testMultipleSessions(t *testing.T) {
+	devices := []string{"desktop", "phone"}
+	cookies := []*http.Cookie{}
+	for _, device := range devices {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:3000/login", nil)
+		r.Header.Set("User-Agent", device)
+		r.RemoteAddr = "120.120.120.132:4565"
+		err := jjauth.NewSessionFromRequest("user2", 60, 1, w, r)
+		if err != nil {
+			t.Fatalf("NewSessionFromRequest error: %s", err.Error())
+		}
+		cookies = append(cookies, w.Result().Cookies()[0])
+	}
+
+	sessions, err := jjauth.ListSessions("user2")
+	if err != nil {
+		t.Fatalf("ListSessions error: %s", err.Error())
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("ListSessions -> sessions expected: 2  Got: %d", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.IP != "120.120.120.132" || (session.UserAgent != "desktop" && session.UserAgent != "phone") {
+			t.Fatalf("ListSessions -> unexpected device: %s %s", session.UserAgent, session.IP)
+		}
+		if session.ID == cookies[0].Value || session.ID == cookies[1].Value {
+			t.Fatalf("ListSessions -> session token exposed as session ID")
+		}
+	}
+
+	// Revoke desktop session from phone
+	r, _ := http.NewRequest("GET", "http://localhost:3000/members", nil)
+	r.AddCookie(cookies[0])
+	desktopId, _ := jjauth.GetSessionId(r)
+	if err := jjauth.RevokeSession("user1", desktopId); err == nil {
+		t.Fatalf("RevokeSession -> session revoked by other user")
+	}
+	if err := jjauth.RevokeSession("user2", desktopId); err != nil {
+		t.Fatalf("RevokeSession error: %s", err.Error())
+	}
+	checkRoute("http://localhost:3000/members", "members", "Not revoked session to /members ->", cookies[1], t)
+	checkRoute("http://localhost:3000/members", "notloged", "Revoked session to /members ->", cookies[0], t)
+	if sessions, _ := jjauth.ListSessions("user2"); len(sessions) != 1 {
+		t.Fatalf("RevokeSession -> sessions expected: 1  Got: %d", len(sessions))
+	}
+
+	jjauth.RevokeAllSessions("user2")
+	if sessions, _ := jjauth.ListSessions("user2"); len(sessions) != 0 {
+		t.Fatalf("RevokeAllSessions -> sessions expected: 0  Got: %d", len(sessions))
+	}
+}
+
+func testSessionErrors(t *testing.T) {
+	forged := &http.Cookie{Name: "JJCSESID", Value: "forgedtoken1234567890"}
+	checkRoute("http://localhost:3000/members", "notloged", "Forged token to /members ->", forged, t)
+	checkSessionError(forged, 0, jjauth.ErrNoSession, "Forged token", t)
+	checkSessionError(&http.Cookie{Name: "OTHER", Value: "x"}, 0, jjauth.ErrNoSession, "Missing cookie", t)
+
+	stale := testNewSession("user1", 1, 1, t)
+	time.Sleep(2 * time.Second)
+	checkRoute("http://localhost:3000/members", "notloged", "Stale token to /members ->", stale, t)
+	checkSessionError(stale, 0, jjauth.ErrSessionExpired, "Stale token", t)
+
+	revoked := testNewSession("user1", 60, 1, t)
+	checkSessionError(revoked, 1, nil, "Valid token", t)
+	checkSessionError(revoked, 4, jjauth.ErrInsufficientLevel, "Valid token with low level", t)
+	jjauth.RevokeAllSessions("user1")
+	checkRoute("http://localhost:3000/members", "notloged", "Revoked token to /members ->", revoked, t)
+	checkSessionError(revoked, 0, jjauth.ErrSessionRevoked, "Revoked token", t)
+}
+
+func testSlidingSessions(t *testing.T) {
+	a, _ := jjauth.New(jjauth.Options{
+		Users:                jjauth.NewMemoryUserStore(),
+		Secret:               "sliding",
+		SlidingSessions:      true,
+		MaxSessionLifetime:   6,
+		SessionTouchInterval: 1,
+	})
+	handler := a.GetAuthMiddleware(0, "", "")(http.HandlerFunc(membersHandler))
+	get := func(cookie *http.Cookie) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:3000/members", nil)
+		r.AddCookie(cookie)
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	w := httptest.NewRecorder()
+	a.NewSession("user5", 3, 1, w) // 3 seconds idle timeout
+	cookie := w.Result().Cookies()[0]
+
+	time.Sleep(2 * time.Second)
+	if code := get(cookie); code != http.StatusOK {
+		t.Fatalf("Sliding session -> active session rejected: %d", code)
+	}
+	time.Sleep(2 * time.Second) // 4 seconds since creation
+	if code := get(cookie); code != http.StatusOK {
+		t.Fatalf("Sliding session -> session not extended by activity: %d", code)
+	}
+	time.Sleep(2200 * time.Millisecond) // 6.2 seconds since creation
+	if code := get(cookie); code != http.StatusForbidden {
+		t.Fatalf("Sliding session -> session valid after max lifetime: %d", code)
+	}
+}
+
+func testPrincipal(t *testing.T) {
+	a, _ := jjauth.New(jjauth.Options{Users: jjauth.NewMemoryUserStore(), Secret: "principal"})
+	var principal jjauth.Principal
+	var ok bool
+	handler := a.GetAuthMiddleware(2, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok = jjauth.FromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	a.NewSession("user6", 60, 3, w)
+	cookie := w.Result().Cookies()[0]
+	r, _ := http.NewRequest("GET", "http://localhost:3000/members", nil)
+	r.AddCookie(cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !ok {
+		t.Fatalf("Principal -> not found in request context")
+	}
+	sessionId, _ := a.GetSessionId(r)
+	if principal.User != "user6" || principal.AuthLevel != 3 || principal.SessionID != sessionId {
+		t.Fatalf("Principal -> unexpected principal: %+v", principal)
+	}
+	if principal.Exp-principal.Issued != 60 || principal.TwoFactor {
+		t.Fatalf("Principal -> unexpected session times or 2FA status: %+v", principal)
+	}
+	if _, ok := jjauth.FromContext(context.Background()); ok {
+		t.Fatalf("Principal -> found in empty context")
+	}
+}
+
+func testCookieOptions(t *testing.T) {
+	_, err := jjauth.New(jjauth.Options{
+		Users:  jjauth.NewMemoryUserStore(),
+		Cookie: jjauth.CookieOptions{Prefix: jjauth.CookiePrefixHost, Domain: "example.com"},
+	})
+	if err == nil {
+		t.Fatalf("Cookie options -> __Host- cookie with Domain allowed")
+	}
+
+	a, err := jjauth.New(jjauth.Options{
+		Users:  jjauth.NewMemoryUserStore(),
+		Secret: "cookies",
+		Cookie: jjauth.CookieOptions{
+			Name:       "SID",
+			Prefix:     jjauth.CookiePrefixHost,
+			SameSite:   http.SameSiteStrictMode,
+			Persistent: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Cookie options -> New error: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	a.NewSession("user7", 60, 1, w)
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != "__Host-SID" || !cookie.Secure || !cookie.HttpOnly || cookie.Path != "/" {
+		t.Fatalf("Cookie options -> unexpected session cookie: %s", cookie.String())
+	}
+	if cookie.SameSite != http.SameSiteStrictMode || cookie.MaxAge != 60 {
+		t.Fatalf("Cookie options -> unexpected SameSite or Max-Age: %s", cookie.String())
+	}
+
+	r, _ := http.NewRequest("GET", "https://localhost:3000/members", nil)
+	r.AddCookie(cookie)
+	if err := a.CheckAuthCookie(r); err != nil {
+		t.Fatalf("Cookie options -> prefixed cookie not accepted: %s", err.Error())
+	}
+
+	w = httptest.NewRecorder()
+	a.LogOut(w, r)
+	deleted := w.Result().Cookies()[0]
+	if deleted.Name != "__Host-SID" || !deleted.HttpOnly || !deleted.Secure || deleted.MaxAge >= 0 {
+		t.Fatalf("Cookie options -> unexpected logout cookie: %s", deleted.String())
+	}
+}
+
+func testRoles(t *testing.T) {
+	jjauth.GrantPermission("editor", "invoices.edit")
+	jjauth.GrantPermission("admin", "users.delete")
+	jjauth.GrantRole("user1", "editor")
+	jjauth.GrantRole("user1", "editor") // Grants are idempotent
+	jjauth.MapLevelRoles(1, "member")
+
+	if roles, _ := jjauth.GetUserRoles("user1"); len(roles) != 1 || roles[0] != "editor" {
+		t.Fatalf("GetUserRoles -> expected: [editor]  Got: %v", roles)
+	}
+
+	cookie := testNewSession("user1", 60, 1, t)
+	checkRule := func(middleware func(http.Handler) http.Handler, expectedCode int, testName string) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:3000/invoices", nil)
+		r.AddCookie(cookie)
+		middleware(http.HandlerFunc(membersHandler)).ServeHTTP(w, r)
+		if w.Code != expectedCode {
+			t.Fatalf("%s -> expected status: %d  Got: %d", testName, expectedCode, w.Code)
+		}
+	}
+
+	checkRule(jjauth.RequireRole("editor", "", ""), http.StatusOK, "RequireRole granted role")
+	checkRule(jjauth.RequireRole("member", "", ""), http.StatusOK, "RequireRole role mapped from level")
+	checkRule(jjauth.RequireRole("admin", "", ""), http.StatusForbidden, "RequireRole missing role")
+	checkRule(jjauth.RequirePermission("invoices.edit", "", ""), http.StatusOK, "RequirePermission granted")
+	checkRule(jjauth.RequirePermission("users.delete", "", ""), http.StatusForbidden, "RequirePermission missing")
+	checkRule(jjauth.RequireAny([]jjauth.Rule{jjauth.Role("admin"), jjauth.Level(1)}, "", ""), http.StatusOK, "RequireAny")
+	checkRule(jjauth.RequireAll([]jjauth.Rule{jjauth.Role("member"), jjauth.Permission("users.delete")}, "", ""),
+		http.StatusForbidden, "RequireAll")
+
+	jjauth.RevokeRole("user1", "editor")
+	checkRule(jjauth.RequirePermission("invoices.edit", "", ""), http.StatusForbidden, "RequirePermission revoked role")
+}
+
+func testPasswordHashers(t *testing.T) {
+	users := jjauth.NewMemoryUserStore()
+	a, _ := jjauth.New(jjauth.Options{Users: users, Secret: "hashers"})
+
+	// User saved by older versions: bcrypt(password + salt + secret)
+	legacyHash, _ := bcrypt.GenerateFromPassword([]byte("legacypass"+"salt1234"+"hashers"), 10)
+	users.CreateUser(jjauth.User{Name: "legacy", Password: string(legacyHash), Salt: "salt1234", AuthLevel: 1})
+	if ok, _ := a.CheckLogin("legacy", "legacypass"); !ok {
+		t.Fatalf("Password hashers -> legacy hash not verified")
+	}
+	legacy, _ := users.GetUser("legacy")
+	if !strings.HasPrefix(legacy.Password, "$argon2id$v=19$") || legacy.Salt != "" {
+		t.Fatalf("Password hashers -> legacy hash not rehashed: %s", legacy.Password)
+	}
+
+	a.SetPasswordHasher(jjauth.ScryptHasher{LogN: 14, R: 8, P: 1, KeyLen: 32, SaltLen: 16})
+	if ok, _ := a.CheckLogin("legacy", "legacypass"); !ok {
+		t.Fatalf("Password hashers -> argon2id hash not verified")
+	}
+	legacy, _ = users.GetUser("legacy")
+	if !strings.HasPrefix(legacy.Password, "$scrypt$ln=14,r=8,p=1$") {
+		t.Fatalf("Password hashers -> argon2id hash not rehashed to scrypt: %s", legacy.Password)
+	}
+
+	// Passwords longer than 72 bytes must not be truncated by bcrypt
+	a.SetPasswordHasher(jjauth.BcryptHasher{Cost: 10})
+	long := strings.Repeat("a", 80)
+	a.NewUser("longpass", long+"1", "", 1)
+	if ok, _ := a.CheckLogin("longpass", long+"2"); ok {
+		t.Fatalf("Password hashers -> long password truncated")
+	}
+	if ok, _ := a.CheckLogin("longpass", long+"1"); !ok {
+		t.Fatalf("Password hashers -> long password not verified")
+	}
+}
+
+func testPepperRotation(t *testing.T) {
+	users := jjauth.NewMemoryUserStore()
+	a, _ := jjauth.New(jjauth.Options{Users: users, Secret: "oldsecret"})
+	a.NewUser("pepper1", "pass1", "", 1)
+	a.NewUser("pepper2", "pass2", "", 1)
+
+	a.AddPepperKey(jjauth.PepperKey{ID: "k2", Secret: "newsecret"})
+	report, _ := a.GetPepperReport()
+	if report.Total != 2 || report.Old != 2 || report.CurrentKey != "k2" {
+		t.Fatalf("Pepper report -> unexpected report before login: %+v", report)
+	}
+
+	if ok, _ := a.CheckLogin("pepper1", "pass1"); !ok {
+		t.Fatalf("Pepper rotation -> old key hash not verified")
+	}
+	report, _ = a.GetPepperReport()
+	if report.Current != 1 || report.Old != 1 || report.ByKey["k2"] != 1 {
+		t.Fatalf("Pepper report -> hash not upgraded to current key: %+v", report)
+	}
+
+	// Secret passed to New changed: hashes without key ID need the old secret as key ""
+	b, _ := jjauth.New(jjauth.Options{
+		Users:   users,
+		Secret:  "changedsecret",
+		Peppers: []jjauth.PepperKey{{ID: "", Secret: "oldsecret"}, {ID: "k2", Secret: "newsecret"}},
+	})
+	if ok, _ := b.CheckLogin("pepper1", "pass1"); !ok {
+		t.Fatalf("Pepper rotation -> current key hash not verified after secret change")
+	}
+	if ok, _ := b.CheckLogin("pepper2", "pass2"); !ok {
+		t.Fatalf("Pepper rotation -> old key hash not verified after secret change")
+	}
+	if ok, _ := b.CheckLogin("pepper2", "wrong"); ok {
+		t.Fatalf("Pepper rotation -> wrong password accepted")
+	}
+
+	reports := make(chan jjauth.PepperReport, 1)
+	stop := b.StartPepperReports(10*time.Millisecond, func(r jjauth.PepperReport) {
+		select {
+		case reports <- r:
+		default:
+		}
+	})
+	report = <-reports
+	stop()
+	if report.Current != 2 || report.Old != 0 {
+		t.Fatalf("Pepper reports job -> unexpected report: %+v", report)
+	}
+}
+
+func testPasswordPolicy(t *testing.T) {
+	// Breached passwords database with "password123" (SHA-1 CBFDAC6008F9CAB4083784CBD1874F76618D2A97)
+	breachedDir := t.TempDir()
+	os.WriteFile(filepath.Join(breachedDir, "CBFDA"), []byte("C6008F9CAB4083784CBD1874F76618D2A97:123\r\n"), 0600)
+
+	a, _ := jjauth.New(jjauth.Options{
+		Users:  jjauth.NewMemoryUserStore(),
+		Secret: "policy",
+		PasswordPolicy: &jjauth.PasswordPolicy{
+			MinLength:      10,
+			MaxLength:      64,
+			RequireUpper:   true,
+			RequireDigit:   true,
+			MinStrength:    2,
+			RejectUserInfo: true,
+			HistorySize:    3,
+			Breached:       jjauth.BreachedPasswordsDir(breachedDir),
+		},
+	})
+
+	err := a.NewUser("policyuser", "", "", 1)
+	var policyErr *jjauth.PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Password policy -> empty password accepted: %v", err)
+	}
+	for _, rule := range []string{jjauth.RuleMinLength, jjauth.RuleUpper, jjauth.RuleDigit, jjauth.RuleStrength} {
+		if !policyErr.Has(rule) {
+			t.Fatalf("Password policy -> rule %s not reported: %s", rule, policyErr.Error())
+		}
+	}
+
+	err = a.CheckPassword("policyuser", "", "Mypolicyuser2022")
+	if !errors.As(err, &policyErr) || !policyErr.Has(jjauth.RuleUserInfo) {
+		t.Fatalf("Password policy -> password with username accepted: %v", err)
+	}
+	err = a.CheckPassword("policyuser", "", "password123")
+	if !errors.As(err, &policyErr) || !policyErr.Has(jjauth.RuleBreached) {
+		t.Fatalf("Password policy -> breached password accepted: %v", err)
+	}
+
+	passwords := []string{"Correct7Horse", "Battery8Staple", "Tr0ub4dor&3xyz", "Purple9Monkey"}
+	if err := a.NewUser("policyuser", passwords[0], "", 1); err != nil {
+		t.Fatalf("Password policy -> valid password rejected: %s", err.Error())
+	}
+	for _, password := range passwords[1:] {
+		if err := a.UpdateUserPass("policyuser", password); err != nil {
+			t.Fatalf("Password policy -> valid password rejected: %s", err.Error())
+		}
+	}
+	err = a.UpdateUserPass("policyuser", passwords[2])
+	if !errors.As(err, &policyErr) || !policyErr.Has(jjauth.RuleHistory) {
+		t.Fatalf("Password policy -> reused password accepted: %v", err)
+	}
+	if err := a.UpdateUserPass("policyuser", passwords[0]); err != nil {
+		t.Fatalf("Password policy -> password older than history rejected: %s", err.Error())
+	}
+
+	if jjauth.PasswordStrength("aaaaaaaaaaaa") != 0 || jjauth.PasswordStrength("abcdefgh123") > 1 {
+		t.Fatalf("Password strength -> repeated or sequential characters scored too high")
+	}
+}
+
+func testIdentity(t *testing.T) {
+	store := jjauth.NewMemoryUserStore()
+	a, _ := jjauth.New(jjauth.Options{
+		Users:  store,
+		Secret: "identity",
+		UsernameRules: &jjauth.UsernameRules{
+			MinLength:         3,
+			MaxLength:         20,
+			Pattern:           regexp.MustCompile(`^\pL[\pL\pN._-]*$`),
+			Normalization:     jjauth.NormalizePRECIS,
+			CaseFold:          true,
+			RejectConfusables: true,
+		},
+	})
+
+	for _, user := range []string{"ab", "1alice", "al ice", "thisusernameistoolong"} {
+		if err := a.NewUser(user, "1234", "", 1); !errors.Is(err, jjauth.ErrInvalidUsername) {
+			t.Fatalf("Username rules -> invalid username %q accepted: %v", user, err)
+		}
+	}
+	for _, email := range []string{"alice", "alice@localhost", "Alice <alice@example.com>"} {
+		if err := a.NewUser("alice", "1234", email, 1); !errors.Is(err, jjauth.ErrInvalidEmail) {
+			t.Fatalf("Email rules -> invalid email %q accepted: %v", email, err)
+		}
+	}
+
+	// Fullwidth "Ａｌｉｃｅ" is normalized to "alice"
+	if err := a.NewUser(" \uff21\uff4c\uff49\uff43\uff45 ", "1234", "Alice@Example.COM", 1); err != nil {
+		t.Fatalf("Username rules -> valid username rejected: %s", err.Error())
+	}
+	if err := a.NewUser("ALICE", "1234", "", 1); err == nil {
+		t.Fatalf("Username rules -> duplicated username with other case accepted")
+	}
+	// Cyrillic "а" and latin "lice"
+	if err := a.NewUser("\u0430lice", "1234", "", 1); !errors.Is(err, jjauth.ErrInvalidUsername) {
+		t.Fatalf("Username rules -> mixed scripts username accepted: %v", err)
+	}
+	// Cyrillic "о" looks like latin "o" of existing "bob"
+	a.NewUser("bob", "1234", "", 1)
+	if err := a.NewUser("b\u043eb", "1234", "", 1); !errors.Is(err, jjauth.ErrInvalidUsername) {
+		t.Fatalf("Username rules -> confusable username accepted: %v", err)
+	}
+
+	if ok, _ := a.CheckLogin("Alice", "1234"); !ok {
+		t.Fatalf("Username rules -> login with other case failed")
+	}
+	user, err := store.GetUser("alice")
+	if err != nil || user.Email != "Alice@example.com" {
+		t.Fatalf("Email rules -> email not normalized: %q %v", user.Email, err)
+	}
+}
+
+func testEmailVerification(t *testing.T) {
+	// Table "Users" of older versions
+	oldDB, _ := sql.Open("sqlite3", filepath.Join(t.TempDir(), "old.db"))
+	defer oldDB.Close()
+	oldDB.Exec("CREATE TABLE Users (PK_USER TEXT NOT NULL PRIMARY KEY UNIQUE, Password TEXT NOT NULL, Email TEXT, Salt TEXT NOT NULL, Auth_level INTEGER DEFAULT 0);")
+	oldDB.Exec("INSERT INTO Users VALUES ('olduser', 'hash', 'old@email.com', '', 1);")
+	store, err := jjauth.NewSQLUserStore(oldDB)
+	if err != nil {
+		t.Fatalf("Email verification -> old Users table not updated: %s", err.Error())
+	}
+	if user, err := store.GetUser("olduser"); err != nil || user.Email != "old@email.com" || user.EmailVerified {
+		t.Fatalf("Email verification -> old user not read: %+v %v", user, err)
+	}
+
+	a, _ := jjauth.New(jjauth.Options{
+		Users:      store,
+		Secret:     "verification",
+		EmailRules: jjauth.EmailRules{RequireVerified: true},
+	})
+	a.NewUser("carol", "1234", "carol@email.com", 1)
+	if ok, _ := a.CheckLogin("carol", "1234"); ok {
+		t.Fatalf("Email verification -> login with unverified email accepted")
+	}
+	login := jjauth.LoginRequest{User: "carol", Password: "1234", Duration: 60}
+	r := httptest.NewRequest("POST", "http://localhost:3000/login", nil)
+	for i := 0; i < 6; i++ {
+		if _, err := a.Login(httptest.NewRecorder(), r, login); !errors.Is(err, jjauth.ErrEmailNotVerified) {
+			t.Fatalf("Email verification -> wrong error of unverified email: %v", err)
+		}
+	}
+
+	token, err := a.NewEmailVerificationToken("carol")
+	if err != nil {
+		t.Fatalf("Email verification -> token not created: %s", err.Error())
+	}
+	if _, err := a.ConfirmEmail(token[:len(token)-2] + "xx"); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("Email verification -> tampered token accepted: %v", err)
+	}
+	if user, err := a.ConfirmEmail(token); err != nil || user != "carol" {
+		t.Fatalf("Email verification -> valid token rejected: %v", err)
+	}
+	if _, err := a.ConfirmEmail(token); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("Email verification -> token used twice")
+	}
+	if ok, _ := a.CheckLogin("carol", "1234"); !ok {
+		t.Fatalf("Email verification -> login with verified email rejected")
+	}
+	if _, err := a.Login(httptest.NewRecorder(), r, login); err != nil {
+		t.Fatalf("Email verification -> logins of unverified email counted as failed: %v", err)
+	}
+
+	// Email change keeps the old email until confirmation
+	if err := a.UpdateUserEmail("carol", "carol@new.com"); err != nil {
+		t.Fatalf("Email verification -> email not updated: %s", err.Error())
+	}
+	user, _ := store.GetUser("carol")
+	if user.Email != "carol@email.com" || user.PendingEmail != "carol@new.com" || !user.EmailVerified {
+		t.Fatalf("Email verification -> pending email not saved: %+v", user)
+	}
+	token, _ = a.NewEmailVerificationToken("carol")
+	if _, err := a.ConfirmEmail(token); err != nil {
+		t.Fatalf("Email verification -> new email not confirmed: %s", err.Error())
+	}
+	user, _ = store.GetUser("carol")
+	if user.Email != "carol@new.com" || user.PendingEmail != "" || !user.EmailVerified {
+		t.Fatalf("Email verification -> new email not saved: %+v", user)
+	}
+	if _, err := a.NewEmailVerificationToken("carol"); !errors.Is(err, jjauth.ErrEmailVerified) {
+		t.Fatalf("Email verification -> token created for verified email: %v", err)
+	}
+}
+
+func testPasswordReset(t *testing.T) {
+	mailer := make(chanMailer, 1)
+	a, _ := jjauth.New(jjauth.Options{
+		Users:  jjauth.NewMemoryUserStore(),
+		Secret: "reset",
+		Mailer: mailer,
+	})
+	a.NewUser("dave", "1234", "dave@email.com", 1)
+	a.NewSession("dave", 3600, 1, httptest.NewRecorder())
+	if sessions, _ := a.ListSessions("dave"); len(sessions) != 1 {
+		t.Fatalf("Password reset -> session not created")
+	}
+
+	if err := a.RequestPasswordReset("dave"); err == nil {
+		t.Fatalf("Password reset -> reset sent without PasswordResetOptions.URL")
+	}
+	a.SetPasswordResetOptions(jjauth.PasswordResetOptions{URL: "https://example.com/reset"})
+	if err := a.RequestPasswordReset("nobody@email.com"); err != nil {
+		t.Fatalf("Password reset -> unknown user revealed: %s", err.Error())
+	}
+	if err := a.RequestPasswordReset("dave@email.com"); err != nil {
+		t.Fatalf("Password reset -> RequestPasswordReset error: %s", err.Error())
+	}
+	select {
+	case body := <-mailer:
+		if !strings.Contains(body, "https://example.com/reset?token=") {
+			t.Fatalf("Password reset -> link not sent: %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Password reset -> email not sent")
+	}
+	a.RequestPasswordReset("dave")
+	select {
+	case <-mailer:
+		t.Fatalf("Password reset -> resend not throttled")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	token, err := a.NewPasswordResetToken("dave")
+	if err != nil {
+		t.Fatalf("Password reset -> token not created: %s", err.Error())
+	}
+	var policyErr *jjauth.PolicyError
+	if _, err := a.ResetPassword(token, ""); !errors.As(err, &policyErr) {
+		t.Fatalf("Password reset -> empty password accepted: %v", err)
+	}
+	if _, err := a.ResetPassword("badtoken", "5678"); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("Password reset -> invalid token accepted: %v", err)
+	}
+	if user, err := a.ResetPassword(token, "5678"); err != nil || user != "dave" {
+		t.Fatalf("Password reset -> valid token rejected: %v", err)
+	}
+	if _, err := a.ResetPassword(token, "9012"); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("Password reset -> token used twice")
+	}
+	if ok, _ := a.CheckLogin("dave", "5678"); !ok {
+		t.Fatalf("Password reset -> new password rejected")
+	}
+	if sessions, _ := a.ListSessions("dave"); len(sessions) != 0 {
+		t.Fatalf("Password reset -> sessions not revoked: %+v", sessions)
+	}
+}
+
+func testTOTP(t *testing.T) {
+	a, _ := jjauth.New(jjauth.Options{
+		Users:       jjauth.NewMemoryUserStore(),
+		Secret:      "totp",
+		TOTPOptions: &jjauth.TOTPOptions{Issuer: "Example", Skew: 1},
+	})
+	a.NewUser("erin", "1234", "erin@email.com", 1)
+
+	enrollment, err := a.EnrollTOTP("erin")
+	if err != nil {
+		t.Fatalf("TOTP -> enrollment error: %s", err.Error())
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Example:erin?") || !bytes.HasPrefix(enrollment.QRCode, []byte("\x89PNG")) {
+		t.Fatalf("TOTP -> wrong enrollment: %s", enrollment.URI)
+	}
+	if a.HasTOTP("erin") {
+		t.Fatalf("TOTP -> enabled before confirmation")
+	}
+
+	step := time.Now().Unix() / 30
+	if err := a.ConfirmTOTP("erin", "000000x"); !errors.Is(err, jjauth.ErrInvalidTOTPCode) {
+		t.Fatalf("TOTP -> invalid code accepted: %v", err)
+	}
+	if err := a.ConfirmTOTP("erin", totpCode(enrollment.Secret, step)); err != nil {
+		t.Fatalf("TOTP -> valid code rejected: %s", err.Error())
+	}
+	if !a.HasTOTP("erin") {
+		t.Fatalf("TOTP -> not enabled after confirmation")
+	}
+	if _, err := a.EnrollTOTP("erin"); !errors.Is(err, jjauth.ErrTOTPEnrolled) {
+		t.Fatalf("TOTP -> enrollment replaced without DisableTOTP")
+	}
+	if a.CheckTOTP("erin", totpCode(enrollment.Secret, step)) {
+		t.Fatalf("TOTP -> replayed code accepted")
+	}
+
+	// Second factor with TOTP instead of email codes
+	if err := a.New2FA("erin", "1234", 60); err != nil {
+		t.Fatalf("TOTP -> New2FA error: %s", err.Error())
+	}
+	if err := a.Verify2FA("erin", totpCode(enrollment.Secret, step+1)); err != nil {
+		t.Fatalf("TOTP -> Check2FA rejected code of next time step")
+	}
+	if a.CheckTOTP("erin", totpCode(enrollment.Secret, step-1)) {
+		t.Fatalf("TOTP -> code older than last used code accepted")
+	}
+
+	// Wrong codes of CheckTOTP and Check2FA share the attempts limit
+	for i := 0; i < jjauth.DefaultTwoFactorOptions.MaxAttempts; i++ {
+		a.CheckTOTP("erin", "abcdef")
+	}
+	a.New2FA("erin", "1234", 60)
+	if err := a.Verify2FA("erin", "abcdef"); !errors.Is(err, jjauth.ErrCodeExhausted) {
+		t.Fatalf("TOTP -> attempts of CheckTOTP not limited: %v", err)
+	}
+
+	// An email code pending from before the enrollment is not a TOTP code
+	mailer := &testMailer{}
+	b, _ := jjauth.New(jjauth.Options{Users: jjauth.NewMemoryUserStore(), Secret: "totp", Mailer: mailer})
+	b.NewUser("erin", "1234", "erin@email.com", 1)
+	b.New2FA("erin", "1234", 60)
+	enrollment, _ = b.EnrollTOTP("erin")
+	b.ConfirmTOTP("erin", totpCode(enrollment.Secret, step))
+	if b.CheckTOTP("erin", mailer.body) {
+		t.Fatalf("TOTP -> email code accepted as TOTP code")
+	}
+	if !b.CheckTOTP("erin", totpCode(enrollment.Secret, step+1)) {
+		t.Fatalf("TOTP -> code rejected while an email code was pending")
+	}
+
+	a.DisableTOTP("erin")
+	if a.HasTOTP("erin") {
+		t.Fatalf("TOTP -> not disabled")
+	}
+
+	// Secrets encrypted with an old secret after its rotation with the pepper keyring
+	users, store := jjauth.NewMemoryUserStore(), jjauth.NewMemoryTOTPStore()
+	old, _ := jjauth.New(jjauth.Options{Users: users, TOTP: store, Secret: "old"})
+	old.NewUser("erin", "1234", "", 1)
+	enrollment, _ = old.EnrollTOTP("erin")
+	step = time.Now().Unix() / 30
+	old.ConfirmTOTP("erin", totpCode(enrollment.Secret, step))
+	rotated, _ := jjauth.New(jjauth.Options{Users: users, TOTP: store, Secret: "new",
+		Peppers: []jjauth.PepperKey{{ID: "", Secret: "old"}, {ID: "k2", Secret: "pepper2"}}})
+	if !rotated.CheckTOTP("erin", totpCode(enrollment.Secret, step+1)) {
+		t.Fatalf("TOTP -> secret of old key not decrypted after rotation")
+	}
+	if secret, _ := store.GetTOTP("erin"); !strings.HasPrefix(secret.Secret, "$pepper$kid=k2$") {
+		t.Fatalf("TOTP -> secret not upgraded to current pepper key: %s", secret.Secret)
+	}
+}
+
+func testRecoveryCodes(t *testing.T) {
+	db, _ := sql.Open("sqlite3", filepath.Join(t.TempDir(), "recovery.db"))
+	defer db.Close()
+	a, err := jjauth.New(jjauth.Options{DB: db, Secret: "recovery"})
+	if err != nil {
+		t.Fatalf("Recovery codes -> New error: %s", err.Error())
+	}
+	a.NewUser("frank", "1234", "frank@email.com", 1)
+
+	codes, err := a.GenerateRecoveryCodes("frank", 0)
+	if err != nil || len(codes) != 10 {
+		t.Fatalf("Recovery codes -> codes not generated: %v %v", codes, err)
+	}
+	if !a.UseRecoveryCode("frank", strings.ToUpper(codes[0])) {
+		t.Fatalf("Recovery codes -> valid code rejected")
+	}
+	if a.UseRecoveryCode("frank", codes[0]) {
+		t.Fatalf("Recovery codes -> code used twice")
+	}
+	if left, _ := a.RecoveryCodesLeft("frank"); left != 9 {
+		t.Fatalf("Recovery codes -> expected 9 codes left, got %d", left)
+	}
+
+	// Only the session created with the checked methods is verified with a second factor
+	w := httptest.NewRecorder()
+	a.NewSession("frank", 3600, 1, w)
+	a.NewSessionFromRequest("frank", 3600, 1, w, nil, jjauth.MethodPassword, jjauth.MethodRecoveryCode)
+	sessions, _ := a.ListSessions("frank")
+	if len(sessions) != 2 || sessions[0].TwoFactor == sessions[1].TwoFactor {
+		t.Fatalf("Recovery codes -> wrong second factor of sessions: %+v", sessions)
+	}
+
+	newCodes, _ := a.GenerateRecoveryCodes("frank", 5)
+	if a.UseRecoveryCode("frank", codes[1]) {
+		t.Fatalf("Recovery codes -> code of old batch accepted")
+	}
+	if !a.UseRecoveryCode("frank", newCodes[4]) {
+		t.Fatalf("Recovery codes -> code of new batch rejected")
+	}
+
+	// Codes hashed with an old secret after its rotation with the pepper keyring
+	rotated, _ := jjauth.New(jjauth.Options{DB: db, Secret: "new",
+		Peppers: []jjauth.PepperKey{{ID: "", Secret: "recovery"}, {ID: "k2", Secret: "pepper2"}}})
+	if !rotated.UseRecoveryCode("frank", newCodes[0]) {
+		t.Fatalf("Recovery codes -> code of old key rejected after rotation")
+	}
+	newCodes, _ = rotated.GenerateRecoveryCodes("frank", 1)
+	if !rotated.UseRecoveryCode("frank", newCodes[0]) {
+		t.Fatalf("Recovery codes -> code of current pepper key rejected")
+	}
+}
+
+func testWebAuthn(t *testing.T) {
+	db, _ := sql.Open("sqlite3", filepath.Join(t.TempDir(), "webauthn.db"))
+	defer db.Close()
+	opts := jjauth.Options{
+		DB:              db,
+		Secret:          "webauthn",
+		WebAuthnOptions: jjauth.WebAuthnOptions{RPID: "example.com", RPName: "Example"},
+	}
+	a, _ := jjauth.New(opts)
+	a.NewUser("grace", "1234", "grace@email.com", 1)
+	authenticator := newSoftAuthenticator("example.com", "https://example.com")
+
+	if _, err := a.BeginWebAuthnLogin("grace"); err == nil {
+		t.Fatalf("WebAuthn -> login started without credentials")
+	}
+
+	creation, err := a.BeginWebAuthnRegistration("grace")
+	if err != nil {
+		t.Fatalf("WebAuthn -> registration not started: %s", err.Error())
+	}
+	registration := authenticator.register(creation.Challenge, "packed")
+	if _, err := a.FinishWebAuthnRegistration("grace", registration); err != nil {
+		t.Fatalf("WebAuthn -> registration rejected: %s", err.Error())
+	}
+	if _, err := a.FinishWebAuthnRegistration("grace", registration); !errors.Is(err, jjauth.ErrWebAuthn) {
+		t.Fatalf("WebAuthn -> registration replayed: %v", err)
+	}
+	creation, _ = a.BeginWebAuthnRegistration("grace")
+	if len(creation.ExcludeCredentials) != 1 {
+		t.Fatalf("WebAuthn -> registered credential not excluded")
+	}
+	evil := newSoftAuthenticator("example.com", "https://evil.com")
+	if _, err := a.FinishWebAuthnRegistration("grace", evil.register(creation.Challenge, "none")); !errors.Is(err, jjauth.ErrWebAuthn) {
+		t.Fatalf("WebAuthn -> registration from other origin accepted: %v", err)
+	}
+
+	// Second factor after password
+	request, _ := a.BeginWebAuthnLogin("grace")
+	assertion := authenticator.login(request.Challenge, "")
+	if user, err := a.FinishWebAuthnLogin(assertion); err != nil || user != "grace" {
+		t.Fatalf("WebAuthn -> login rejected: %v", err)
+	}
+	if _, err := a.FinishWebAuthnLogin(assertion); !errors.Is(err, jjauth.ErrWebAuthn) {
+		t.Fatalf("WebAuthn -> login replayed: %v", err)
+	}
+
+	// Passwordless login with a passkey requires user verification
+	request, _ = a.BeginWebAuthnLogin("")
+	if request.UserVerification != "required" {
+		t.Fatalf("WebAuthn -> passkey login without user verification requested")
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "https://example.com/passkey", nil)
+	authenticator.noPIN = true
+	if _, err := a.PasskeyLogin(authenticator.login(request.Challenge, creation.User.ID), 3600, w, r); !errors.Is(err, jjauth.ErrWebAuthn) {
+		t.Fatalf("WebAuthn -> passkey login without user verification accepted: %v", err)
+	}
+	request, _ = a.BeginWebAuthnLogin("")
+	if _, err := a.FinishWebAuthnLogin(authenticator.login(request.Challenge, creation.User.ID)); !errors.Is(err, jjauth.ErrWebAuthn) {
+		t.Fatalf("WebAuthn -> usernameless login without user verification accepted: %v", err)
+	}
+	authenticator.noPIN = false
+
+	// The challenge is saved in the store, so other instance can finish the login
+	request, _ = a.BeginWebAuthnLogin("")
+	b, _ := jjauth.New(opts)
+	user, err := b.PasskeyLogin(authenticator.login(request.Challenge, creation.User.ID), 3600, w, r)
+	if err != nil || user != "grace" {
+		t.Fatalf("WebAuthn -> passkey login rejected: %v", err)
+	}
+	sessions, _ := a.ListSessions("grace")
+	if len(sessions) != 1 || len(sessions[0].AMR) != 1 || sessions[0].AMR[0] != jjauth.MethodPasskey || !sessions[0].TwoFactor {
+		t.Fatalf("WebAuthn -> passkey session not created: %+v", sessions)
+	}
+
+	// Cloned authenticator
+	authenticator.signCount = 0
+	request, _ = a.BeginWebAuthnLogin("grace")
+	if _, err := a.FinishWebAuthnLogin(authenticator.login(request.Challenge, "")); !errors.Is(err, jjauth.ErrWebAuthn) {
+		t.Fatalf("WebAuthn -> decreasing sign counter accepted: %v", err)
+	}
+
+	credentials, _ := a.ListWebAuthnCredentials("grace")
+	if len(credentials) != 1 || credentials[0].SignCount != 4 {
+		t.Fatalf("WebAuthn -> wrong credentials: %+v", credentials)
+	}
+	a.DeleteWebAuthnCredential("grace", credentials[0].ID)
+	if credentials, _ := a.ListWebAuthnCredentials("grace"); len(credentials) != 0 {
+		t.Fatalf("WebAuthn -> credential not deleted")
+	}
+}
+
+func testTwoFactorCodes(t *testing.T) {
+	db, _ := sql.Open("sqlite3", filepath.Join(t.TempDir(), "codes.db"))
+	defer db.Close()
+	mailer := &testMailer{}
+	opts := jjauth.Options{
+		DB:               db,
+		Secret:           "codes",
+		Mailer:           mailer,
+		TwoFactorOptions: &jjauth.TwoFactorOptions{CodeLength: 8, MaxAttempts: 3, ResendInterval: 2},
+	}
+	a, _ := jjauth.New(opts)
+	a.NewUser("heidi", "1234", "heidi@email.com", 1)
+
+	if err := a.Verify2FA("heidi", "12345678"); !errors.Is(err, jjauth.ErrCodeNotFound) {
+		t.Fatalf("2FA codes -> code without New2FA: %v", err)
+	}
+	if err := a.New2FA("heidi", "1234", 60); err != nil {
+		t.Fatalf("2FA codes -> New2FA error: %s", err.Error())
+	}
+	code := mailer.body
+	if len(code) != 8 || strings.Trim(code, "0123456789") != "" {
+		t.Fatalf("2FA codes -> code is not numeric with 8 digits: %q", code)
+	}
+	if err := a.New2FA("heidi", "1234", 60); !errors.Is(err, jjauth.ErrCodeThrottled) {
+		t.Fatalf("2FA codes -> resend not throttled: %v", err)
+	}
+
+	// Codes survive restarts
+	a, _ = jjauth.New(opts)
+	if err := a.Verify2FA("heidi", "x"); !errors.Is(err, jjauth.ErrCodeInvalid) {
+		t.Fatalf("2FA codes -> wrong code: %v", err)
+	}
+	if !a.Check2FA("heidi", code) {
+		t.Fatalf("2FA codes -> valid code rejected after restart")
+	}
+	if err := a.Verify2FA("heidi", code); !errors.Is(err, jjauth.ErrCodeNotFound) {
+		t.Fatalf("2FA codes -> code used twice: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	a.New2FA("heidi", "1234", 60)
+	code = mailer.body
+	a.Verify2FA("heidi", "x")
+	a.Verify2FA("heidi", "x")
+	if err := a.Verify2FA("heidi", "x"); !errors.Is(err, jjauth.ErrCodeExhausted) {
+		t.Fatalf("2FA codes -> code not invalidated after max attempts: %v", err)
+	}
+	if err := a.Verify2FA("heidi", code); !errors.Is(err, jjauth.ErrCodeExhausted) {
+		t.Fatalf("2FA codes -> valid code accepted after max attempts: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	a.New2FA("heidi", "1234", 1)
+	time.Sleep(2 * time.Second)
+	if err := a.Verify2FA("heidi", mailer.body); !errors.Is(err, jjauth.ErrCodeExpired) {
+		t.Fatalf("2FA codes -> expired code: %v", err)
+	}
+}
+
+func testStepUp(t *testing.T) {
+	db, _ := sql.Open("sqlite3", filepath.Join(t.TempDir(), "stepup.db"))
+	defer db.Close()
+	// Table "Sessions" of older versions
+	db.Exec("CREATE TABLE Sessions (PK_SESSION TEXT NOT NULL PRIMARY KEY UNIQUE, FK_USER TEXT NOT NULL, " +
+		"Auth_level INTEGER DEFAULT 0, Created BIGINT NOT NULL, Last_seen BIGINT NOT NULL, Exp BIGINT NOT NULL, " +
+		"Idle BIGINT DEFAULT 0, Max_exp BIGINT DEFAULT 0, User_agent TEXT, IP TEXT, Revoked BOOLEAN DEFAULT 0, " +
+		"Two_factor BOOLEAN DEFAULT 0);")
+	a, err := jjauth.New(jjauth.Options{DB: db, Secret: "stepup"})
+	if err != nil {
+		t.Fatalf("Step-up -> Sessions table not migrated: %s", err.Error())
+	}
+	a.NewUser("ivan", "1234", "", 1)
+	enrollment, _ := a.EnrollTOTP("ivan")
+	step := time.Now().Unix() / 30
+	a.ConfirmTOTP("ivan", totpCode(enrollment.Secret, step))
+
+	w := httptest.NewRecorder()
+	a.NewSessionFromRequest("ivan", 60, 1, w, nil, jjauth.MethodPassword)
+	cookie := w.Result().Cookies()[0]
+
+	request := func(middleware func(http.Handler) http.Handler) (int, jjauth.Principal) {
+		var principal jjauth.Principal
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:3000/account/delete", nil)
+		r.AddCookie(cookie)
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ = jjauth.FromContext(r.Context())
+		})).ServeHTTP(w, r)
+		return w.Code, principal
+	}
+
+	code, principal := request(a.RequireRecentAuth(60, "/reauth"))
+	if code != http.StatusOK || len(principal.AMR) != 1 || principal.AMR[0] != jjauth.MethodPassword || principal.TwoFactor {
+		t.Fatalf("Step-up -> password session: %d %+v", code, principal)
+	}
+	if code, _ := request(a.RequireRecentAuth(60, "/reauth", jjauth.MethodTOTP, jjauth.MethodPasskey)); code != http.StatusSeeOther {
+		t.Fatalf("Step-up -> second factor not required: %d", code)
+	}
+	time.Sleep(2 * time.Second)
+	if code, _ := request(a.RequireRecentAuth(1, "")); code != http.StatusForbidden {
+		t.Fatalf("Step-up -> old authentication accepted: %d", code)
+	}
+
+	r, _ := http.NewRequest("POST", "http://localhost:3000/reauth", nil)
+	r.AddCookie(cookie)
+	if err := a.Reauthenticate(r); !errors.Is(err, jjauth.ErrNoRecentAuth) {
+		t.Fatalf("Step-up -> reauthentication without checks: %v", err)
+	}
+	if !a.CheckTOTP("ivan", totpCode(enrollment.Secret, step+1)) {
+		t.Fatalf("Step-up -> TOTP code rejected")
+	}
+	if err := a.Reauthenticate(r, jjauth.MethodTOTP); err != nil {
+		t.Fatalf("Step-up -> Reauthenticate error: %s", err.Error())
+	}
+	code, principal = request(a.RequireRecentAuth(1, "", jjauth.MethodTOTP))
+	if code != http.StatusOK || principal.SessionID == "" || !principal.TwoFactor {
+		t.Fatalf("Step-up -> session not upgraded in place: %d %+v", code, principal)
+	}
+}
+
+func testLogin(t *testing.T) {
+	db, _ := sql.Open("sqlite3", filepath.Join(t.TempDir(), "login.db"))
+	defer db.Close()
+	mailer := &testMailer{}
+	a, _ := jjauth.New(jjauth.Options{DB: db, Secret: "login", Mailer: mailer})
+	a.NewUser("judy", "1234", "judy@email.com", 2)
+	a.NewUser("mallory", "1234", "mallory@email.com", 1)
+
+	login := func(req jjauth.LoginRequest, cookies []*http.Cookie) (jjauth.LoginResult, []*http.Cookie, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "http://localhost:3000/login", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		result, err := a.Login(w, r, req)
+		return result, w.Result().Cookies(), err
+	}
+
+	result, cookies, err := login(jjauth.LoginRequest{User: "judy", Password: "1234", Duration: 60}, nil)
+	if err != nil || result.Status != jjauth.LoginComplete || len(cookies) != 1 || cookies[0].Name != "JJCSESID" {
+		t.Fatalf("Login -> login without 2FA: %+v %v", result, err)
+	}
+
+	for i := 0; i < 6; i++ {
+		_, _, err = login(jjauth.LoginRequest{User: "mallory", Password: "x"}, nil)
+	}
+	if !errors.Is(err, jjauth.ErrInvalidLogin) {
+		t.Fatalf("Login -> wrong password: %v", err)
+	}
+	if _, _, err = login(jjauth.LoginRequest{User: "mallory", Password: "1234"}, nil); !errors.Is(err, jjauth.ErrLoginBlocked) {
+		t.Fatalf("Login -> failed logins not registered: %v", err)
+	}
+
+	// A failed 2FA lookup does not skip the second factor
+	b, _ := jjauth.New(jjauth.Options{DB: db, Secret: "login", Mailer: mailer, TOTP: brokenTOTPStore{jjauth.NewMemoryTOTPStore()}})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://localhost:3000/login", nil)
+	if _, err := b.Login(w, r, jjauth.LoginRequest{User: "judy", Password: "1234"}); err == nil || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("Login -> session created without 2FA lookup: %v", err)
+	}
+
+	// Second factor
+	a.SetRequire2FA("judy", true)
+	if !a.Requires2FA("judy") {
+		t.Fatalf("Login -> SetRequire2FA not saved")
+	}
+	result, cookies, err = login(jjauth.LoginRequest{User: "judy", Password: "1234", Duration: 60}, nil)
+	if err != nil || result.Status != jjauth.LoginPending2FA || len(cookies) != 1 || cookies[0].Name != "JJCSESID_2FA" {
+		t.Fatalf("Login -> pending second factor: %+v %v", result, err)
+	}
+	pending := cookies
+	if _, _, err = login(jjauth.LoginRequest{Code: mailer.body}, nil); !errors.Is(err, jjauth.ErrNoPendingLogin) {
+		t.Fatalf("Login -> code without pending login: %v", err)
+	}
+	forged := []*http.Cookie{{Name: "JJCSESID_2FA", Value: pending[0].Value + "x"}}
+	if _, _, err = login(jjauth.LoginRequest{Code: mailer.body}, forged); !errors.Is(err, jjauth.ErrNoPendingLogin) {
+		t.Fatalf("Login -> forged pending login: %v", err)
+	}
+	if _, _, err = login(jjauth.LoginRequest{Code: "x"}, pending); !errors.Is(err, jjauth.ErrCodeInvalid) {
+		t.Fatalf("Login -> wrong code: %v", err)
+	}
+	result, cookies, err = login(jjauth.LoginRequest{Code: mailer.body}, pending)
+	if err != nil || result.Status != jjauth.LoginComplete || result.User != "judy" {
+		t.Fatalf("Login -> second step: %+v %v", result, err)
+	}
+	if len(cookies) != 2 || cookies[1].Name != "JJCSESID_2FA" || cookies[1].MaxAge >= 0 {
+		t.Fatalf("Login -> pending login cookie not deleted")
+	}
+
+	sessions, _ := a.ListSessions("judy")
+	for _, session := range sessions {
+		if session.TwoFactor {
+			if session.AuthLevel != 2 || len(session.AMR) != 2 || session.AMR[1] != jjauth.MethodEmailCode || session.Exp-session.Created != 60 {
+				t.Fatalf("Login -> session after second factor: %+v", session)
+			}
+			return
+		}
+	}
+	t.Fatalf("Login -> session not verified with second factor")
+}
+
+func testHandlers(t *testing.T) {
+	mailer := &testMailer{}
+	a, _ := jjauth.New(jjauth.Options{Users: jjauth.NewMemoryUserStore(), Secret: "handlers", Mailer: mailer})
+	custom := template.Must(template.New("login").Parse(`custom login {{.Error}}`))
+	h := handlers.New(a, handlers.Options{AuthLevel: 1, Templates: custom})
+
+	serve := func(handler http.Handler, method string, target string, body string, contentType string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	const form = "application/x-www-form-urlencoded"
+	const jsonType = "application/json"
+
+	// Registration
+	w := serve(h.Register(), "GET", "/register", "", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="email"`) || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Handlers -> default register template: %d %s", w.Code, w.Body.String())
+	}
+	csrf := w.Result().Cookies()[0]
+	if !strings.Contains(w.Body.String(), `name="csrf_token" value="`+csrf.Value+`"`) {
+		t.Fatalf("Handlers -> CSRF token not in the form: %s", w.Body.String())
+	}
+	w = serve(h.Register(), "POST", "/register", `{"user":"Kate","password":"1234","email":"kate@email.com"}`, jsonType, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Handlers -> registration without CSRF token: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.Register(), "POST", "/register", `{"user":"Kate","password":"1234","email":"kate@email.com","csrf_token":"x"}`, jsonType, []*http.Cookie{csrf})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Handlers -> registration with wrong CSRF token: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.Register(), "POST", "/register", `{"user":"Kate","password":"1234","email":"kate@email.com","csrf_token":"`+csrf.Value+`"}`, jsonType, []*http.Cookie{csrf})
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"user":"kate"`) {
+		t.Fatalf("Handlers -> JSON registration: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.Register(), "POST", "/register", "user=kate&password=1234&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "User name already used") {
+		t.Fatalf("Handlers -> duplicated user: %d %s", w.Code, w.Body.String())
+	}
+
+	// Login with forms
+	w = serve(h.Login(), "GET", "/login", "", "", []*http.Cookie{csrf})
+	if w.Body.String() != "custom login " || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("Handlers -> custom login template: %s", w.Body.String())
+	}
+	w = serve(h.Login(), "POST", "/login", "user=kate&password=x&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "custom login Wrong user or password" {
+		t.Fatalf("Handlers -> wrong password: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.Login(), "POST", "/login", "user=kate&password=1234", form, []*http.Cookie{csrf})
+	if w.Code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("Handlers -> login without CSRF token: %d %v", w.Code, w.Header())
+	}
+	w = serve(h.Login(), "POST", "/login", "user=kate&password=1234&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Handlers -> login: %d %v", w.Code, w.Header())
+	}
+	session := append(w.Result().Cookies(), csrf)
+	w = serve(h.Logout(), "POST", "/logout", "", "", session)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Handlers -> logout without CSRF token: %d %v", w.Code, w.Header())
+	}
+	w = serve(h.Logout(), "POST", "/logout", "csrf_token="+csrf.Value, form, session)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Fatalf("Handlers -> logout: %d %v", w.Code, w.Header())
+	}
+	if sessions, _ := a.ListSessions("kate"); len(sessions) != 0 {
+		t.Fatalf("Handlers -> session not deleted by logout")
+	}
+
+	// Login with JSON and second factor. JSON clients get the CSRF token with a GET request
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.Header.Set("Accept", jsonType)
+	w = httptest.NewRecorder()
+	h.Login().ServeHTTP(w, r)
+	var page struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	json.NewDecoder(w.Body).Decode(&page)
+	if len(w.Result().Cookies()) != 1 || page.CSRFToken != w.Result().Cookies()[0].Value {
+		t.Fatalf("Handlers -> JSON CSRF token: %+v %v", page, w.Header())
+	}
+	csrf = w.Result().Cookies()[0]
+	a.SetRequire2FA("kate", true)
+	w = serve(h.Login(), "POST", "/login", `{"user":"kate","password":"1234","csrf_token":"`+csrf.Value+`"}`, jsonType, []*http.Cookie{csrf})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"pending_2fa"`) {
+		t.Fatalf("Handlers -> JSON pending login: %d %s", w.Code, w.Body.String())
+	}
+	pending := append(w.Result().Cookies(), csrf)
+	w = serve(h.TwoFactor(), "POST", "/login/2fa", "code="+mailer.body+"&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Fatalf("Handlers -> code without pending login: %d %v", w.Code, w.Header())
+	}
+	w = serve(h.TwoFactor(), "POST", "/login/2fa", `{"code":"`+mailer.body+`","csrf_token":"`+csrf.Value+`"}`, jsonType, pending)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"logged_in"`) {
+		t.Fatalf("Handlers -> JSON second factor: %d %s", w.Code, w.Body.String())
+	}
+
+	// Password reset and email verification
+	w = serve(h.ForgotPassword(), "POST", "/forgot", `{"user":"kate","csrf_token":"`+csrf.Value+`"}`, jsonType, []*http.Cookie{csrf})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Handlers -> reset without PasswordResetOptions.URL: %d", w.Code)
+	}
+	token, _ := a.NewPasswordResetToken("kate")
+	w = serve(h.ResetPassword(), "GET", "/reset?token="+token, "", "", []*http.Cookie{csrf})
+	if !strings.Contains(w.Body.String(), token) {
+		t.Fatalf("Handlers -> reset form without token")
+	}
+	w = serve(h.ResetPassword(), "POST", "/reset", "token="+token+"&password=5678", form, []*http.Cookie{csrf})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Handlers -> reset password without CSRF token: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.ResetPassword(), "POST", "/reset", "token="+token+"&password=5678&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Handlers -> reset password: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.ResetPassword(), "POST", "/reset", "token="+token+"&password=5678&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already used") {
+		t.Fatalf("Handlers -> reset token used twice: %d %s", w.Code, w.Body.String())
+	}
+	token, _ = a.NewEmailVerificationToken("kate")
+	w = serve(h.VerifyEmail(), "GET", "/verify?token="+token, "", "", []*http.Cookie{csrf})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), token) || a.IsEmailVerified("kate") {
+		t.Fatalf("Handlers -> email verified by the link: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h.VerifyEmail(), "POST", "/verify", "token="+token+"&csrf_token="+csrf.Value, form, []*http.Cookie{csrf})
+	if w.Code != http.StatusSeeOther || !a.IsEmailVerified("kate") {
+		t.Fatalf("Handlers -> email verification: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func testAPIMode(t *testing.T) {
+	a, _ := jjauth.New(jjauth.Options{Users: jjauth.NewMemoryUserStore(), Secret: "api"})
+	a.NewUser("leo", "1234", "", 1)
+	token, err := a.NewSessionToken("leo", 60, 1, nil)
+	if err != nil {
+		t.Fatalf("API -> NewSessionToken error: %s", err.Error())
+	}
+
+	cors := jjauth.CORSOptions{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true, MaxAge: 600}
+	serve := func(middleware func(http.Handler) http.Handler, method string, header map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "http://localhost:3000/api/items", nil)
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := jjauth.FromContext(r.Context())
+			w.Write([]byte(principal.User))
+		})).ServeHTTP(w, r)
+		return w
+	}
+	checkProblem := func(w *httptest.ResponseRecorder, status int, testName string) {
+		var problem jjauth.Problem
+		json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != status || problem.Status != status || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Fatalf("API -> %s: %d %+v", testName, w.Code, problem)
+		}
+	}
+
+	bearer := map[string]string{"Authorization": "Bearer " + token, "Origin": "https://app.example.com"}
+	w := serve(a.GetAPIMiddleware(1, cors), "GET", bearer)
+	if w.Code != http.StatusOK || w.Body.String() != "leo" || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("API -> bearer token: %d %s %v", w.Code, w.Body.String(), w.Header())
+	}
+	w = serve(a.GetAPIMiddleware(1, cors), "GET", nil)
+	checkProblem(w, http.StatusUnauthorized, "request without session")
+	if w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("API -> WWW-Authenticate header: %v", w.Header())
+	}
+	checkProblem(serve(a.GetAPIMiddleware(2, cors), "GET", bearer), http.StatusForbidden, "insufficient auth level")
+
+	// Preflight requests
+	preflight := map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"}
+	w = serve(a.GetAPIMiddleware(1, cors), "OPTIONS", preflight)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "DELETE") ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("API -> preflight: %d %v", w.Code, w.Header())
+	}
+	preflight["Origin"] = "https://evil.example.com"
+	checkProblem(serve(a.GetAPIMiddleware(1, cors), "OPTIONS", preflight), http.StatusForbidden, "preflight of other origin")
+	evil := map[string]string{"Authorization": "Bearer " + token, "Origin": "https://evil.example.com"}
+	checkProblem(serve(a.GetAPIMiddleware(1, cors), "POST", evil), http.StatusForbidden, "request of other origin")
+
+	// Same-origin requests with the session cookie
+	cookie := map[string]string{"Cookie": "JJCSESID=" + token, "Origin": "http://localhost:3000"}
+	if w = serve(a.GetAPIMiddleware(1, cors), "POST", cookie); w.Code != http.StatusOK || w.Body.String() != "leo" {
+		t.Fatalf("API -> same-origin request with cookie: %d %s", w.Code, w.Body.String())
+	}
+
+	// Any origin is allowed without credentials, even if AllowCredentials is set
+	wildcard := jjauth.CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	w = serve(a.GetAPIMiddleware(1, wildcard), "GET", evil)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("API -> wildcard origin with credentials: %d %v", w.Code, w.Header())
+	}
+	cookie["Origin"] = "https://evil.example.com"
+	checkProblem(serve(a.GetAPIMiddleware(1, wildcard), "POST", cookie), http.StatusUnauthorized, "cookie of other origin")
+
+	// The header is only read by the API middlewares
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if err := a.CheckAuthCookie(r); !errors.Is(err, jjauth.ErrNoSession) {
+		t.Fatalf("API -> bearer token accepted as session cookie: %v", err)
+	}
+	if w = serve(a.GetAuthMiddleware(1, "", ""), "GET", bearer); w.Code != http.StatusForbidden {
+		t.Fatalf("API -> bearer token accepted by GetAuthMiddleware: %d", w.Code)
+	}
+
+	sessions, _ := a.ListSessions("leo")
+	a.RevokeSession("leo", sessions[0].ID)
+	w = serve(a.GetAPIMiddleware(1, cors), "GET", bearer)
+	checkProblem(w, http.StatusUnauthorized, "revoked session")
+	if !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Fatalf("API -> revoked token without invalid_token error")
+	}
+}
+
+func testJWT(t *testing.T) {
+	a, _ := jjauth.New(jjauth.Options{Users: jjauth.NewMemoryUserStore(), Secret: "jwt", JWT: jjauth.JWTOptions{Issuer: "https://auth.example.com"}})
+	a.NewUser("mia", "1234", "", 1)
+	pair, err := a.IssueTokens("mia", 1, nil)
+	if err != nil || pair.TokenType != "Bearer" || pair.ExpiresIn <= 0 || pair.ExpiresIn > 900 {
+		t.Fatalf("JWT -> IssueTokens: %+v %v", pair, err)
+	}
+	principal, err := a.ParseAccessToken(pair.AccessToken)
+	if err != nil || principal.User != "mia" || principal.AuthLevel != 1 || principal.SessionID == "" {
+		t.Fatalf("JWT -> ParseAccessToken: %+v %v", principal, err)
+	}
+	if _, err = a.ParseAccessToken(pair.AccessToken + "x"); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("JWT -> tampered token not rejected: %v", err)
+	}
+
+	serve := func(middleware func(http.Handler) http.Handler, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://localhost:3000/api/items", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := jjauth.FromContext(r.Context())
+			w.Write([]byte(principal.User))
+		})).ServeHTTP(w, r)
+		return w
+	}
+	if w := serve(a.GetJWTMiddleware(1), pair.AccessToken); w.Code != http.StatusOK || w.Body.String() != "mia" {
+		t.Fatalf("JWT -> middleware with access token: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(a.GetJWTMiddleware(1), ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("JWT -> middleware without token: %d", w.Code)
+	}
+	if w := serve(a.GetJWTMiddleware(2), pair.AccessToken); w.Code != http.StatusForbidden {
+		t.Fatalf("JWT -> middleware with insufficient auth level: %d", w.Code)
+	}
+
+	// Rotation and reuse detection
+	rotated, err := a.RefreshTokens(pair.RefreshToken)
+	if err != nil || rotated.RefreshToken == pair.RefreshToken {
+		t.Fatalf("JWT -> RefreshTokens: %+v %v", rotated, err)
+	}
+	if _, err = a.RefreshTokens(pair.RefreshToken); !errors.Is(err, jjauth.ErrRefreshTokenReused) {
+		t.Fatalf("JWT -> reused refresh token: %v", err)
+	}
+	if _, err = a.RefreshTokens(rotated.RefreshToken); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("JWT -> refresh token family not revoked: %v", err)
+	}
+
+	pair, _ = a.IssueTokens("mia", 1, nil)
+	if err = a.RevokeRefreshToken(pair.RefreshToken); err != nil {
+		t.Fatalf("JWT -> RevokeRefreshToken: %s", err.Error())
+	}
+	if _, err = a.RefreshTokens(pair.RefreshToken); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("JWT -> revoked refresh token: %v", err)
+	}
+
+	// Ed25519 keyring
+	hsToken := pair.AccessToken
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	if err = a.AddJWTKey(jjauth.JWTKey{ID: "k1", PrivateKey: priv}); err != nil {
+		t.Fatalf("JWT -> AddJWTKey: %s", err.Error())
+	}
+	if _, err = a.ParseAccessToken(hsToken); err == nil {
+		t.Fatalf("JWT -> HS256 token accepted with keyring")
+	}
+	pair, _ = a.IssueTokens("mia", 1, nil)
+	parts := strings.Split(pair.AccessToken, ".")
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if !strings.Contains(string(header), `"kid":"k1"`) || !strings.Contains(string(header), `"alg":"EdDSA"`) {
+		t.Fatalf("JWT -> header of EdDSA token: %s", header)
+	}
+	if principal, err = a.ParseAccessToken(pair.AccessToken); err != nil || principal.User != "mia" {
+		t.Fatalf("JWT -> ParseAccessToken of EdDSA token: %v", err)
+	}
+	w := httptest.NewRecorder()
+	a.JWKSHandler().ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	json.NewDecoder(w.Body).Decode(&jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "k1" || jwks.Keys[0].Kty != "OKP" ||
+		jwks.Keys[0].X != base64.RawURLEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)) {
+		t.Fatalf("JWT -> JWKS: %+v", jwks)
+	}
+
+	// SQL refresh token store
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "jwt.db"))
+	if err != nil {
+		t.Fatalf("JWT -> sql.Open error: %s", err.Error())
+	}
+	defer db.Close()
+	b, err := jjauth.New(jjauth.Options{DB: db, Secret: "jwt"})
+	if err != nil {
+		t.Fatalf("JWT -> New with DB error: %s", err.Error())
+	}
+	b.NewUser("mia", "1234", "", 1)
+	pair, _ = b.IssueTokens("mia", 1, nil)
+	rotated, err = b.RefreshTokens(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("JWT -> SQL RefreshTokens: %s", err.Error())
+	}
+	if _, err = b.RefreshTokens(pair.RefreshToken); !errors.Is(err, jjauth.ErrRefreshTokenReused) {
+		t.Fatalf("JWT -> SQL reused refresh token: %v", err)
+	}
+	b.DeleteUser("mia")
+	if _, err = b.RefreshTokens(rotated.RefreshToken); !errors.Is(err, jjauth.ErrInvalidToken) {
+		t.Fatalf("JWT -> SQL refresh token of deleted user: %v", err)
+	}
+}
+
 // Helpers
 
+// testMailer saves the last email instead of sending it.
+type testMailer struct {
+	to   string
+	body string
+}
+
+func (m *testMailer) SendMail(to string, subject string, body string) error {
+	m.to = to
+	m.body = body
+	return nil
+}
+
+// chanMailer sends the body of the emails sent in background to the channel.
+type chanMailer chan string
+
+func (m chanMailer) SendMail(to string, subject string, body string) error {
+	m <- body
+	return nil
+}
+
+// brokenTOTPStore fails to read the TOTP secrets.
+type brokenTOTPStore struct {
+	*jjauth.MemoryTOTPStore
+}
+
+func (s brokenTOTPStore) GetTOTP(user string) (jjauth.TOTPSecret, error) {
+	return jjauth.TOTPSecret{}, errors.New("store not available")
+}
+
+// softAuthenticator is a software WebAuthn authenticator with an ES256 key.
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+	rpID      string
+	origin    string
+	noPIN     bool // Only user presence, without user verification
+}
+
+func newSoftAuthenticator(rpID string, origin string) *softAuthenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, rpID: rpID, origin: origin}
+}
+
+func (s *softAuthenticator) register(challenge string, format string) jjauth.WebAuthnResponse {
+	clientData := s.clientData("webauthn.create", challenge)
+	coseKey, _ := cbor.Marshal(map[int]interface{}{1: 2, 3: -7, -1: 1, -2: s.key.X.FillBytes(make([]byte, 32)), -3: s.key.Y.FillBytes(make([]byte, 32))})
+	authData := s.authData(0x45)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = append(authData, byte(len(s.id)>>8), byte(len(s.id)))
+	authData = append(authData, s.id...)
+	authData = append(authData, coseKey...)
+
+	attStmt := map[string]interface{}{}
+	if format == "packed" {
+		attStmt = map[string]interface{}{"alg": -7, "sig": s.sign(authData, clientData)}
+	}
+	attestation, _ := cbor.Marshal(map[string]interface{}{"fmt": format, "attStmt": attStmt, "authData": authData})
+
+	return jjauth.WebAuthnResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(s.id),
+		RawID: base64.RawURLEncoding.EncodeToString(s.id),
+		Type:  "public-key",
+		Response: jjauth.WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+			AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+func (s *softAuthenticator) login(challenge string, userHandle string) jjauth.WebAuthnResponse {
+	s.signCount++
+	clientData := s.clientData("webauthn.get", challenge)
+	flags := byte(0x05)
+	if s.noPIN {
+		flags = 0x01
+	}
+	authData := s.authData(flags)
+	return jjauth.WebAuthnResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(s.id),
+		RawID: base64.RawURLEncoding.EncodeToString(s.id),
+		Type:  "public-key",
+		Response: jjauth.WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+			AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+			Signature:         base64.RawURLEncoding.EncodeToString(s.sign(authData, clientData)),
+			UserHandle:        userHandle,
+		},
+	}
+}
+
+func (s *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	return []byte(fmt.Sprintf(`{"type":%q,"challenge":%q,"origin":%q,"crossOrigin":false}`, ceremony, challenge, s.origin))
+}
+
+func (s *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(s.rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], s.signCount)
+	return data
+}
+
+func (s *softAuthenticator) sign(authData []byte, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, s.key, hash[:])
+	return sig
+}
+
+// totpCode returns the TOTP code (RFC 6238, SHA1, 6 digits) of the time step.
+func totpCode(secret string, step int64) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func checkSessionError(cookie *http.Cookie, authLevel int, expectedErr error, testName string, t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://localhost:3000/members", nil)
+	r.AddCookie(cookie)
+	err := jjauth.CheckAuthLevel(r, authLevel)
+	if expectedErr == nil {
+		if err != nil {
+			t.Fatalf("%s -> unexpected error: %s", testName, err.Error())
+		}
+		return
+	}
+	if !errors.Is(err, expectedErr) {
+		t.Fatalf("%s -> expected error: %v  Got: %v", testName, expectedErr, err)
+	}
+}
+
 func checkRoute(reqURL string, expectedRes string, testName string, cookie *http.Cookie, t *testing.T) {
 	// Client
 	client := &http.Client{}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a signed token (Ex: email verification link) is
+// malformed, has a wrong signature or was already used.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenExpired is returned when a signed token is valid but expired.
+var ErrTokenExpired = errors.New("token expired")
+
+// tokenPayload is the signed content of the tokens sent to the users.
+type tokenPayload struct {
+	Purpose string   `json:"p"`
+	Exp     int64    `json:"e"`
+	Fields  []string `json:"f"`
+}
+
+// signToken returns a URL-safe token "payload.signature" valid for [duration] seconds.
+// The purpose avoids that a token issued for a flow is accepted by other flow.
+func (a *Authenticator) signToken(purpose string, duration int64, fields ...string) (string, error) {
+	payload, err := json.Marshal(tokenPayload{Purpose: purpose, Exp: time.Now().Unix() + duration, Fields: fields})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + a.tokenSignature(encoded), nil
+}
+
+// parseToken checks signature, purpose and expiration of the token, and returns its fields.
+func (a *Authenticator) parseToken(purpose string, token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(a.tokenSignature(parts[0]))) {
+		return nil, ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var payload tokenPayload
+	if err := json.Unmarshal(b, &payload); err != nil || payload.Purpose != purpose {
+		return nil, ErrInvalidToken
+	}
+	if payload.Exp < time.Now().Unix() {
+		return nil, ErrTokenExpired
+	}
+	return payload.Fields, nil
+}
+
+// tokenSignature returns the HMAC-SHA256 of the encoded payload. The key is derived from
+// the secret, so signatures can not be confused with the session IDs.
+func (a *Authenticator) tokenSignature(encoded string) string {
+	key := hmac.New(sha256.New, []byte(a.secret))
+	key.Write([]byte("signed token"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
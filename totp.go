@@ -0,0 +1,385 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// TOTPOptions defines the TOTP codes (RFC 6238) of the authenticator apps.
+type TOTPOptions struct {
+	Issuer    string // Name of the service shown by authenticator apps
+	Digits    int    // Digits of the codes: 6 (default) or 8
+	Period    int    // Duration in seconds of each time step (default 30)
+	Skew      int    // Accepted time steps before and after the current one, for clock drift
+	Algorithm string // HMAC algorithm: "SHA1" (default, supported by all apps), "SHA256" or "SHA512"
+	QRSize    int    // Size in pixels of the QR code (default 256)
+}
+
+// TOTPEnrollment is the data the user needs to add the account to an authenticator app.
+type TOTPEnrollment struct {
+	Secret string // Base32 secret, for manual entry
+	URI    string // otpauth:// URI
+	QRCode []byte // PNG image of the URI
+}
+
+// DefaultTOTPOptions are the TOTP options used if none are configured.
+var DefaultTOTPOptions = TOTPOptions{
+	Issuer:    "auth",
+	Digits:    6,
+	Period:    30,
+	Skew:      1,
+	Algorithm: "SHA1",
+	QRSize:    256,
+}
+
+// ErrTOTPEnrolled is returned by EnrollTOTP when the user has already a confirmed
+// TOTP authenticator. It must be disabled with DisableTOTP before a new enrollment.
+var ErrTOTPEnrolled = errors.New("totp already enrolled")
+
+// ErrInvalidTOTPCode is returned by ConfirmTOTP when the code is not valid.
+var ErrInvalidTOTPCode = errors.New("invalid totp code")
+
+// totpSecretSize is the number of random bytes (160 bits) of a TOTP secret.
+const totpSecretSize = 20
+
+// totpAttemptsDuration is the time in seconds during which the wrong codes of CheckTOTP
+// are counted.
+const totpAttemptsDuration = int64(60 * 5)
+
+// SetTOTPOptions sets the options of the TOTP codes. Zero values of Digits, Period,
+// Algorithm and QRSize are replaced by the values of DefaultTOTPOptions.
+func SetTOTPOptions(opts TOTPOptions) error {
+	return defaultAuth.SetTOTPOptions(opts)
+}
+
+// SetTOTPOptions sets the options of the TOTP codes. See SetTOTPOptions.
+func (a *Authenticator) SetTOTPOptions(opts TOTPOptions) error {
+	if opts.Digits == 0 {
+		opts.Digits = DefaultTOTPOptions.Digits
+	}
+	if opts.Period <= 0 {
+		opts.Period = DefaultTOTPOptions.Period
+	}
+	if opts.Algorithm == "" {
+		opts.Algorithm = DefaultTOTPOptions.Algorithm
+	}
+	if opts.QRSize <= 0 {
+		opts.QRSize = DefaultTOTPOptions.QRSize
+	}
+	if opts.Skew < 0 {
+		opts.Skew = 0
+	}
+	if opts.Digits != 6 && opts.Digits != 8 {
+		return fmt.Errorf("Invalid TOTP options: %d digits", opts.Digits)
+	}
+	if totpHash(opts.Algorithm) == nil {
+		return fmt.Errorf("Invalid TOTP options: algorithm %s not supported", opts.Algorithm)
+	}
+	a.totp = opts
+	return nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user and returns the data to add it
+// to an authenticator app. The secret is saved encrypted, and it is not used as second
+// factor until the enrollment is confirmed with ConfirmTOTP.
+//
+// Returns ErrTOTPEnrolled if the user has already a confirmed TOTP authenticator.
+func EnrollTOTP(user string) (TOTPEnrollment, error) {
+	return defaultAuth.EnrollTOTP(user)
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. See EnrollTOTP.
+func (a *Authenticator) EnrollTOTP(user string) (TOTPEnrollment, error) {
+	user = a.userKey(user)
+	if _, err := a.users.GetUser(user); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("TOTP not enrolled: %s", err.Error())
+	}
+	current, err := a.totpStore.GetTOTP(user)
+	if err == nil && current.Confirmed {
+		return TOTPEnrollment{}, ErrTOTPEnrolled
+	}
+
+	key, err := randomBytes(totpSecretSize)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("TOTP not enrolled: %s", err.Error())
+	}
+	encrypted, err := a.encryptTOTPSecret(key)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("TOTP not enrolled: %s", err.Error())
+	}
+	err = a.totpStore.SaveTOTP(TOTPSecret{User: user, Secret: encrypted})
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("TOTP not enrolled: %s", err.Error())
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	uri := a.totpURI(user, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, a.totp.QRSize)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("TOTP QR code not generated: %s", err.Error())
+	}
+	return TOTPEnrollment{Secret: secret, URI: uri, QRCode: png}, nil
+}
+
+// ConfirmTOTP checks the first code of the authenticator app and enables TOTP as the
+// second factor of the user: from now New2FA does not send email codes and Check2FA
+// checks TOTP codes.
+//
+// Returns an error wrapping ErrInvalidTOTPCode if the code is not valid.
+func ConfirmTOTP(user string, code string) error {
+	return defaultAuth.ConfirmTOTP(user, code)
+}
+
+// ConfirmTOTP checks the first code of the authenticator app. See ConfirmTOTP.
+func (a *Authenticator) ConfirmTOTP(user string, code string) error {
+	user = a.userKey(user)
+	secret, err := a.totpStore.GetTOTP(user)
+	if err != nil {
+		return fmt.Errorf("TOTP not confirmed: %s", err.Error())
+	}
+	if !a.verifyTOTP(secret, code) {
+		return fmt.Errorf("TOTP not confirmed: %w", ErrInvalidTOTPCode)
+	}
+	secret, err = a.totpStore.GetTOTP(user)
+	if err == nil {
+		secret.Confirmed = true
+		err = a.totpStore.SaveTOTP(secret)
+	}
+	if err != nil {
+		return fmt.Errorf("TOTP not confirmed: %s", err.Error())
+	}
+	return nil
+}
+
+// CheckTOTP checks a code of the authenticator app of the user. Each code can be used
+// only once.
+//
+// Wrong codes are counted with the attempts of Check2FA: after TwoFactorOptions.MaxAttempts
+// wrong codes, all the codes are rejected during 5 minutes. A pending email code of
+// New2FA is cancelled.
+//
+// Returns true if the code is valid: then pass MethodTOTP to NewSessionFromRequest or
+// Reauthenticate.
+func CheckTOTP(user string, code string) bool {
+	return defaultAuth.CheckTOTP(user, code)
+}
+
+// CheckTOTP checks a code of the authenticator app of the user. See CheckTOTP.
+func (a *Authenticator) CheckTOTP(user string, code string) bool {
+	user = a.userKey(user)
+	if !a.HasTOTP(user) {
+		return false
+	}
+
+	// The code is checked as the pending code of Check2FA, so both share the attempts.
+	// A pending email code is replaced, but its wrong attempts are kept.
+	now := time.Now().Unix()
+	pending, err := a.codes.GetCode(user)
+	if errors.Is(err, ErrCodeNotFound) || (err == nil && (!pending.TOTP || pending.Exp < now)) {
+		replaced := TwoFactorCode{User: user, Created: now, Exp: now + totpAttemptsDuration, TOTP: true}
+		if err == nil && pending.Exp >= now {
+			replaced.Attempts = pending.Attempts
+		}
+		err = a.codes.SaveCode(replaced)
+	}
+	if err != nil {
+		return false
+	}
+	return a.Check2FA(user, code)
+}
+
+// HasTOTP returns true if the user has a confirmed TOTP authenticator.
+func HasTOTP(user string) bool {
+	return defaultAuth.HasTOTP(user)
+}
+
+// HasTOTP returns true if the user has a confirmed TOTP authenticator.
+func (a *Authenticator) HasTOTP(user string) bool {
+	secret, err := a.totpStore.GetTOTP(a.userKey(user))
+	return err == nil && secret.Confirmed
+}
+
+// DisableTOTP deletes the TOTP secret of the user. The second factor of the user
+// returns to email codes.
+func DisableTOTP(user string) error {
+	return defaultAuth.DisableTOTP(user)
+}
+
+// DisableTOTP deletes the TOTP secret of the user. See DisableTOTP.
+func (a *Authenticator) DisableTOTP(user string) error {
+	user = a.userKey(user)
+	err := a.totpStore.DeleteTOTP(user)
+	if err != nil {
+		return fmt.Errorf("%s TOTP couldnt be disabled: %s", user, err.Error())
+	}
+	return nil
+}
+
+// checkTOTPCode checks a code of the confirmed TOTP authenticator of the user.
+func (a *Authenticator) checkTOTPCode(user string, code string) bool {
+	secret, err := a.totpStore.GetTOTP(user)
+	if err != nil || !secret.Confirmed {
+		return false
+	}
+	return a.verifyTOTP(secret, code)
+}
+
+// verifyTOTP checks the code against the time steps allowed by the skew, and marks
+// its time step as used. Secrets encrypted with an old pepper key are upgraded.
+func (a *Authenticator) verifyTOTP(secret TOTPSecret, code string) bool {
+	key, keyID, err := a.decryptTOTPSecret(secret.Secret)
+	if err != nil {
+		log.Printf("%s TOTP secret not decrypted: %s", secret.User, err)
+		return false
+	}
+	if len(code) != a.totp.Digits {
+		return false
+	}
+	current := time.Now().Unix() / int64(a.totp.Period)
+	for step := current - int64(a.totp.Skew); step <= current+int64(a.totp.Skew); step++ {
+		expected := totpCode(key, step, a.totp.Digits, totpHash(a.totp.Algorithm))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			if a.totpStore.UseTOTPStep(secret.User, step) != nil {
+				return false
+			}
+			a.upgradeTOTPSecret(secret.User, key, keyID)
+			return true
+		}
+	}
+	return false
+}
+
+// totpURI returns the otpauth:// URI of the Key Uri Format of authenticator apps.
+func (a *Authenticator) totpURI(user string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", a.totp.Issuer)
+	query.Set("algorithm", a.totp.Algorithm)
+	query.Set("digits", strconv.Itoa(a.totp.Digits))
+	query.Set("period", strconv.Itoa(a.totp.Period))
+	label := url.PathEscape(a.totp.Issuer + ":" + user)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// totpCode returns the HOTP code (RFC 4226) of the time step.
+func totpCode(key []byte, step int64, digits int, fn func() hash.Hash) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(fn, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+func totpHash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "SHA1":
+		return sha1.New
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	}
+	return nil
+}
+
+// totpCipher returns the AES-256-GCM cipher of the TOTP secrets. The key is derived
+// from the secret of a pepper key.
+func totpCipher(secret string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("totp secret"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTOTPSecret encrypts the TOTP key with the current pepper key. The key ID is
+// saved as in the password hashes: "$pepper$kid=<key id>$<base64>".
+func (a *Authenticator) encryptTOTPSecret(key []byte) (string, error) {
+	keyID, secret := a.currentPepperKey()
+	aead, err := totpCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, key, nil)
+	encrypted := base64.StdEncoding.EncodeToString(sealed)
+	if keyID == "" {
+		return encrypted, nil
+	}
+	return pepperPrefix + keyID + "$" + encrypted, nil
+}
+
+// decryptTOTPSecret returns the TOTP key and the ID of the pepper key which encrypted it.
+func (a *Authenticator) decryptTOTPSecret(encrypted string) ([]byte, string, error) {
+	keyID, data := splitPepperKey(encrypted)
+	secret, ok := a.pepperSecret(keyID)
+	if !ok {
+		return nil, keyID, fmt.Errorf("unknown pepper key %s", keyID)
+	}
+	aead, err := totpCipher(secret)
+	if err != nil {
+		return nil, keyID, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(data, "$"))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, keyID, errors.New("invalid encrypted totp secret")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, keyID, fmt.Errorf("totp secret not decrypted with pepper key %q: %s", keyID, err.Error())
+	}
+	return key, keyID, nil
+}
+
+// upgradeTOTPSecret encrypts again with the current pepper key a TOTP key encrypted with
+// an old key.
+func (a *Authenticator) upgradeTOTPSecret(user string, key []byte, keyID string) {
+	if current, _ := a.currentPepperKey(); current == keyID {
+		return
+	}
+	encrypted, err := a.encryptTOTPSecret(key)
+	if err != nil {
+		log.Printf("%s TOTP secret not upgraded: %s", user, err)
+		return
+	}
+	secret, err := a.totpStore.GetTOTP(user)
+	if err == nil {
+		secret.Secret = encrypted
+		err = a.totpStore.SaveTOTP(secret)
+	}
+	if err != nil {
+		log.Printf("%s TOTP secret not upgraded: %s", user, err)
+	}
+}
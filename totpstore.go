@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// TOTPSecret is the TOTP authenticator of a user as it is saved in a TOTPStore.
+type TOTPSecret struct {
+	User      string
+	Secret    string // Encrypted secret
+	Confirmed bool   // Enrollment confirmed with a first code
+	LastStep  int64  // Last time step used, to reject replayed codes
+}
+
+// TOTPStore saves the TOTP secrets of the users.
+//
+// This package includes SQLTOTPStore and MemoryTOTPStore.
+type TOTPStore interface {
+	// SaveTOTP saves the TOTP secret of the user, replacing the previous one.
+	SaveTOTP(secret TOTPSecret) error
+
+	// GetTOTP returns the TOTP secret of the user. Returns ErrTOTPNotFound if it not exists.
+	GetTOTP(user string) (TOTPSecret, error)
+
+	// UseTOTPStep saves [step] as the last used time step of the user. Returns ErrTOTPReplay
+	// if the last used time step is not older, so only one of several concurrent uses of
+	// the same code succeeds.
+	UseTOTPStep(user string, step int64) error
+
+	// DeleteTOTP deletes the TOTP secret of the user.
+	DeleteTOTP(user string) error
+}
+
+// ErrTOTPNotFound is returned by TOTPStore when the user has not a TOTP secret.
+var ErrTOTPNotFound = errors.New("totp not found")
+
+// ErrTOTPReplay is returned by TOTPStore when a time step was already used.
+var ErrTOTPReplay = errors.New("totp code already used")
+
+// MemoryTOTPStore is a concurrency-safe TOTPStore which keeps secrets in memory.
+type MemoryTOTPStore struct {
+	secrets map[string]TOTPSecret
+	mtx     *sync.Mutex
+}
+
+// NewMemoryTOTPStore creates an empty MemoryTOTPStore.
+func NewMemoryTOTPStore() *MemoryTOTPStore {
+	return &MemoryTOTPStore{
+		secrets: make(map[string]TOTPSecret),
+		mtx:     &sync.Mutex{},
+	}
+}
+
+func (s *MemoryTOTPStore) SaveTOTP(secret TOTPSecret) error {
+	s.mtx.Lock()
+	s.secrets[secret.User] = secret
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryTOTPStore) GetTOTP(user string) (TOTPSecret, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	secret, ok := s.secrets[user]
+	if !ok {
+		return TOTPSecret{}, ErrTOTPNotFound
+	}
+	return secret, nil
+}
+
+func (s *MemoryTOTPStore) UseTOTPStep(user string, step int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	secret, ok := s.secrets[user]
+	if !ok {
+		return ErrTOTPNotFound
+	}
+	if secret.LastStep >= step {
+		return ErrTOTPReplay
+	}
+	secret.LastStep = step
+	s.secrets[user] = secret
+	return nil
+}
+
+func (s *MemoryTOTPStore) DeleteTOTP(user string) error {
+	s.mtx.Lock()
+	delete(s.secrets, user)
+	s.mtx.Unlock()
+	return nil
+}
+
+// SQLTOTPStore is a TOTPStore which saves secrets in the table "Totp_secrets" of a
+// database/sql database.
+type SQLTOTPStore struct {
+	db *sql.DB
+}
+
+// NewSQLTOTPStore creates the table "Totp_secrets" in the database if not exists.
+func NewSQLTOTPStore(db *sql.DB) (*SQLTOTPStore, error) {
+	_, err := db.Exec(qryCreateTOTPTable)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLTOTPStore{db}, nil
+}
+
+func (s *SQLTOTPStore) SaveTOTP(secret TOTPSecret) error {
+	return replaceRow(s.db, qryDeleteTOTP, []interface{}{secret.User}, qrySaveTOTP, secret.User, secret.Secret, secret.Confirmed, secret.LastStep)
+}
+
+func (s *SQLTOTPStore) GetTOTP(user string) (TOTPSecret, error) {
+	secret := TOTPSecret{User: user}
+	err := s.db.QueryRow(qryGetTOTP, user).Scan(&secret.Secret, &secret.Confirmed, &secret.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTPSecret{}, ErrTOTPNotFound
+	}
+	if err != nil {
+		return TOTPSecret{}, err
+	}
+	return secret, nil
+}
+
+func (s *SQLTOTPStore) UseTOTPStep(user string, step int64) error {
+	result, err := s.db.Exec(qryUseTOTPStep, step, user, step)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := s.GetTOTP(user); err != nil {
+			return err
+		}
+		return ErrTOTPReplay
+	}
+	return nil
+}
+
+func (s *SQLTOTPStore) DeleteTOTP(user string) error {
+	_, err := s.db.Exec(qryDeleteTOTP, user)
+	return err
+}
@@ -1,65 +1,141 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"sync"
+	"log"
+	"math/big"
 	"time"
-
-	"github.com/jjcapellan/wordgen"
-	"golang.org/x/crypto/bcrypt"
 )
 
-type obj2FA struct {
-	hashPass []byte
-	exp      int64 // Expire time
+// TwoFactorOptions defines the email verification codes of New2FA.
+type TwoFactorOptions struct {
+	CodeLength     int // Number of digits of the codes (default 6)
+	MaxAttempts    int // Wrong codes before the code is invalidated (default 5)
+	ResendInterval int // Minimum seconds between two codes sent to the same user (default 30)
+}
+
+// DefaultTwoFactorOptions are the options of the verification codes used if none are configured.
+var DefaultTwoFactorOptions = TwoFactorOptions{
+	CodeLength:     6,
+	MaxAttempts:    5,
+	ResendInterval: 30,
 }
 
-var twoFactorStore map[string]obj2FA = make(map[string]obj2FA)
+// Errors of New2FA and Verify2FA, usable with errors.Is.
+var (
+	ErrCodeNotFound  = errors.New("verification code not found")
+	ErrCodeExpired   = errors.New("verification code expired")
+	ErrCodeInvalid   = errors.New("wrong verification code")
+	ErrCodeExhausted = errors.New("too many wrong verification codes")
+	ErrCodeThrottled = errors.New("verification code requested too often")
+)
 
-var mtx2FStore *sync.Mutex = &sync.Mutex{}
+// SetTwoFactorOptions sets the options of the verification codes. Zero values are
+// replaced by the values of DefaultTwoFactorOptions.
+func SetTwoFactorOptions(opts TwoFactorOptions) {
+	defaultAuth.SetTwoFactorOptions(opts)
+}
+
+// SetTwoFactorOptions sets the options of the verification codes. See SetTwoFactorOptions.
+func (a *Authenticator) SetTwoFactorOptions(opts TwoFactorOptions) {
+	if opts.CodeLength <= 0 {
+		opts.CodeLength = DefaultTwoFactorOptions.CodeLength
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultTwoFactorOptions.MaxAttempts
+	}
+	if opts.ResendInterval <= 0 {
+		opts.ResendInterval = DefaultTwoFactorOptions.ResendInterval
+	}
+	a.twoFactor = opts
+}
 
 // New2FA checks user password and sends a verification code to user email
 //
-// The verification code is valid for [duration] seconds and is deleted after use
+// The verification code is numeric (TwoFactorOptions.CodeLength digits), is valid for
+// [duration] seconds and is deleted after use. A new code replaces the previous one, and
+// can not be requested before TwoFactorOptions.ResendInterval seconds (ErrCodeThrottled).
+//
+// If the user has a confirmed TOTP authenticator (see ConfirmTOTP), no email is sent and
+// Check2FA expects a code of the authenticator app during the following [duration] seconds.
 //
 // Returns an error if verification code is not sent
 func New2FA(user string, password string, duration int64) error {
+	return defaultAuth.New2FA(user, password, duration)
+}
+
+// New2FA checks user password and sends a verification code to user email. See New2FA.
+func (a *Authenticator) New2FA(user string, password string, duration int64) error {
+	user = a.userKey(user)
 	// Check user/pass
 
-	isUser, _ := CheckLogin(user, password)
+	isUser, _ := a.CheckLogin(user, password)
 	if !isUser {
 		return fmt.Errorf("Verification code not sent to user %s: invalid user", user)
 	}
+	return a.send2FACode(user, duration)
+}
 
-	// Get user email
-
-	row := conf.db.QueryRow(qryGetUserEmail, user)
-
-	var email string
-	err := row.Scan(&email)
+// send2FACode saves a new verification code of the user and sends it by email, or
+// prepares the check of a TOTP code.
+func (a *Authenticator) send2FACode(user string, duration int64) error {
+	now := time.Now().Unix()
+	err := a.codes.PurgeExpired(now)
 	if err != nil {
-		return fmt.Errorf("Verification code not sent: %s", err.Error())
+		log.Printf("expired verification codes not purged: %s", err)
 	}
 
-	// Create temp 2FA password
+	// Users with TOTP use the authenticator app instead of email codes
+
+	if a.HasTOTP(user) {
+		// The TOTP secret does not change, so a new login keeps the wrong attempts
+		code := TwoFactorCode{User: user, Created: now, Exp: now + duration, TOTP: true}
+		previous, err := a.codes.GetCode(user)
+		if err == nil && previous.TOTP && previous.Exp >= now {
+			code.Attempts = previous.Attempts
+			if previous.Exp > code.Exp {
+				code.Exp = previous.Exp
+			}
+		}
+		err = a.codes.SaveCode(code)
+		if err != nil {
+			return fmt.Errorf("Verification code not saved: %s", err.Error())
+		}
+		return nil
+	}
 
-	pass := wordgen.NotSymbols(6)
-	hashPass, _ := bcrypt.GenerateFromPassword([]byte(pass), 10)
+	// Resend throttling
 
-	// Register new 2FA
+	previous, err := a.codes.GetCode(user)
+	if err == nil && !previous.TOTP && previous.Created+int64(a.twoFactor.ResendInterval) > now {
+		return fmt.Errorf("Verification code not sent: %w", ErrCodeThrottled)
+	}
 
-	obj2f := obj2FA{}
-	obj2f.hashPass = hashPass
-	obj2f.exp = time.Now().Unix() + int64(duration)
+	// Get user email
 
-	mtx2FStore.Lock()
-	twoFactorStore[user] = obj2f
-	mtx2FStore.Unlock()
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return fmt.Errorf("Verification code not sent: %s", err.Error())
+	}
+	email := objUser.Email
+
+	// Create and register new 2FA code
+
+	code, err := randomDigits(a.twoFactor.CodeLength)
+	if err != nil {
+		return fmt.Errorf("Verification code not sent: %s", err.Error())
+	}
+	err = a.codes.SaveCode(TwoFactorCode{User: user, Hash: a.hash2FACode(user, code), Created: now, Exp: now + duration})
+	if err != nil {
+		return fmt.Errorf("Verification code not saved: %s", err.Error())
+	}
 
-	// Send 2FA password to user email
+	// Send 2FA code to user email
 
-	msg := genMessage("Verification code", pass)
-	err = sendMessage(email, msg)
+	err = a.mailer.SendMail(email, "Verification code", code)
 	if err != nil {
 		return fmt.Errorf("Verification code not sent: %s", err.Error())
 	}
@@ -69,23 +145,102 @@ func New2FA(user string, password string, duration int64) error {
 
 // Check2FA checks the verification code (pass2FA)
 //
-// Returns true if pass2FA is valid.
+// Returns true if pass2FA is valid: then pass MethodEmailCode (or MethodTOTP if the user has
+// an authenticator app) to NewSessionFromRequest or Reauthenticate. Use Verify2FA to know
+// why a code is rejected.
 func Check2FA(user string, pass2FA string) bool {
+	return defaultAuth.Check2FA(user, pass2FA)
+}
+
+// Check2FA checks the verification code (pass2FA). See Check2FA.
+func (a *Authenticator) Check2FA(user string, pass2FA string) bool {
+	_, err := a.check2FACode(user, pass2FA)
+	return err == nil
+}
 
-	defer mtx2FStore.Unlock()
-	mtx2FStore.Lock()
+// Verify2FA is like Check2FA, but returns nil if pass2FA is valid, or an error wrapping
+// ErrCodeNotFound, ErrCodeExpired, ErrCodeInvalid, or ErrCodeExhausted after
+// TwoFactorOptions.MaxAttempts wrong codes (a new code is required).
+func Verify2FA(user string, pass2FA string) error {
+	return defaultAuth.Verify2FA(user, pass2FA)
+}
+
+// Verify2FA checks the verification code (pass2FA). See Verify2FA.
+func (a *Authenticator) Verify2FA(user string, pass2FA string) error {
+	_, err := a.check2FACode(user, pass2FA)
+	return err
+}
 
-	exp := twoFactorStore[user].exp
-	if exp < time.Now().Unix() {
-		return false
+// check2FACode checks the verification code and returns its method: MethodTOTP or
+// MethodEmailCode.
+func (a *Authenticator) check2FACode(user string, pass2FA string) (string, error) {
+	user = a.userKey(user)
+	code, err := a.codes.GetCode(user)
+	if errors.Is(err, ErrCodeNotFound) {
+		return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Verification code of %s not checked: %s", user, err.Error())
+	}
+	if code.Exp < time.Now().Unix() {
+		return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeExpired)
 	}
 
-	err := bcrypt.CompareHashAndPassword(twoFactorStore[user].hashPass, []byte(pass2FA))
+	// The attempt is counted before the check, so concurrent checks can not exceed the limit
+	attempts, err := a.codes.AddAttempt(user)
 	if err != nil {
-		return false
+		return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeNotFound)
+	}
+	if attempts > a.twoFactor.MaxAttempts {
+		return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeExhausted)
 	}
 
-	delete(twoFactorStore, user)
+	var valid bool
+	if code.TOTP {
+		valid = a.checkTOTPCode(user, pass2FA)
+	} else {
+		valid = subtle.ConstantTimeCompare([]byte(code.Hash), []byte(a.hash2FACode(user, pass2FA))) == 1
+	}
+	if !valid {
+		if attempts == a.twoFactor.MaxAttempts {
+			return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeExhausted)
+		}
+		return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeInvalid)
+	}
+
+	err = a.codes.DeleteCode(user)
+	if err != nil {
+		return "", fmt.Errorf("Verification code of %s not checked: %w", user, ErrCodeNotFound)
+	}
+	if code.TOTP {
+		return MethodTOTP, nil
+	}
+	return MethodEmailCode, nil
+}
 
-	return true
+// clear2FACode forgets the pending code of a user who passed other second factor.
+func (a *Authenticator) clear2FACode(user string) {
+	err := a.codes.DeleteCode(user)
+	if err != nil && !errors.Is(err, ErrCodeNotFound) {
+		log.Printf("%s verification code not deleted: %s", user, err)
+	}
+}
+
+// hash2FACode returns the HMAC of the code, so a leaked store does not contain valid codes.
+func (a *Authenticator) hash2FACode(user string, code string) string {
+	return a.hashToken("2fa code " + user + " " + code)
+}
+
+// randomDigits returns [n] uniformly random decimal digits.
+func randomDigits(n int) (string, error) {
+	ten := big.NewInt(10)
+	digits := make([]byte, n)
+	for i := range digits {
+		d, err := rand.Int(rand.Reader, ten)
+		if err != nil {
+			return "", fmt.Errorf("random digits could not be generated: %s", err.Error())
+		}
+		digits[i] = byte('0' + d.Int64())
+	}
+	return string(digits), nil
 }
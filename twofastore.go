@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// TwoFactorCode is the pending verification code of a user, created by New2FA.
+type TwoFactorCode struct {
+	User     string
+	Hash     string // HMAC of the code (empty if TOTP)
+	Created  int64  // Unix time
+	Exp      int64  // Expire time
+	Attempts int    // Number of checks of the code
+	TOTP     bool   // The code is checked against the TOTP authenticator of the user
+}
+
+// TwoFactorStore saves the pending verification codes, so they survive restarts and can
+// be shared by several app instances.
+//
+// This package includes SQLTwoFactorStore and MemoryTwoFactorStore.
+type TwoFactorStore interface {
+	// SaveCode saves the code of the user, replacing the previous one.
+	SaveCode(code TwoFactorCode) error
+
+	// GetCode returns the code of the user. Returns ErrCodeNotFound if it not exists.
+	GetCode(user string) (TwoFactorCode, error)
+
+	// AddAttempt increments the attempts of the code of the user and returns the new value.
+	// Returns ErrCodeNotFound if it not exists.
+	AddAttempt(user string) (int, error)
+
+	// DeleteCode deletes the code of the user. Returns ErrCodeNotFound if it not exists, so
+	// only one of several concurrent uses succeeds.
+	DeleteCode(user string) error
+
+	// PurgeExpired deletes the codes expired before [now].
+	PurgeExpired(now int64) error
+}
+
+// MemoryTwoFactorStore is a concurrency-safe TwoFactorStore which keeps codes in memory.
+type MemoryTwoFactorStore struct {
+	codes map[string]TwoFactorCode
+	mtx   *sync.Mutex
+}
+
+// NewMemoryTwoFactorStore creates an empty MemoryTwoFactorStore.
+func NewMemoryTwoFactorStore() *MemoryTwoFactorStore {
+	return &MemoryTwoFactorStore{
+		codes: make(map[string]TwoFactorCode),
+		mtx:   &sync.Mutex{},
+	}
+}
+
+func (s *MemoryTwoFactorStore) SaveCode(code TwoFactorCode) error {
+	s.mtx.Lock()
+	s.codes[code.User] = code
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryTwoFactorStore) GetCode(user string) (TwoFactorCode, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	code, ok := s.codes[user]
+	if !ok {
+		return TwoFactorCode{}, ErrCodeNotFound
+	}
+	return code, nil
+}
+
+func (s *MemoryTwoFactorStore) AddAttempt(user string) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	code, ok := s.codes[user]
+	if !ok {
+		return 0, ErrCodeNotFound
+	}
+	code.Attempts++
+	s.codes[user] = code
+	return code.Attempts, nil
+}
+
+func (s *MemoryTwoFactorStore) DeleteCode(user string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.codes[user]; !ok {
+		return ErrCodeNotFound
+	}
+	delete(s.codes, user)
+	return nil
+}
+
+func (s *MemoryTwoFactorStore) PurgeExpired(now int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for user, code := range s.codes {
+		if code.Exp < now {
+			delete(s.codes, user)
+		}
+	}
+	return nil
+}
+
+// SQLTwoFactorStore is a TwoFactorStore which saves codes in the table "Two_factor_codes"
+// of a database/sql database.
+type SQLTwoFactorStore struct {
+	db *sql.DB
+}
+
+// NewSQLTwoFactorStore creates the table "Two_factor_codes" in the database if not exists.
+func NewSQLTwoFactorStore(db *sql.DB) (*SQLTwoFactorStore, error) {
+	_, err := db.Exec(qryCreateTwoFactorTable)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLTwoFactorStore{db}, nil
+}
+
+func (s *SQLTwoFactorStore) SaveCode(code TwoFactorCode) error {
+	return replaceRow(s.db, qryDeleteTwoFactorCode, []interface{}{code.User}, qrySaveTwoFactorCode, code.User, code.Hash, code.Created, code.Exp, code.Attempts, code.TOTP)
+}
+
+func (s *SQLTwoFactorStore) GetCode(user string) (TwoFactorCode, error) {
+	code := TwoFactorCode{User: user}
+	err := s.db.QueryRow(qryGetTwoFactorCode, user).Scan(&code.Hash, &code.Created, &code.Exp, &code.Attempts, &code.TOTP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TwoFactorCode{}, ErrCodeNotFound
+	}
+	if err != nil {
+		return TwoFactorCode{}, err
+	}
+	return code, nil
+}
+
+func (s *SQLTwoFactorStore) AddAttempt(user string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(qryAddTwoFactorAttempt, user)
+	if err != nil {
+		return 0, err
+	}
+	var attempts int
+	err = tx.QueryRow(qryGetTwoFactorAttempts, user).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCodeNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return attempts, tx.Commit()
+}
+
+func (s *SQLTwoFactorStore) DeleteCode(user string) error {
+	result, err := s.db.Exec(qryDeleteTwoFactorCode, user)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCodeNotFound
+	}
+	return nil
+}
+
+func (s *SQLTwoFactorStore) PurgeExpired(now int64) error {
+	_, err := s.db.Exec(qryPurgeTwoFactorCodes, now)
+	return err
+}
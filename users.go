@@ -1,11 +1,10 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"time"
-
-	"github.com/jjcapellan/wordgen"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // NewUser saves a new user in the database
@@ -17,30 +16,102 @@ import (
 // email: can be an empty stryng (""). Is used for two factor validation.
 //
 // authLevel: this number should be used to filter user access privileges.
+//
+// The username and the email are normalized before save them (see NormalizeUsername and
+// NormalizeEmail). Returns an error wrapping ErrInvalidUsername or ErrInvalidEmail if they
+// are not valid, a *PolicyError if the password does not satisfy the password policy, or
+// an error wrapping ErrUserExists if the name is already used.
 func NewUser(user string, password string, email string, authLevel int) error {
-	salt := wordgen.New(8)
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password+salt+conf.secret), 10)
-	_, err := conf.db.Exec(qryNewUser, user, string(hashedPassword), email, salt, authLevel)
+	return defaultAuth.NewUser(user, password, email, authLevel)
+}
+
+// NewUser saves a new user in the database. See NewUser.
+func (a *Authenticator) NewUser(user string, password string, email string, authLevel int) error {
+	user, err := a.NormalizeUsername(user)
+	if err != nil {
+		return err
+	}
+	email, err = a.NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	err = a.checkPolicy(user, email, password)
+	if err != nil {
+		return err
+	}
+	if _, err := a.users.GetUser(user); err == nil {
+		return fmt.Errorf("User %s not saved in database: %w", user, ErrUserExists)
+	}
+	hashedPassword, err := a.hashPass(password)
 	if err != nil {
 		return fmt.Errorf("User %s not saved in database: %s", user, err.Error())
 	}
+	err = a.users.CreateUser(User{Name: user, Password: hashedPassword, Email: email, AuthLevel: authLevel})
+	if err != nil {
+		return fmt.Errorf("User %s not saved in database: %w", user, err)
+	}
 	return nil
 }
 
 // DeleteUser deletes user register from database.
 func DeleteUser(user string) error {
-	_, err := conf.db.Exec(qryDeleteUser, user)
+	return defaultAuth.DeleteUser(user)
+}
+
+// DeleteUser deletes user register from database.
+func (a *Authenticator) DeleteUser(user string) error {
+	user = a.userKey(user)
+	err := a.users.DeleteUser(user)
 	if err != nil {
 		return fmt.Errorf("User %s couldnt be deleted from database: %s", user, err.Error())
 	}
+	err = a.sessions.DeleteUserSessions(user)
+	if err != nil {
+		return fmt.Errorf("User %s sessions couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.deleteUserRoles(user)
+	if err != nil {
+		return fmt.Errorf("User %s roles couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.history.DeletePasswordHistory(user)
+	if err != nil {
+		return fmt.Errorf("User %s password history couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.resets.DeleteUserResets(user)
+	if err != nil {
+		return fmt.Errorf("User %s password resets couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.totpStore.DeleteTOTP(user)
+	if err != nil {
+		return fmt.Errorf("User %s TOTP couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.recoveryCodes.DeleteRecoveryCodes(user)
+	if err != nil {
+		return fmt.Errorf("User %s recovery codes couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.codes.DeleteCode(user)
+	if err != nil && !errors.Is(err, ErrCodeNotFound) {
+		return fmt.Errorf("User %s verification code couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.webauthnStore.DeleteUserCredentials(user)
+	if err != nil {
+		return fmt.Errorf("User %s WebAuthn credentials couldnt be deleted: %s", user, err.Error())
+	}
+	err = a.refreshTokens.DeleteUserRefreshTokens(user)
+	if err != nil {
+		return fmt.Errorf("User %s refresh tokens couldnt be deleted: %s", user, err.Error())
+	}
 	return nil
 }
 
 // GetUsersCount gets the current number of users registered
 func GetUsersCount() (int, error) {
-	result := conf.db.QueryRow(qryGetUsersCount)
-	var count int
-	err := result.Scan(&count)
+	return defaultAuth.GetUsersCount()
+}
+
+// GetUsersCount gets the current number of users registered
+func (a *Authenticator) GetUsersCount() (int, error) {
+	count, err := a.users.CountUsers()
 	if err != nil {
 		return 0, fmt.Errorf("Users count error: %s", err.Error())
 	}
@@ -48,22 +119,84 @@ func GetUsersCount() (int, error) {
 }
 
 // UpdateUserPass updates user password
+//
+// Returns a *PolicyError if the password does not satisfy the password policy.
 func UpdateUserPass(user string, newPassword string) error {
-	salt := wordgen.New(8)
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(newPassword+salt+conf.secret), 10)
-	_, err := conf.db.Exec(qryUpdatePass, hashedPassword, salt, user)
+	return defaultAuth.UpdateUserPass(user, newPassword)
+}
+
+// UpdateUserPass updates user password
+func (a *Authenticator) UpdateUserPass(user string, newPassword string) error {
+	user = a.userKey(user)
+	objUser, err := a.users.GetUser(user)
 	if err != nil {
 		return fmt.Errorf("%s password couldnt be updated from database: %s", user, err.Error())
 	}
+	err = a.checkPolicy(user, objUser.Email, newPassword)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := a.hashPass(newPassword)
+	if err != nil {
+		return fmt.Errorf("%s password couldnt be updated from database: %s", user, err.Error())
+	}
+	err = a.users.UpdatePassword(user, hashedPassword, "")
+	if err != nil {
+		return fmt.Errorf("%s password couldnt be updated from database: %s", user, err.Error())
+	}
+
+	// Legacy hashes (with salt) can not be verified later, so they are not saved
+	if a.policy.HistorySize > 1 && objUser.Salt == "" {
+		err = a.history.AddPassword(user, objUser.Password)
+		if err != nil {
+			log.Printf("%s previous password not saved in password history: %s", user, err)
+		}
+	}
 	return nil
 }
 
-// UpdateUserEmail updates user email
+// UpdateUserEmail updates user email. The email is normalized before save it.
+//
+// The new email is saved as pending and the current email is kept until the new one is
+// confirmed with ConfirmEmail. If EmailRules.VerificationURL is set, a verification link
+// is sent to the new email, else the application must send the token returned by
+// NewEmailVerificationToken. An empty email removes the email of the user.
+//
+// Returns an error wrapping ErrInvalidEmail if the email is not valid.
 func UpdateUserEmail(user string, newEmail string) error {
-	_, err := conf.db.Exec(qryUpdateEmail, newEmail, user)
+	return defaultAuth.UpdateUserEmail(user, newEmail)
+}
+
+// UpdateUserEmail updates user email. See UpdateUserEmail.
+func (a *Authenticator) UpdateUserEmail(user string, newEmail string) error {
+	user = a.userKey(user)
+	newEmail, err := a.NormalizeEmail(newEmail)
+	if err != nil {
+		return err
+	}
+	objUser, err := a.users.GetUser(user)
 	if err != nil {
 		return fmt.Errorf("%s email couldnt be updated from database: %s", user, err.Error())
 	}
+
+	switch newEmail {
+	case "":
+		err = a.users.UpdateEmail(user, "")
+		if err == nil {
+			err = a.users.UpdateEmailStatus(user, false, "")
+		}
+	case objUser.Email:
+		err = a.users.UpdateEmailStatus(user, objUser.EmailVerified, "")
+	default:
+		err = a.users.UpdateEmailStatus(user, objUser.EmailVerified, newEmail)
+	}
+	if err != nil {
+		return fmt.Errorf("%s email couldnt be updated from database: %s", user, err.Error())
+	}
+
+	if newEmail != "" && newEmail != objUser.Email && a.emailRules.VerificationURL != "" {
+		return a.SendVerificationEmail(user)
+	}
 	return nil
 }
 
@@ -71,17 +204,39 @@ func UpdateUserEmail(user string, newEmail string) error {
 //
 // Returns (true, authLevel) if login is successful, else returns (false, 0).
 func CheckLogin(user string, password string) (bool, int) {
+	return defaultAuth.CheckLogin(user, password)
+}
 
-	row := conf.db.QueryRow(qryGetUser, user)
-	var hashedPassword string
-	var email string
-	var salt string
-	var authLevel int
-	err := row.Scan(&hashedPassword, &email, &salt, &authLevel)
+// CheckLogin checks user password
+//
+// Returns (true, authLevel) if login is successful, else returns (false, 0).
+//
+// If the stored hash uses an old algorithm or old parameters, it is replaced by a new hash.
+//
+// If EmailRules.RequireVerified is set, users without a verified email can not log in.
+func (a *Authenticator) CheckLogin(user string, password string) (bool, int) {
+	authLevel, err := a.checkLogin(user, password)
+	return err == nil, authLevel
+}
+
+// checkLogin checks user password and returns the auth level of the user, or an error
+// wrapping ErrInvalidLogin or ErrEmailNotVerified.
+func (a *Authenticator) checkLogin(user string, password string) (int, error) {
+	user = a.userKey(user)
+	objUser, err := a.users.GetUser(user)
 	if err != nil {
-		return false, 0
+		return 0, ErrInvalidLogin
+	}
+	if !a.checkPass(password, objUser.Password, objUser.Salt) {
+		return objUser.AuthLevel, ErrInvalidLogin
+	}
+	if a.emailRules.RequireVerified && !objUser.EmailVerified {
+		return objUser.AuthLevel, ErrEmailNotVerified
 	}
-	return checkPass(password, hashedPassword, salt), authLevel
+	if a.needsRehash(objUser) {
+		a.rehashPass(user, password)
+	}
+	return objUser.AuthLevel, nil
 }
 
 // CheckLogin checks user password and returns result after [delay] seconds.
@@ -89,20 +244,22 @@ func CheckLogin(user string, password string) (bool, int) {
 //
 // Returns (true, authLevel) if login is successful, else returns (false, 0).
 func CheckLoginDelayed(user string, password string, delay int) (bool, int) {
+	return defaultAuth.CheckLoginDelayed(user, password, delay)
+}
+
+// CheckLoginDelayed checks user password and returns result after [delay] seconds. See CheckLoginDelayed.
+func (a *Authenticator) CheckLoginDelayed(user string, password string, delay int) (bool, int) {
 	time.Sleep(time.Duration(delay) * time.Second)
-	passed, authLevel := CheckLogin(user, password)
+	passed, authLevel := a.CheckLogin(user, password)
 	return passed, authLevel
 }
 
-func checkPass(password string, hashedPassword string, salt string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password+salt+conf.secret))
+func (a *Authenticator) rehashPass(user string, password string) {
+	hashedPassword, err := a.hashPass(password)
+	if err == nil {
+		err = a.users.UpdatePassword(user, hashedPassword, "")
+	}
 	if err != nil {
-		return false
+		log.Printf("%s password not rehashed: %s", user, err)
 	}
-	return true
-}
-
-func initAuthTable() error {
-	_, err := conf.db.Exec(qryCreateTable)
-	return err
 }
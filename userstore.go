@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+)
+
+// User is a user profile as it is saved in a UserStore.
+type User struct {
+	Name      string `json:"name"`     // Unique name of the user
+	Password  string `json:"password"` // Hashed password
+	Email     string `json:"email"`
+	Salt      string `json:"salt"` // Only used by bcrypt hashes of older versions
+	AuthLevel int    `json:"auth_level"`
+
+	EmailVerified bool   `json:"email_verified"`          // Email confirmed with ConfirmEmail
+	PendingEmail  string `json:"pending_email,omitempty"` // New email waiting for confirmation
+
+	Require2FA bool `json:"require_2fa,omitempty"` // Login requires a second factor (see SetRequire2FA)
+}
+
+// UserStore is the storage backend of the users profiles.
+//
+// This package includes three implementations: SQLUserStore (database/sql),
+// MemoryUserStore (useful for tests) and FileUserStore (JSON file for small tools).
+type UserStore interface {
+	// CreateUser saves a new user. Returns ErrUserExists if user name is already used.
+	CreateUser(user User) error
+
+	// GetUser returns the user profile. Returns ErrUserNotFound if user not exists.
+	GetUser(name string) (User, error)
+
+	// UpdatePassword replaces hashed password and salt of the user.
+	UpdatePassword(name string, hashedPassword string, salt string) error
+
+	// UpdateEmail replaces the email of the user.
+	UpdateEmail(name string, email string) error
+
+	// UpdateEmailStatus replaces the verification state and the pending email of the user.
+	UpdateEmailStatus(name string, verified bool, pendingEmail string) error
+
+	// UpdateRequire2FA sets if the user must pass a second factor to log in.
+	UpdateRequire2FA(name string, required bool) error
+
+	// DeleteUser deletes the user profile.
+	DeleteUser(name string) error
+
+	// CountUsers returns the number of users saved.
+	CountUsers() (int, error)
+
+	// ListUsers returns the names of all users.
+	ListUsers() ([]string, error)
+
+	// UsersByEmail returns the names of the users with the email.
+	UsersByEmail(email string) ([]string, error)
+}
+
+// ErrUserNotFound is returned by UserStore when the user does not exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserExists is returned by UserStore when the user name is already used.
+var ErrUserExists = errors.New("user already exists")
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileUserStore is a UserStore which saves users in a JSON file.
+// The whole file is rewritten on each change, so it is intended for small tools
+// with few users.
+type FileUserStore struct {
+	path string
+	mem  *MemoryUserStore
+	mtx  *sync.Mutex // Serializes writes to the file
+}
+
+// NewFileUserStore opens the JSON file in path, or creates it if not exists.
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{
+		path: path,
+		mem:  NewMemoryUserStore(),
+		mtx:  &sync.Mutex{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, s.save()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Users file could not be read: %s", err.Error())
+	}
+
+	var users []User
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &users)
+		if err != nil {
+			return nil, fmt.Errorf("Users file could not be parsed: %s", err.Error())
+		}
+	}
+	for _, user := range users {
+		s.mem.users[user.Name] = user
+	}
+	return s, nil
+}
+
+func (s *FileUserStore) CreateUser(user User) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.mem.CreateUser(user)
+	if err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileUserStore) GetUser(name string) (User, error) {
+	return s.mem.GetUser(name)
+}
+
+func (s *FileUserStore) UpdatePassword(name string, hashedPassword string, salt string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.mem.UpdatePassword(name, hashedPassword, salt)
+	if err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileUserStore) UpdateEmail(name string, email string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.mem.UpdateEmail(name, email)
+	if err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileUserStore) UpdateEmailStatus(name string, verified bool, pendingEmail string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.mem.UpdateEmailStatus(name, verified, pendingEmail)
+	if err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileUserStore) UpdateRequire2FA(name string, required bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.mem.UpdateRequire2FA(name, required)
+	if err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileUserStore) DeleteUser(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.mem.DeleteUser(name)
+	if err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *FileUserStore) CountUsers() (int, error) {
+	return s.mem.CountUsers()
+}
+
+func (s *FileUserStore) ListUsers() ([]string, error) {
+	return s.mem.ListUsers()
+}
+
+func (s *FileUserStore) UsersByEmail(email string) ([]string, error) {
+	return s.mem.UsersByEmail(email)
+}
+
+// save writes all users to a temporary file and then renames it, so a crash
+// never leaves a half written users file.
+func (s *FileUserStore) save() error {
+	s.mem.mtx.RLock()
+	users := make([]User, 0, len(s.mem.users))
+	for _, user := range s.mem.users {
+		users = append(users, user)
+	}
+	s.mem.mtx.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Users file could not be saved: %s", err.Error())
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Users file could not be saved: %s", err.Error())
+	}
+	return nil
+}
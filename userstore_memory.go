@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"sync"
+)
+
+// MemoryUserStore is a concurrency-safe UserStore which keeps users in memory.
+// Users are lost when the process ends, so it is mainly intended for tests.
+type MemoryUserStore struct {
+	users map[string]User
+	mtx   *sync.RWMutex
+}
+
+// NewMemoryUserStore creates an empty MemoryUserStore.
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users: make(map[string]User),
+		mtx:   &sync.RWMutex{},
+	}
+}
+
+func (s *MemoryUserStore) CreateUser(user User) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.users[user.Name]; ok {
+		return ErrUserExists
+	}
+	s.users[user.Name] = user
+	return nil
+}
+
+func (s *MemoryUserStore) GetUser(name string) (User, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	user, ok := s.users[name]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryUserStore) UpdatePassword(name string, hashedPassword string, salt string) error {
+	return s.update(name, func(user *User) {
+		user.Password = hashedPassword
+		user.Salt = salt
+	})
+}
+
+func (s *MemoryUserStore) UpdateEmail(name string, email string) error {
+	return s.update(name, func(user *User) {
+		user.Email = email
+	})
+}
+
+func (s *MemoryUserStore) UpdateEmailStatus(name string, verified bool, pendingEmail string) error {
+	return s.update(name, func(user *User) {
+		user.EmailVerified = verified
+		user.PendingEmail = pendingEmail
+	})
+}
+
+func (s *MemoryUserStore) UpdateRequire2FA(name string, required bool) error {
+	return s.update(name, func(user *User) {
+		user.Require2FA = required
+	})
+}
+
+func (s *MemoryUserStore) DeleteUser(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.users, name)
+	return nil
+}
+
+func (s *MemoryUserStore) CountUsers() (int, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.users), nil
+}
+
+func (s *MemoryUserStore) ListUsers() ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *MemoryUserStore) UsersByEmail(email string) ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	names := []string{}
+	for name, user := range s.users {
+		if user.Email == email {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *MemoryUserStore) update(name string, fn func(user *User)) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	user, ok := s.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	fn(&user)
+	s.users[name] = user
+	return nil
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SQLUserStore is a UserStore which saves users in the table "Users" of a database/sql database.
+type SQLUserStore struct {
+	db *sql.DB
+}
+
+// NewSQLUserStore creates the table "Users" in the database if not exists, and adds
+// the columns of new versions to the table of older versions.
+func NewSQLUserStore(db *sql.DB) (*SQLUserStore, error) {
+	_, err := db.Exec(qryCreateTable)
+	if err != nil {
+		return nil, err
+	}
+	migrations := []struct {
+		check string
+		alter []string
+	}{
+		{qryCheckEmailColumns, []string{qryAddEmailVerifiedColumn, qryAddPendingEmailColumn}},
+		{qryCheckRequire2FAColumn, []string{qryAddRequire2FAColumn}},
+	}
+	for _, migration := range migrations {
+		rows, err := db.Query(migration.check)
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		for _, qry := range migration.alter {
+			_, err = db.Exec(qry)
+			if err != nil {
+				return nil, fmt.Errorf("Users table not updated: %s", err.Error())
+			}
+		}
+	}
+	return &SQLUserStore{db}, nil
+}
+
+func (s *SQLUserStore) CreateUser(user User) error {
+	_, err := s.db.Exec(qryNewUser, user.Name, user.Password, user.Email, user.Salt, user.AuthLevel,
+		user.EmailVerified, user.PendingEmail, user.Require2FA)
+	return err
+}
+
+func (s *SQLUserStore) GetUser(name string) (User, error) {
+	row := s.db.QueryRow(qryGetUser, name)
+	user := User{Name: name}
+	var email, pendingEmail sql.NullString
+	var verified, require2FA sql.NullBool
+	err := row.Scan(&user.Password, &email, &user.Salt, &user.AuthLevel, &verified, &pendingEmail, &require2FA)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.Email = email.String
+	user.EmailVerified = verified.Bool
+	user.PendingEmail = pendingEmail.String
+	user.Require2FA = require2FA.Bool
+	return user, nil
+}
+
+func (s *SQLUserStore) UpdatePassword(name string, hashedPassword string, salt string) error {
+	_, err := s.db.Exec(qryUpdatePass, hashedPassword, salt, name)
+	return err
+}
+
+func (s *SQLUserStore) UpdateEmail(name string, email string) error {
+	_, err := s.db.Exec(qryUpdateEmail, email, name)
+	return err
+}
+
+func (s *SQLUserStore) UpdateEmailStatus(name string, verified bool, pendingEmail string) error {
+	_, err := s.db.Exec(qryUpdateEmailStatus, verified, pendingEmail, name)
+	return err
+}
+
+func (s *SQLUserStore) UpdateRequire2FA(name string, required bool) error {
+	_, err := s.db.Exec(qryUpdateRequire2FA, required, name)
+	return err
+}
+
+func (s *SQLUserStore) DeleteUser(name string) error {
+	_, err := s.db.Exec(qryDeleteUser, name)
+	return err
+}
+
+func (s *SQLUserStore) ListUsers() ([]string, error) {
+	return s.queryNames(qryListUsers)
+}
+
+func (s *SQLUserStore) UsersByEmail(email string) ([]string, error) {
+	return s.queryNames(qryUsersByEmail, email)
+}
+
+func (s *SQLUserStore) CountUsers() (int, error) {
+	result := s.db.QueryRow(qryGetUsersCount)
+	var count int
+	err := result.Scan(&count)
+	return count, err
+}
+
+func (s *SQLUserStore) queryNames(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,529 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// WebAuthnOptions defines the relying party (the website) of the WebAuthn ceremonies.
+type WebAuthnOptions struct {
+	RPID    string   // Relying party ID: domain of the site (Ex: example.com)
+	RPName  string   // Name of the site shown by the authenticator
+	Origins []string // Accepted origins (default https://[RPID])
+	Timeout int      // Seconds to complete a ceremony (default 300)
+
+	// RequireUserVerification requires that the authenticator verifies the user (PIN or
+	// biometrics). Without it only the presence of the user (a touch) is required.
+	RequireUserVerification bool
+
+	// Attestation is the attestation conveyance preference: "none" (default), "indirect"
+	// or "direct". Supported attestation formats are "none" and "packed".
+	Attestation string
+}
+
+// WebAuthnRelyingParty identifies the site in WebAuthnCreationOptions.
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUser identifies the user in WebAuthnCreationOptions. ID is an opaque handle.
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// WebAuthnCredentialParam is an accepted public key algorithm.
+type WebAuthnCredentialParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// WebAuthnDescriptor identifies a credential.
+type WebAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// WebAuthnSelection defines the authenticators accepted by a registration.
+type WebAuthnSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCreationOptions are the options of navigator.credentials.create. Its JSON is
+// the format of PublicKeyCredential.parseCreationOptionsFromJSON.
+type WebAuthnCreationOptions struct {
+	RP                     WebAuthnRelyingParty      `json:"rp"`
+	User                   WebAuthnUser              `json:"user"`
+	Challenge              string                    `json:"challenge"`
+	PubKeyCredParams       []WebAuthnCredentialParam `json:"pubKeyCredParams"`
+	Timeout                int                       `json:"timeout"` // milliseconds
+	ExcludeCredentials     []WebAuthnDescriptor      `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnSelection         `json:"authenticatorSelection"`
+	Attestation            string                    `json:"attestation"`
+}
+
+// WebAuthnRequestOptions are the options of navigator.credentials.get. Its JSON is the
+// format of PublicKeyCredential.parseRequestOptionsFromJSON.
+type WebAuthnRequestOptions struct {
+	Challenge        string               `json:"challenge"`
+	Timeout          int                  `json:"timeout"` // milliseconds
+	RPID             string               `json:"rpId"`
+	AllowCredentials []WebAuthnDescriptor `json:"allowCredentials"`
+	UserVerification string               `json:"userVerification"`
+}
+
+// WebAuthnResponse is the credential returned by the browser. Its JSON is the format of
+// PublicKeyCredential.toJSON, with base64url binary values.
+type WebAuthnResponse struct {
+	ID       string                        `json:"id"`
+	RawID    string                        `json:"rawId"`
+	Type     string                        `json:"type"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+// WebAuthnAuthenticatorResponse is the response of the authenticator. AttestationObject
+// is set by registrations; AuthenticatorData, Signature and UserHandle by logins.
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// ErrWebAuthn is wrapped by the errors of the WebAuthn ceremonies when the response of
+// the browser is not valid.
+var ErrWebAuthn = errors.New("webauthn verification failed")
+
+// webauthnTimeout is the default time in seconds to complete a ceremony.
+const webauthnTimeout = 300
+
+// SetWebAuthnOptions sets the relying party of the WebAuthn ceremonies.
+func SetWebAuthnOptions(opts WebAuthnOptions) {
+	defaultAuth.SetWebAuthnOptions(opts)
+}
+
+// SetWebAuthnOptions sets the relying party of the WebAuthn ceremonies.
+func (a *Authenticator) SetWebAuthnOptions(opts WebAuthnOptions) {
+	if len(opts.Origins) == 0 && opts.RPID != "" {
+		opts.Origins = []string{"https://" + opts.RPID}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = webauthnTimeout
+	}
+	if opts.Attestation == "" {
+		opts.Attestation = "none"
+	}
+	a.webauthn = opts
+}
+
+// BeginWebAuthnRegistration starts the registration of a security key or passkey for the
+// user. The options must be passed to navigator.credentials.create in the browser, and
+// its result to FinishWebAuthnRegistration.
+func BeginWebAuthnRegistration(user string) (WebAuthnCreationOptions, error) {
+	return defaultAuth.BeginWebAuthnRegistration(user)
+}
+
+// BeginWebAuthnRegistration starts the registration of a credential. See BeginWebAuthnRegistration.
+func (a *Authenticator) BeginWebAuthnRegistration(user string) (WebAuthnCreationOptions, error) {
+	user = a.userKey(user)
+	if a.webauthn.RPID == "" {
+		return WebAuthnCreationOptions{}, fmt.Errorf("WebAuthn registration not started: WebAuthnOptions.RPID is empty")
+	}
+	if _, err := a.users.GetUser(user); err != nil {
+		return WebAuthnCreationOptions{}, fmt.Errorf("WebAuthn registration not started: %s", err.Error())
+	}
+	credentials, err := a.webauthnStore.ListUserCredentials(user)
+	if err != nil {
+		return WebAuthnCreationOptions{}, fmt.Errorf("WebAuthn registration not started: %s", err.Error())
+	}
+	challenge, err := a.newWebAuthnChallenge(user, false)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+
+	exclude := []WebAuthnDescriptor{}
+	for _, credential := range credentials {
+		exclude = append(exclude, WebAuthnDescriptor{Type: "public-key", ID: credential.ID})
+	}
+	return WebAuthnCreationOptions{
+		RP:        WebAuthnRelyingParty{ID: a.webauthn.RPID, Name: a.webauthn.RPName},
+		User:      WebAuthnUser{ID: a.webauthnUserHandle(user), Name: user, DisplayName: user},
+		Challenge: challenge,
+		PubKeyCredParams: []WebAuthnCredentialParam{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		Timeout:                a.webauthn.Timeout * 1000,
+		ExcludeCredentials:     exclude,
+		AuthenticatorSelection: WebAuthnSelection{ResidentKey: "preferred", UserVerification: a.userVerification()},
+		Attestation:            a.webauthn.Attestation,
+	}, nil
+}
+
+// FinishWebAuthnRegistration verifies the result of navigator.credentials.create and
+// saves the new credential of the user.
+//
+// Returns an error wrapping ErrWebAuthn if the response is not valid.
+func FinishWebAuthnRegistration(user string, response WebAuthnResponse) (WebAuthnCredential, error) {
+	return defaultAuth.FinishWebAuthnRegistration(user, response)
+}
+
+// FinishWebAuthnRegistration verifies the registration response. See FinishWebAuthnRegistration.
+func (a *Authenticator) FinishWebAuthnRegistration(user string, response WebAuthnResponse) (WebAuthnCredential, error) {
+	user = a.userKey(user)
+	clientDataJSON, challenge, err := a.checkClientData(response, "webauthn.create")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if challenge.Login || challenge.User != user {
+		return WebAuthnCredential{}, webauthnError("challenge was not issued for this registration")
+	}
+
+	raw, err := decodeBase64URL(response.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, webauthnError("attestation object not valid")
+	}
+	var att attestationObject
+	if err := cbor.Unmarshal(raw, &att); err != nil {
+		return WebAuthnCredential{}, webauthnError("attestation object not valid")
+	}
+	ad, err := a.checkAuthenticatorData(att.AuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if ad.flags&flagAttestedData == 0 || len(ad.credentialID) == 0 {
+		return WebAuthnCredential{}, webauthnError("attested credential data missing")
+	}
+	if _, err := coseAlgorithm(ad.publicKey); err != nil {
+		return WebAuthnCredential{}, webauthnError(err.Error())
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	switch att.Fmt {
+	case "none":
+	case "packed":
+		if err := verifyPacked(att.AttStmt, ad, att.AuthData, clientDataHash[:]); err != nil {
+			return WebAuthnCredential{}, webauthnError(err.Error())
+		}
+	default:
+		return WebAuthnCredential{}, webauthnError("attestation format " + att.Fmt + " not supported")
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(ad.credentialID)
+	if _, err := a.webauthnStore.GetCredential(id); err == nil {
+		return WebAuthnCredential{}, webauthnError("credential already registered")
+	}
+	credential := WebAuthnCredential{
+		ID:        id,
+		User:      user,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+		AAGUID:    ad.aaguid,
+		Created:   time.Now().Unix(),
+	}
+	err = a.webauthnStore.CreateCredential(credential)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("WebAuthn credential not saved: %s", err.Error())
+	}
+	return credential, nil
+}
+
+// BeginWebAuthnLogin starts a WebAuthn login. The options must be passed to
+// navigator.credentials.get in the browser, and its result to FinishWebAuthnLogin.
+//
+// With a user, only the credentials of that user are accepted (Ex: second factor after
+// the password). With an empty user, any passkey saved in the authenticator is accepted
+// (passwordless login), and the authenticator must verify the user (PIN or biometrics).
+func BeginWebAuthnLogin(user string) (WebAuthnRequestOptions, error) {
+	return defaultAuth.BeginWebAuthnLogin(user)
+}
+
+// BeginWebAuthnLogin starts a WebAuthn login. See BeginWebAuthnLogin.
+func (a *Authenticator) BeginWebAuthnLogin(user string) (WebAuthnRequestOptions, error) {
+	if a.webauthn.RPID == "" {
+		return WebAuthnRequestOptions{}, fmt.Errorf("WebAuthn login not started: WebAuthnOptions.RPID is empty")
+	}
+	allow := []WebAuthnDescriptor{}
+	if user != "" {
+		user = a.userKey(user)
+		credentials, err := a.webauthnStore.ListUserCredentials(user)
+		if err != nil {
+			return WebAuthnRequestOptions{}, fmt.Errorf("WebAuthn login not started: %s", err.Error())
+		}
+		if len(credentials) == 0 {
+			return WebAuthnRequestOptions{}, fmt.Errorf("WebAuthn login not started: %s", ErrCredentialNotFound.Error())
+		}
+		for _, credential := range credentials {
+			allow = append(allow, WebAuthnDescriptor{Type: "public-key", ID: credential.ID})
+		}
+	}
+	challenge, err := a.newWebAuthnChallenge(user, true)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	verification := a.userVerification()
+	if user == "" {
+		verification = "required"
+	}
+	return WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          a.webauthn.Timeout * 1000,
+		RPID:             a.webauthn.RPID,
+		AllowCredentials: allow,
+		UserVerification: verification,
+	}, nil
+}
+
+// FinishWebAuthnLogin verifies the result of navigator.credentials.get.
+//
+// Returns the user of the credential: then pass MethodPasskey to NewSessionFromRequest or
+// Reauthenticate. Returns an error wrapping ErrWebAuthn if the response is not valid, or
+// if the login was started without user (see BeginWebAuthnLogin) and the authenticator
+// did not verify the user.
+func FinishWebAuthnLogin(response WebAuthnResponse) (string, error) {
+	return defaultAuth.FinishWebAuthnLogin(response)
+}
+
+// FinishWebAuthnLogin verifies the login response. See FinishWebAuthnLogin.
+func (a *Authenticator) FinishWebAuthnLogin(response WebAuthnResponse) (string, error) {
+	user, _, err := a.finishWebAuthnLogin(response)
+	return user, err
+}
+
+// finishWebAuthnLogin verifies the login response, and returns the user of the credential
+// and whether the authenticator verified the user.
+func (a *Authenticator) finishWebAuthnLogin(response WebAuthnResponse) (string, bool, error) {
+	clientDataJSON, challenge, err := a.checkClientData(response, "webauthn.get")
+	if err != nil {
+		return "", false, err
+	}
+	if !challenge.Login {
+		return "", false, webauthnError("challenge was not issued for a login")
+	}
+
+	id := response.RawID
+	if id == "" {
+		id = response.ID
+	}
+	rawID, err := decodeBase64URL(id)
+	if err != nil {
+		return "", false, webauthnError("credential ID not valid")
+	}
+	credential, err := a.webauthnStore.GetCredential(base64.RawURLEncoding.EncodeToString(rawID))
+	if err != nil {
+		return "", false, webauthnError("credential not registered")
+	}
+	if challenge.User != "" && credential.User != challenge.User {
+		return "", false, webauthnError("credential of other user")
+	}
+	if response.Response.UserHandle != "" {
+		handle, err := decodeBase64URL(response.Response.UserHandle)
+		if err != nil || base64.RawURLEncoding.EncodeToString(handle) != a.webauthnUserHandle(credential.User) {
+			return "", false, webauthnError("user handle does not match")
+		}
+	}
+
+	authData, err := decodeBase64URL(response.Response.AuthenticatorData)
+	if err != nil {
+		return "", false, webauthnError("authenticator data not valid")
+	}
+	ad, err := a.checkAuthenticatorData(authData)
+	if err != nil {
+		return "", false, err
+	}
+	// Without a user, the passkey is the only proof of identity
+	if challenge.User == "" && ad.flags&flagUserVerified == 0 {
+		return "", false, webauthnError("user not verified")
+	}
+	sig, err := decodeBase64URL(response.Response.Signature)
+	if err != nil {
+		return "", false, webauthnError("signature not valid")
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(credential.PublicKey, signed, sig); err != nil {
+		return "", false, webauthnError(err.Error())
+	}
+
+	// Authenticators without counter always report 0. Else the counter must increase,
+	// or the credential may have been cloned.
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return "", false, webauthnError("signature counter did not increase")
+	}
+	err = a.webauthnStore.UpdateSignCount(credential.ID, ad.signCount, time.Now().Unix())
+	if err != nil {
+		return "", false, fmt.Errorf("WebAuthn sign counter not saved: %s", err.Error())
+	}
+
+	a.clear2FACode(credential.User)
+	return credential.User, ad.flags&flagUserVerified != 0, nil
+}
+
+// PasskeyLogin verifies the result of navigator.credentials.get (see FinishWebAuthnLogin)
+// and creates a new session of the user with its auth level (see NewSessionFromRequest).
+// The method of the session is MethodPasskey.
+//
+// The authenticator must verify the user (PIN or biometrics): a passkey with user
+// verification is a second factor by itself, so the session is marked as verified with a
+// second factor (Session.TwoFactor). Returns an error wrapping ErrWebAuthn without it.
+//
+// If EmailRules.RequireVerified is set, users without a verified email can not log in.
+func PasskeyLogin(response WebAuthnResponse, duration int, w http.ResponseWriter, r *http.Request) (string, error) {
+	return defaultAuth.PasskeyLogin(response, duration, w, r)
+}
+
+// PasskeyLogin verifies the login response and creates a new session. See PasskeyLogin.
+func (a *Authenticator) PasskeyLogin(response WebAuthnResponse, duration int, w http.ResponseWriter, r *http.Request) (string, error) {
+	user, verified, err := a.finishWebAuthnLogin(response)
+	if err != nil {
+		return "", err
+	}
+	if !verified {
+		return "", webauthnError("user not verified")
+	}
+	objUser, err := a.users.GetUser(user)
+	if err != nil {
+		return "", fmt.Errorf("Passkey login error: %s", err.Error())
+	}
+	if a.emailRules.RequireVerified && !objUser.EmailVerified {
+		return "", fmt.Errorf("Passkey login of %s failed: %w", user, ErrEmailNotVerified)
+	}
+	token, session, err := a.createSession(user, duration, objUser.AuthLevel, r, []string{MethodPasskey}, true)
+	if err != nil {
+		return "", err
+	}
+	a.setSessionCookie(w, token, session.Exp)
+	return user, nil
+}
+
+// ListWebAuthnCredentials returns the security keys and passkeys of the user.
+func ListWebAuthnCredentials(user string) ([]WebAuthnCredential, error) {
+	return defaultAuth.ListWebAuthnCredentials(user)
+}
+
+// ListWebAuthnCredentials returns the security keys and passkeys of the user.
+func (a *Authenticator) ListWebAuthnCredentials(user string) ([]WebAuthnCredential, error) {
+	user = a.userKey(user)
+	credentials, err := a.webauthnStore.ListUserCredentials(user)
+	if err != nil {
+		return nil, fmt.Errorf("%s WebAuthn credentials could not be read: %s", user, err.Error())
+	}
+	return credentials, nil
+}
+
+// DeleteWebAuthnCredential deletes a security key or passkey of the user. id is the ID
+// of a WebAuthnCredential returned by ListWebAuthnCredentials.
+func DeleteWebAuthnCredential(user string, id string) error {
+	return defaultAuth.DeleteWebAuthnCredential(user, id)
+}
+
+// DeleteWebAuthnCredential deletes a credential of the user. See DeleteWebAuthnCredential.
+func (a *Authenticator) DeleteWebAuthnCredential(user string, id string) error {
+	user = a.userKey(user)
+	credential, err := a.webauthnStore.GetCredential(id)
+	if err != nil || credential.User != user {
+		return fmt.Errorf("WebAuthn credential of %s could not be deleted: %s", user, ErrCredentialNotFound.Error())
+	}
+	err = a.webauthnStore.DeleteCredential(id)
+	if err != nil {
+		return fmt.Errorf("WebAuthn credential of %s could not be deleted: %s", user, err.Error())
+	}
+	return nil
+}
+
+// checkClientData checks type and origin of the client data, and consumes its challenge.
+func (a *Authenticator) checkClientData(response WebAuthnResponse, ceremony string) ([]byte, WebAuthnChallenge, error) {
+	clientDataJSON, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, WebAuthnChallenge{}, webauthnError("client data not valid")
+	}
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, WebAuthnChallenge{}, webauthnError("client data not valid")
+	}
+	if cd.Type != ceremony {
+		return nil, WebAuthnChallenge{}, webauthnError("client data type is not " + ceremony)
+	}
+	if !contains(a.webauthn.Origins, cd.Origin) {
+		return nil, WebAuthnChallenge{}, webauthnError("origin " + cd.Origin + " not accepted")
+	}
+
+	challenge, err := a.webauthnStore.GetChallenge(cd.Challenge)
+	if err == nil {
+		err = a.webauthnStore.DeleteChallenge(cd.Challenge)
+	}
+	if err != nil || challenge.Exp < time.Now().Unix() {
+		return nil, WebAuthnChallenge{}, webauthnError("challenge not valid or expired")
+	}
+	return clientDataJSON, challenge, nil
+}
+
+// checkAuthenticatorData checks the relying party and the user flags of the authenticator data.
+func (a *Authenticator) checkAuthenticatorData(data []byte) (authenticatorData, error) {
+	ad, err := parseAuthenticatorData(data)
+	if err != nil {
+		return ad, webauthnError(err.Error())
+	}
+	rpIDHash := sha256.Sum256([]byte(a.webauthn.RPID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return ad, webauthnError("relying party ID does not match")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return ad, webauthnError("user not present")
+	}
+	if a.webauthn.RequireUserVerification && ad.flags&flagUserVerified == 0 {
+		return ad, webauthnError("user not verified")
+	}
+	return ad, nil
+}
+
+// newWebAuthnChallenge saves and returns a random challenge of a new ceremony. Expired
+// challenges are deleted.
+func (a *Authenticator) newWebAuthnChallenge(user string, login bool) (string, error) {
+	challenge, err := createToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	err = a.webauthnStore.CreateChallenge(WebAuthnChallenge{ID: challenge, User: user, Login: login, Exp: now + int64(a.webauthn.Timeout)})
+	if err != nil {
+		return "", fmt.Errorf("WebAuthn challenge not saved: %s", err.Error())
+	}
+	err = a.webauthnStore.PurgeExpiredChallenges(now)
+	if err != nil {
+		log.Printf("expired WebAuthn challenges not purged: %s", err)
+	}
+	return challenge, nil
+}
+
+// webauthnUserHandle returns the base64url user handle of the user. It is derived from
+// the secret, so authenticators do not store the username in the handle.
+func (a *Authenticator) webauthnUserHandle(user string) string {
+	handle := sha256.Sum256([]byte(a.hashToken("webauthn user " + user)))
+	return base64.RawURLEncoding.EncodeToString(handle[:])
+}
+
+func (a *Authenticator) userVerification() string {
+	if a.webauthn.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+func webauthnError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrWebAuthn, reason)
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithms supported for credential public keys.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// oidAAGUID is the certificate extension with the AAGUID of packed attestations.
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type packedStatement struct {
+	Alg int64    `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5c [][]byte `cbor:"x5c"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte // COSE_Key
+}
+
+// parseAuthenticatorData parses the binary authenticator data of the WebAuthn spec.
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	ad := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	ad.aaguid = rest[:16]
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return ad, errors.New("credential ID too short")
+	}
+	ad.credentialID = rest[:idLen]
+
+	var key cbor.RawMessage
+	if err := cbor.NewDecoder(bytes.NewReader(rest[idLen:])).Decode(&key); err != nil {
+		return ad, fmt.Errorf("credential public key not valid: %s", err.Error())
+	}
+	ad.publicKey = key
+	return ad, nil
+}
+
+// verifyPacked verifies a "packed" attestation statement. Attestation certificates are
+// not checked against trusted roots.
+func verifyPacked(raw cbor.RawMessage, ad authenticatorData, authData []byte, clientDataHash []byte) error {
+	var stmt packedStatement
+	if err := cbor.Unmarshal(raw, &stmt); err != nil {
+		return fmt.Errorf("packed attestation not valid: %s", err.Error())
+	}
+	signed := append(append([]byte{}, authData...), clientDataHash...)
+
+	// Self attestation: signed with the credential key
+	if len(stmt.X5c) == 0 {
+		alg, err := coseAlgorithm(ad.publicKey)
+		if err != nil {
+			return err
+		}
+		if alg != stmt.Alg {
+			return errors.New("packed attestation algorithm does not match the credential key")
+		}
+		return verifyCOSESignature(ad.publicKey, signed, stmt.Sig)
+	}
+
+	cert, err := x509.ParseCertificate(stmt.X5c[0])
+	if err != nil {
+		return fmt.Errorf("attestation certificate not valid: %s", err.Error())
+	}
+	if cert.Version != 3 || cert.IsCA || !contains(cert.Subject.OrganizationalUnit, "Authenticator Attestation") {
+		return errors.New("attestation certificate does not satisfy the packed requirements")
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, ad.aaguid) {
+			return errors.New("attestation certificate AAGUID does not match")
+		}
+	}
+	var sigAlg x509.SignatureAlgorithm
+	switch stmt.Alg {
+	case coseES256:
+		sigAlg = x509.ECDSAWithSHA256
+	case coseRS256:
+		sigAlg = x509.SHA256WithRSA
+	case coseEdDSA:
+		sigAlg = x509.PureEd25519
+	default:
+		return fmt.Errorf("attestation algorithm %d not supported", stmt.Alg)
+	}
+	if err := cert.CheckSignature(sigAlg, signed, stmt.Sig); err != nil {
+		return fmt.Errorf("attestation signature not valid: %s", err.Error())
+	}
+	return nil
+}
+
+// coseAlgorithm returns the algorithm (label 3) of a COSE_Key.
+func coseAlgorithm(key []byte) (int64, error) {
+	var m map[int]interface{}
+	if err := cbor.Unmarshal(key, &m); err != nil {
+		return 0, fmt.Errorf("credential public key not valid: %s", err.Error())
+	}
+	alg, ok := coseInt(m[3])
+	if !ok {
+		return 0, errors.New("credential public key without algorithm")
+	}
+	return alg, nil
+}
+
+// verifyCOSESignature verifies the signature of the data with a COSE_Key (ES256, EdDSA or RS256).
+func verifyCOSESignature(key []byte, data []byte, sig []byte) error {
+	var m map[int]interface{}
+	if err := cbor.Unmarshal(key, &m); err != nil {
+		return fmt.Errorf("credential public key not valid: %s", err.Error())
+	}
+	alg, _ := coseInt(m[3])
+	hash := sha256.Sum256(data)
+
+	switch alg {
+	case coseES256:
+		x, _ := m[-2].([]byte)
+		y, _ := m[-3].([]byte)
+		crv, _ := coseInt(m[-1])
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return errors.New("ES256 public key not valid")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) || !ecdsa.VerifyASN1(pub, hash[:], sig) {
+			return errors.New("signature not valid")
+		}
+	case coseEdDSA:
+		x, _ := m[-2].([]byte)
+		if len(x) != ed25519.PublicKeySize || !ed25519.Verify(x, data, sig) {
+			return errors.New("signature not valid")
+		}
+	case coseRS256:
+		n, _ := m[-1].([]byte)
+		e, _ := m[-2].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return errors.New("RS256 public key not valid")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return errors.New("signature not valid")
+		}
+	default:
+		return fmt.Errorf("public key algorithm %d not supported", alg)
+	}
+	return nil
+}
+
+// coseInt converts the integers decoded by cbor (uint64 or int64) to int64.
+func coseInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// decodeBase64URL decodes base64url with or without padding, as sent by browsers.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
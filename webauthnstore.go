@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// WebAuthnCredential is a WebAuthn credential (security key or passkey) of a user.
+type WebAuthnCredential struct {
+	ID        string // Base64url credential ID
+	User      string
+	PublicKey []byte // COSE_Key
+	SignCount uint32 // Last signature counter reported by the authenticator
+	AAGUID    []byte // Model of the authenticator
+	Created   int64  // Unix time
+	LastUsed  int64  // Unix time of the last login (0 if never used)
+}
+
+// WebAuthnChallenge is the challenge of a pending WebAuthn ceremony.
+type WebAuthnChallenge struct {
+	ID    string // Base64url challenge
+	User  string // "" for passkey logins without username
+	Login bool   // Login or registration
+	Exp   int64  // Expire time (unix seconds)
+}
+
+// WebAuthnStore saves the WebAuthn credentials of the users and the challenges of the
+// pending ceremonies.
+//
+// This package includes SQLWebAuthnStore and MemoryWebAuthnStore.
+type WebAuthnStore interface {
+	// CreateCredential saves a new credential.
+	CreateCredential(credential WebAuthnCredential) error
+
+	// GetCredential returns the credential. Returns ErrCredentialNotFound if it not exists.
+	GetCredential(id string) (WebAuthnCredential, error)
+
+	// ListUserCredentials returns all credentials of the user, oldest first.
+	ListUserCredentials(user string) ([]WebAuthnCredential, error)
+
+	// UpdateSignCount saves the signature counter and the last use of the credential.
+	UpdateSignCount(id string, signCount uint32, lastUsed int64) error
+
+	// DeleteCredential deletes the credential.
+	DeleteCredential(id string) error
+
+	// DeleteUserCredentials deletes all credentials of the user.
+	DeleteUserCredentials(user string) error
+
+	// CreateChallenge saves the challenge of a new ceremony.
+	CreateChallenge(challenge WebAuthnChallenge) error
+
+	// GetChallenge returns the challenge. Returns ErrChallengeNotFound if it not exists.
+	GetChallenge(id string) (WebAuthnChallenge, error)
+
+	// DeleteChallenge deletes the challenge. Returns ErrChallengeNotFound if it not exists,
+	// so only one of several concurrent calls succeeds.
+	DeleteChallenge(id string) error
+
+	// PurgeExpiredChallenges deletes the challenges expired before [now].
+	PurgeExpiredChallenges(now int64) error
+}
+
+// ErrCredentialNotFound is returned by WebAuthnStore when the credential does not exist.
+var ErrCredentialNotFound = errors.New("webauthn credential not found")
+
+// ErrChallengeNotFound is returned by WebAuthnStore when the challenge does not exist.
+var ErrChallengeNotFound = errors.New("webauthn challenge not found")
+
+// MemoryWebAuthnStore is a concurrency-safe WebAuthnStore which keeps credentials in memory.
+type MemoryWebAuthnStore struct {
+	credentials map[string]WebAuthnCredential
+	challenges  map[string]WebAuthnChallenge
+	mtx         *sync.Mutex
+}
+
+// NewMemoryWebAuthnStore creates an empty MemoryWebAuthnStore.
+func NewMemoryWebAuthnStore() *MemoryWebAuthnStore {
+	return &MemoryWebAuthnStore{
+		credentials: make(map[string]WebAuthnCredential),
+		challenges:  make(map[string]WebAuthnChallenge),
+		mtx:         &sync.Mutex{},
+	}
+}
+
+func (s *MemoryWebAuthnStore) CreateCredential(credential WebAuthnCredential) error {
+	s.mtx.Lock()
+	s.credentials[credential.ID] = credential
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryWebAuthnStore) GetCredential(id string) (WebAuthnCredential, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	credential, ok := s.credentials[id]
+	if !ok {
+		return WebAuthnCredential{}, ErrCredentialNotFound
+	}
+	return credential, nil
+}
+
+func (s *MemoryWebAuthnStore) ListUserCredentials(user string) ([]WebAuthnCredential, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	credentials := []WebAuthnCredential{}
+	for _, credential := range s.credentials {
+		if credential.User == user {
+			credentials = append(credentials, credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Created < credentials[j].Created })
+	return credentials, nil
+}
+
+func (s *MemoryWebAuthnStore) UpdateSignCount(id string, signCount uint32, lastUsed int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	credential, ok := s.credentials[id]
+	if !ok {
+		return ErrCredentialNotFound
+	}
+	credential.SignCount = signCount
+	credential.LastUsed = lastUsed
+	s.credentials[id] = credential
+	return nil
+}
+
+func (s *MemoryWebAuthnStore) DeleteCredential(id string) error {
+	s.mtx.Lock()
+	delete(s.credentials, id)
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryWebAuthnStore) DeleteUserCredentials(user string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, credential := range s.credentials {
+		if credential.User == user {
+			delete(s.credentials, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryWebAuthnStore) CreateChallenge(challenge WebAuthnChallenge) error {
+	s.mtx.Lock()
+	s.challenges[challenge.ID] = challenge
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *MemoryWebAuthnStore) GetChallenge(id string) (WebAuthnChallenge, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	challenge, ok := s.challenges[id]
+	if !ok {
+		return WebAuthnChallenge{}, ErrChallengeNotFound
+	}
+	return challenge, nil
+}
+
+func (s *MemoryWebAuthnStore) DeleteChallenge(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.challenges[id]; !ok {
+		return ErrChallengeNotFound
+	}
+	delete(s.challenges, id)
+	return nil
+}
+
+func (s *MemoryWebAuthnStore) PurgeExpiredChallenges(now int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, challenge := range s.challenges {
+		if challenge.Exp < now {
+			delete(s.challenges, id)
+		}
+	}
+	return nil
+}
+
+// SQLWebAuthnStore is a WebAuthnStore which saves credentials in the table
+// "Webauthn_credentials" and challenges in the table "Webauthn_challenges" of a
+// database/sql database.
+type SQLWebAuthnStore struct {
+	db *sql.DB
+}
+
+// NewSQLWebAuthnStore creates the tables "Webauthn_credentials" and "Webauthn_challenges"
+// in the database if not exist.
+func NewSQLWebAuthnStore(db *sql.DB) (*SQLWebAuthnStore, error) {
+	_, err := db.Exec(qryCreateWebAuthnTable)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(qryCreateWebAuthnIndex)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(qryCreateWebAuthnChallengesTable)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLWebAuthnStore{db}, nil
+}
+
+func (s *SQLWebAuthnStore) CreateCredential(c WebAuthnCredential) error {
+	_, err := s.db.Exec(qryNewWebAuthnCredential, c.ID, c.User, c.PublicKey, c.SignCount, c.AAGUID, c.Created, c.LastUsed)
+	return err
+}
+
+func (s *SQLWebAuthnStore) GetCredential(id string) (WebAuthnCredential, error) {
+	credential, err := scanCredential(s.db.QueryRow(qryGetWebAuthnCredential, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebAuthnCredential{}, ErrCredentialNotFound
+	}
+	return credential, err
+}
+
+func (s *SQLWebAuthnStore) ListUserCredentials(user string) ([]WebAuthnCredential, error) {
+	rows, err := s.db.Query(qryListWebAuthnCredentials, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *SQLWebAuthnStore) UpdateSignCount(id string, signCount uint32, lastUsed int64) error {
+	_, err := s.db.Exec(qryUpdateSignCount, signCount, lastUsed, id)
+	return err
+}
+
+func (s *SQLWebAuthnStore) DeleteCredential(id string) error {
+	_, err := s.db.Exec(qryDeleteWebAuthnCredential, id)
+	return err
+}
+
+func (s *SQLWebAuthnStore) DeleteUserCredentials(user string) error {
+	_, err := s.db.Exec(qryDeleteUserWebAuthnCredentials, user)
+	return err
+}
+
+func (s *SQLWebAuthnStore) CreateChallenge(challenge WebAuthnChallenge) error {
+	_, err := s.db.Exec(qryNewWebAuthnChallenge, challenge.ID, challenge.User, challenge.Login, challenge.Exp)
+	return err
+}
+
+func (s *SQLWebAuthnStore) GetChallenge(id string) (WebAuthnChallenge, error) {
+	challenge := WebAuthnChallenge{ID: id}
+	err := s.db.QueryRow(qryGetWebAuthnChallenge, id).Scan(&challenge.User, &challenge.Login, &challenge.Exp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebAuthnChallenge{}, ErrChallengeNotFound
+	}
+	if err != nil {
+		return WebAuthnChallenge{}, err
+	}
+	return challenge, nil
+}
+
+func (s *SQLWebAuthnStore) DeleteChallenge(id string) error {
+	result, err := s.db.Exec(qryDeleteWebAuthnChallenge, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrChallengeNotFound
+	}
+	return nil
+}
+
+func (s *SQLWebAuthnStore) PurgeExpiredChallenges(now int64) error {
+	_, err := s.db.Exec(qryPurgeWebAuthnChallenges, now)
+	return err
+}
+
+func scanCredential(row rowScanner) (WebAuthnCredential, error) {
+	c := WebAuthnCredential{}
+	err := row.Scan(&c.ID, &c.User, &c.PublicKey, &c.SignCount, &c.AAGUID, &c.Created, &c.LastUsed)
+	return c, err
+}